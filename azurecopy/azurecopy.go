@@ -4,21 +4,22 @@ import (
 	"azurecopy/azurecopy/handlers"
 	"azurecopy/azurecopy/models"
 	"azurecopy/azurecopy/utils"
+	"azurecopy/azurecopy/utils/containerutils"
+	"azurecopy/azurecopy/utils/filterutils"
 	"os"
 
-	//	"azurecopy/azurecopy/utils/helpers"
 	"azurecopy/azurecopy/utils/misc"
+	"errors"
 	"fmt"
+	"io"
+	"path/filepath"
 	"regexp"
 	"strings"
-
-	"sync"
+	"sync/atomic"
 
 	log "github.com/Sirupsen/logrus"
 )
 
-var wg sync.WaitGroup
-
 // AzureCopy main client class.
 // Have one instance of this PER cloud env.
 // ie one for source and one for destination.
@@ -36,13 +37,26 @@ type AzureCopy struct {
 	// handlers
 	sourceHandler handlers.CloudHandlerInterface
 	destHandler   handlers.CloudHandlerInterface
+
+	// pool of goroutines doing the copying. One copy job at a time per AzureCopy.
+	pool *copyPool
+
+	// set when pending copies have been cancelled. Any blobs not yet started are skipped.
+	cancelled int32
+
+	// optional record of the state of every blob, so the job can be resumed.
+	journal *Journal
+
+	// which blobs are listed/copied.
+	filter *filterutils.BlobFilter
 }
 
 // NewAzureCopy factory time!
 // want to know source/dest up front.
-func NewAzureCopy(config misc.CloudConfig) *AzureCopy {
+func NewAzureCopy(config misc.CloudConfig) (*AzureCopy, error) {
 	ac := AzureCopy{}
 	ac.config = config
+	ac.pool = newCopyPool(config.ConcurrentCount)
 
 	// technically duped from config, but just easier to reference.
 	ac.destURL = config.Configuration[misc.Dest]
@@ -51,10 +65,87 @@ func NewAzureCopy(config misc.CloudConfig) *AzureCopy {
 	ac.sourceCloudType, _ = ac.getCloudType(ac.sourceURL)
 	ac.destCloudType, _ = ac.getCloudType(ac.destURL)
 
-	ac.sourceHandler = ac.GetHandlerForURL(ac.sourceURL, true, true)
-	ac.destHandler = ac.GetHandlerForURL(ac.destURL, false, true)
+	// SAS tokens on Azure URLs are credentials (picked up by the handler), not part of the path.
+	if ac.sourceCloudType == models.Azure || ac.sourceCloudType == models.AzureFile {
+		ac.sourceURL, _ = utils.SplitAzureSAS(ac.sourceURL)
+	}
+	if ac.destCloudType == models.Azure || ac.destCloudType == models.AzureFile {
+		ac.destURL, _ = utils.SplitAzureSAS(ac.destURL)
+	}
+
+	var err error
+	ac.filter, err = filterutils.NewBlobFilter(config.IncludePatterns, config.ExcludePatterns, config.IncludeRegex, config.ExcludeRegex,
+		config.MinSize, config.MaxSize, config.ModifiedAfter, config.ModifiedBefore)
+	if err != nil {
+		return nil, err
+	}
 
-	return &ac
+	ac.sourceHandler, err = ac.GetHandlerForURL(ac.sourceURL, true, true)
+	if err != nil {
+		return nil, err
+	}
+
+	ac.destHandler, err = ac.GetHandlerForURL(ac.destURL, false, true)
+	if err != nil {
+		return nil, err
+	}
+
+	journalPath := config.Configuration[misc.JournalPath]
+	if journalPath != "" {
+		if config.Resume {
+			ac.journal, err = OpenJournal(journalPath, ac.sourceURL, ac.destURL)
+		} else {
+			ac.journal, err = NewJournal(journalPath, ac.sourceURL, ac.destURL)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &ac, nil
+}
+
+// Close releases anything held open by the job (ie the journal, and handler connections/servers).
+// Every handler is closed even if one fails, the first error is returned.
+func (ac *AzureCopy) Close() error {
+	var closeErr error
+
+	for _, handler := range []handlers.CloudHandlerInterface{ac.sourceHandler, ac.destHandler} {
+		if closer, ok := handler.(io.Closer); ok {
+			if err := closer.Close(); err != nil && closeErr == nil {
+				closeErr = err
+			}
+		}
+	}
+
+	if ac.journal != nil {
+		if err := ac.journal.Close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+
+	return closeErr
+}
+
+// newCopyResult creates the result for a job. Results are also recorded in the journal, if there is one.
+func (ac *AzureCopy) newCopyResult() *CopyResult {
+	result := NewCopyResult()
+	result.journal = ac.journal
+	return result
+}
+
+// submitBlob queues the blob for copying. Blobs the journal says are already copied are skipped.
+func (ac *AzureCopy) submitBlob(blob models.SimpleBlob, result *CopyResult) {
+	if ac.journal != nil {
+		if ac.journal.State(blob.DestName) == BlobDone {
+			log.Debugf("%s already copied", blob.DestName)
+			result.AddSkipped(blob.URL, blob.DestName, errors.New("already copied (journal)"))
+			return
+		}
+		ac.journal.SetState(blob.DestName, blob.URL, BlobPending, nil)
+	}
+
+	ac.pool.Submit(blob)
 }
 
 // Get Cloud Type...
@@ -62,12 +153,43 @@ func NewAzureCopy(config misc.CloudConfig) *AzureCopy {
 func (ac *AzureCopy) getCloudType(url string) (cloudType models.CloudType, isEmulator bool) {
 	lowerURL := strings.ToLower(url)
 
+	// local files.
+	if strings.HasPrefix(lowerURL, "file://") {
+		return models.Filesystem, false
+	}
+
+	// FTP/FTPS
+	if strings.HasPrefix(lowerURL, "ftp://") || strings.HasPrefix(lowerURL, "ftps://") {
+		return models.FTP, false
+	}
+
+	// SFTP
+	if strings.HasPrefix(lowerURL, "sftp://") {
+		return models.SFTP, false
+	}
+
+	// S3 compatible (MinIO, Ceph, Wasabi etc). Checked first since the endpoint could be anything.
+	if utils.IsS3EndpointURL(url, ac.config) {
+		return models.S3, false
+	}
+
+	// Azure via a custom endpoint (sovereign cloud, private endpoint, Azurite elsewhere etc).
+	if utils.IsAzureEndpointURL(url, ac.config) {
+		return models.Azure, false
+	}
+
 	// Azure
 	match, _ := regexp.MatchString("blob.core.windows.net", lowerURL)
 	if match {
 		return models.Azure, false
 	}
 
+	// Azure File Storage
+	match, _ = regexp.MatchString("file.core.windows.net", lowerURL)
+	if match {
+		return models.AzureFile, false
+	}
+
 	// Dropbox
 	match, _ = regexp.MatchString("dropbox.com", lowerURL)
 	if match {
@@ -75,13 +197,12 @@ func (ac *AzureCopy) getCloudType(url string) (cloudType models.CloudType, isEmu
 	}
 
 	// Azure emulator
-	match, _ = regexp.MatchString("127.0.0.1:10000", lowerURL)
+	match, _ = regexp.MatchString("(127.0.0.1|localhost):10000", lowerURL)
 	if match {
 		return models.Azure, true
 	}
 
 	// S3
-	// need to think about S3 compatible devices. TODO(kpfaulkner)
 	match, _ = regexp.MatchString("amazonaws.com", lowerURL)
 	if match {
 		return models.S3, false
@@ -96,52 +217,135 @@ func (ac *AzureCopy) ListContainer() (*models.SimpleContainer, error) {
 
 	container, err := ac.sourceHandler.GetSpecificSimpleContainer(ac.sourceURL)
 	if err != nil {
-		log.Fatal("ListContainer failed ", err)
+		log.Errorf("ListContainer failed %s", err)
+		return nil, err
 	}
 
 	// get the blobs for the deepest vdir which is part of the URL.
-	ac.sourceHandler.GetContainerContents(container)
+	// Non recursive listings want the immediate children of the URL, so can't be pushed down.
+	listContainer, prefix := container, ""
+	if !ac.config.NonRecursive {
+		listContainer, prefix = ac.pushDownListingPrefix(container, ac.sourceCloudType)
+	}
+
+	err = ac.sourceHandler.GetContainerContents(listContainer)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ac.filter.IsEmpty() {
+		ac.filterContainer(listContainer, prefix)
+	}
+
+	// handlers that can't list hierarchically (only Azure can) have listed everything, so drop the grandchildren.
+	if ac.config.NonRecursive {
+		for _, subContainer := range container.ContainerSlice {
+			subContainer.BlobSlice = []*models.SimpleBlob{}
+			subContainer.ContainerSlice = []*models.SimpleContainer{}
+			subContainer.Populated = false
+		}
+	}
+
 	return container, nil
 }
 
+// pushDownListingPrefix descends from the container into the directory every blob passing the filter must be in,
+// so the cloud only lists what we might actually want. Only done for clouds that list by prefix (Azure and S3).
+// Returns the container to list and its path relative to the original container.
+func (ac *AzureCopy) pushDownListingPrefix(container *models.SimpleContainer, cloudType models.CloudType) (*models.SimpleContainer, string) {
+
+	listingPrefix := strings.TrimSuffix(ac.filter.ListingPrefix(), "/")
+	if listingPrefix == "" || (cloudType != models.Azure && cloudType != models.S3) {
+		return container, ""
+	}
+
+	log.Debugf("pushing listing prefix %s down to %s", listingPrefix, container.Name)
+	currentContainer := container
+	for _, segment := range strings.Split(listingPrefix, "/") {
+		subContainer := containerutils.GetContainerByName(currentContainer, segment)
+		subContainer.Origin = container.Origin
+		currentContainer = subContainer
+	}
+
+	return currentContainer, listingPrefix
+}
+
+// filterContainer removes the blobs that don't pass the filter from the container (and subcontainers).
+// prefix is the path of the container relative to the one being listed.
+func (ac *AzureCopy) filterContainer(container *models.SimpleContainer, prefix string) {
+
+	blobSlice := []*models.SimpleBlob{}
+	for _, blob := range container.BlobSlice {
+		if ac.filter.Matches(joinBlobPath(prefix, blob.Name), blob.Properties) {
+			blobSlice = append(blobSlice, blob)
+		}
+	}
+	container.BlobSlice = blobSlice
+
+	for _, subContainer := range container.ContainerSlice {
+		ac.filterContainer(subContainer, joinBlobPath(prefix, subContainer.Name))
+	}
+}
+
+// joinBlobPath joins a (possibly empty) prefix and name with /
+func joinBlobPath(prefix string, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "/" + name
+}
+
 // CreateContainer lists containers/blobs in URL
 func (ac *AzureCopy) CreateContainer(containerName string) error {
 	log.Debugf("CreateContainer %s", containerName)
 
 	_, err := ac.sourceHandler.CreateContainer(containerName)
 	if err != nil {
-		log.Fatal("CreateContainer failed ", err)
+		log.Errorf("CreateContainer failed %s", err)
+		return err
 	}
 
 	return nil
 }
 
 // CopyBlobByURL copy a blob from one URL to another.
-func (ac *AzureCopy) CopyBlobByURL(replaceExisting bool, useCopyBlobFlag bool) error {
+// Individual blob failures do NOT cause an error to be returned, they are recorded in the CopyResult.
+// An error is only returned if the job couldn't run at all (eg. bad source or destination).
+func (ac *AzureCopy) CopyBlobByURL(replaceExisting bool, useCopyBlobFlag bool) (*CopyResult, error) {
 
 	log.Debugf("CopyBlobByURL sourceURL %s", ac.sourceURL)
+
+	// server side copying is done by Azure, so the destination MUST be Azure.
+	if useCopyBlobFlag {
+		if _, ok := ac.destHandler.(handlers.ServerSideCopyHandler); !ok {
+			return nil, errors.New("CopyBlob flag can only be used with an Azure blob or file destination")
+		}
+	}
+
 	var err error
+	var result *CopyResult
 	if misc.GetLastChar(ac.sourceURL) == "/" || misc.GetLastChar(ac.sourceURL) == "\\" {
 		// copying a directory/vdir worth of stuff....
-		err = ac.CopyContainerByURL(ac.sourceURL, ac.destURL, replaceExisting, useCopyBlobFlag)
+		result, err = ac.CopyContainerByURL(ac.sourceURL, ac.destURL, replaceExisting, useCopyBlobFlag)
 	} else {
-		err = ac.CopySingleBlobByURL(ac.sourceURL, ac.destURL, replaceExisting, useCopyBlobFlag)
+		result, err = ac.CopySingleBlobByURL(ac.sourceURL, ac.destURL, replaceExisting, useCopyBlobFlag)
 	}
 
 	if err != nil {
-		log.Fatal("CopyBlobByUrl error ", err)
+		log.Errorf("CopyBlobByUrl error %s", err)
+		return result, err
 	}
-	return nil
+	return result, nil
 }
 
 // CopySingleBlobByURL copies a single blob referenced by URL to a destination URL
-// useCopyBlobFlag currently unused!! TODO(kpfaulkner)
-func (ac *AzureCopy) CopySingleBlobByURL(sourceURL string, destURL string, replaceExisting bool, useCopyBlobFlag bool) error {
+// If useCopyBlobFlag is set the destination copies the blob server side, from a presigned URL of the source.
+func (ac *AzureCopy) CopySingleBlobByURL(sourceURL string, destURL string, replaceExisting bool, useCopyBlobFlag bool) (*CopyResult, error) {
 	fmt.Printf("Copying single blob %s to %s\n", sourceURL, destURL)
 
 	simpleSourceBlob, err := ac.sourceHandler.GetSpecificSimpleBlob(sourceURL)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// prune destination to just be last element of blobname.
@@ -150,24 +354,54 @@ func (ac *AzureCopy) CopySingleBlobByURL(sourceURL string, destURL string, repla
 	simpleSourceBlob.DestName = sp[len(sp)-1]
 
 	log.Debugf("single blob is %v", simpleSourceBlob)
-	destContainer, err := ac.destHandler.GetSpecificSimpleContainer(destURL)
-	if err != nil {
-		return err
+
+	result := ac.newCopyResult()
+
+	if !ac.filter.Matches(simpleSourceBlob.DestName, simpleSourceBlob.Properties) {
+		result.AddSkipped(sourceURL, simpleSourceBlob.DestName, errors.New("excluded by filter"))
+		return result, nil
 	}
 
-	copyChannel := make(chan models.SimpleBlob, 1)
+	// a local destination can name the file rather than the directory to copy into.
+	if ac.destCloudType == models.Filesystem {
+		destURL, simpleSourceBlob.DestName, err = singleFileDestination(destURL, simpleSourceBlob.DestName)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	copyChannel <- *simpleSourceBlob
+	destContainer, err := ac.destHandler.GetSpecificSimpleContainer(destURL)
+	if err != nil {
+		return nil, err
+	}
 
 	// launch go routines for copying.
-	ac.launchCopyGoRoutines(destContainer, replaceExisting, copyChannel, useCopyBlobFlag)
+	ac.startCopyPool(destContainer, replaceExisting, useCopyBlobFlag, result)
 
-	// finished copying contents to channel. Close now?
-	close(copyChannel)
+	ac.submitBlob(*simpleSourceBlob, result)
 
 	// wait for all copying to be done.
-	wg.Wait()
-	return nil
+	ac.pool.Wait()
+	return result, nil
+}
+
+// singleFileDestination splits a filesystem destination naming a file (ie not ending in a separator and not an
+// existing directory) into the directory and file name. Otherwise the destination is the directory to copy into.
+func singleFileDestination(destURL string, destName string) (string, string, error) {
+	if misc.GetLastChar(destURL) == "/" || misc.GetLastChar(destURL) == "\\" {
+		return destURL, destName, nil
+	}
+
+	destPath, err := handlers.FilesystemPathFromURL(destURL)
+	if err != nil {
+		return "", "", err
+	}
+
+	if fi, err := os.Stat(destPath); err == nil && fi.IsDir() {
+		return destURL, destName, nil
+	}
+
+	return filepath.Dir(destPath) + string(os.PathSeparator), filepath.Base(destPath), nil
 }
 
 // CopyContainerByURL copies blobs/containers from a URL to a destination URL.
@@ -175,36 +409,41 @@ func (ac *AzureCopy) CopySingleBlobByURL(sourceURL string, destURL string, repla
 // The plan is to consolidate both listing and copying into using the same methods, but for now
 // want to make sure copying at least is able to start copying blobs before the listing is finished.
 // So will use GoRoutines to concurrently retrieve list of blobs and another for writing to destination.
-func (ac *AzureCopy) CopyContainerByURL(sourceURL string, destURL string, replaceExisting bool, useCopyBlobFlag bool) error {
-	log.Debugf("CopyContainerByURL %s to %s", sourceURL, destURL )
+func (ac *AzureCopy) CopyContainerByURL(sourceURL string, destURL string, replaceExisting bool, useCopyBlobFlag bool) (*CopyResult, error) {
+	log.Debugf("CopyContainerByURL %s to %s", sourceURL, destURL)
 	deepestContainer, err := ac.sourceHandler.GetSpecificSimpleContainer(sourceURL)
 	if err != nil {
-		log.Fatal("CopyContainerByURL failed source: ", err)
+		log.Errorf("CopyContainerByURL failed source: %s", err)
+		return nil, err
 	}
 	log.Debugf("deepest source container is %s", deepestContainer.Name)
 
 	deepestDestinationContainer, err := ac.destHandler.GetSpecificSimpleContainer(destURL)
 	if err != nil {
-		log.Fatal("CopyContainerByURL failed dest: ", err)
+		log.Errorf("CopyContainerByURL failed dest: %s", err)
+		return nil, err
 	}
 	log.Debugf("deepest dest container %s", deepestDestinationContainer.Name)
 
-	// make channel for reading from cloud.
-	readChannel := make(chan models.SimpleContainer, 1000)
+	result := ac.newCopyResult()
 
-	// channel for individual blobs (not containers) which will be read and copied.
-	copyChannel := make(chan models.SimpleBlob, 1000)
+	// make channel for reading from cloud.
+	// Kept small, the copy pool applies back-pressure to the listing so we don't list
+	// the entire source before copying anything.
+	readChannel := make(chan models.SimpleContainer, 10)
 
 	// launch go routines for copying.
-	ac.launchCopyGoRoutines(deepestDestinationContainer, replaceExisting, copyChannel, useCopyBlobFlag)
+	ac.startCopyPool(deepestDestinationContainer, replaceExisting, useCopyBlobFlag, result)
 
 	// get container contents over channel.
 	// get the blobs for the deepest vdir which is part of the URL.
 	// The readChannel will be populated with containers that are populated from the "REAL" cloud container. ie Azure Container or S3 bucket.
-	go ac.sourceHandler.GetContainerContentsOverChannel(*deepestContainer, readChannel)
-	if err != nil {
-		log.Fatalf("CopyContainerByURL err %s", err)
-	}
+	// handler closes the readChannel when done, regardless of error.
+	listContainer, prefix := ac.pushDownListingPrefix(deepestContainer, ac.sourceCloudType)
+	listErrChannel := make(chan error, 1)
+	go func() {
+		listErrChannel <- ac.sourceHandler.GetContainerContentsOverChannel(*listContainer, readChannel)
+	}()
 
 	for {
 		// get data read.
@@ -216,57 +455,69 @@ func (ac *AzureCopy) CopyContainerByURL(sourceURL string, destURL string, replac
 
 		containerDetails.DisplayContainer("")
 
-		// populate the copyChannel with individual blobs.
-		ac.populateCopyChannel(&containerDetails, "", copyChannel)
+		// populate the copy pool with individual blobs.
+		ac.populateCopyChannel(&containerDetails, prefix, result)
 	}
 
-	// finished copying contents to channel. Close now?
-	close(copyChannel)
-
 	// wait for all copying to be done.
-	// wait for all copying to be done.
-	wg.Wait()
-	return nil
-}
+	ac.pool.Wait()
 
-// launchCopyGoRoutines starts a number of Go Routines used for copying contents.
-func (ac *AzureCopy) launchCopyGoRoutines(destContainer *models.SimpleContainer, replaceExisting bool, copyChannel chan models.SimpleBlob, useCopyBlobFlag bool) {
+	// listing failed part way. Whatever was listed has been copied, but the job is incomplete.
+	listErr := <-listErrChannel
+	if listErr != nil {
+		log.Errorf("CopyContainerByURL listing failed %s", listErr)
+		return result, listErr
+	}
 
-	ac.config.ConcurrentCount = 1
+	return result, nil
+}
 
-	log.Debugf("launching %d goroutines", ac.config.ConcurrentCount)
-	for i := 0; i < int(ac.config.ConcurrentCount); i++ {
-		wg.Add(1)
+// startCopyPool starts the pool of goroutines used for copying contents.
+// Blobs are then fed to the pool via populateCopyChannel (or Submit).
+func (ac *AzureCopy) startCopyPool(destContainer *models.SimpleContainer, replaceExisting bool, useCopyBlobFlag bool, result *CopyResult) {
 
-		if useCopyBlobFlag {
-			go ac.copyBlobFromChannelUsingCopyBlobFlag(destContainer, replaceExisting, copyChannel)
-		} else {
-			go ac.copyBlobFromChannel(destContainer, replaceExisting, copyChannel)
+	copyFunc := func(blob models.SimpleBlob) {
+		ac.copyBlob(destContainer, replaceExisting, blob, result)
+	}
+
+	if useCopyBlobFlag {
+		copyFunc = func(blob models.SimpleBlob) {
+			ac.copyBlobUsingCopyBlobFlag(destContainer, replaceExisting, blob, result)
 		}
 	}
+
+	ac.pool.Start(func(blob models.SimpleBlob) {
+		// result records done/failed in the journal. If we die before then, the blob is retried on resume.
+		if ac.journal != nil {
+			ac.journal.SetState(blob.DestName, blob.URL, BlobInProgress, nil)
+		}
+		copyFunc(blob)
+	})
 }
 
-// populateCopyChannel copies blobs into channel for later copying.
-func (ac *AzureCopy) populateCopyChannel(sourceContainer *models.SimpleContainer, prefix string, copyChannel chan models.SimpleBlob) error {
+// populateCopyChannel submits blobs to the copy pool. Blocks if the pool is busy.
+func (ac *AzureCopy) populateCopyChannel(sourceContainer *models.SimpleContainer, prefix string, result *CopyResult) {
 
-	log.Debugf("sourcecontainer blobslice size %d", len(sourceContainer.BlobSlice))
-	log.Debugf("populateCopyChannel ContainerSlice size %d", len(sourceContainer.ContainerSlice))
+	log.Debugf("populateCopyChannel container %s prefix %s", sourceContainer.Name, prefix)
 
-	if len(sourceContainer.BlobSlice) > 0 {
-		log.Debugf("first blob is %s", sourceContainer.BlobSlice[0].Name)
-	}
+	visitBlobs(sourceContainer, prefix, func(blob *models.SimpleBlob) {
+		if !ac.filter.Matches(blob.DestName, blob.Properties) {
+			log.Debugf("%s excluded by filter", blob.DestName)
+			return
+		}
 
-	if len(sourceContainer.ContainerSlice) > 0 {
-		log.Debugf("first container is %s", sourceContainer.ContainerSlice[0].Name)
-	}
+		log.Debugf("Adding blob %s to channel", blob.URL)
+		ac.submitBlob(*blob, result)
+	})
+}
 
-	log.Debugf("populateCopyChannel prefix %s", prefix)
-	log.Debugf("populateCopyChannel container %s", sourceContainer.Name)
+// visitBlobs calls visit for every blob in the container (and its subcontainers).
+// DestName of each blob is set to its path relative to the container, eg. vdir1/vdir2/myblob
+func visitBlobs(sourceContainer *models.SimpleContainer, prefix string, visit func(blob *models.SimpleBlob)) {
 
-	// copy all blobs
-	for _, blob := range sourceContainer.BlobSlice {
+	log.Debugf("visitBlobs blobslice size %d containerSlice size %d", len(sourceContainer.BlobSlice), len(sourceContainer.ContainerSlice))
 
-		log.Debugf("populateCopyChannel blobname %s", blob.Name)
+	for _, blob := range sourceContainer.BlobSlice {
 		if prefix != "" {
 			blob.DestName = prefix + "/" + blob.Name
 		} else {
@@ -274,13 +525,9 @@ func (ac *AzureCopy) populateCopyChannel(sourceContainer *models.SimpleContainer
 		}
 
 		log.Debugf("changing destname %s", blob.DestName)
-		log.Debugf("Adding blob %s to channel", blob.URL)
-		copyChannel <- *blob
+		visit(blob)
 	}
 
-	log.Debugf("DB populateCopyChannel name %s", sourceContainer.Name)
-	log.Debugf("populateCopyChannel containerSlice size %d", len(sourceContainer.ContainerSlice))
-
 	for _, container := range sourceContainer.ContainerSlice {
 		log.Debugf("container name is %s", container.Name)
 		var newPrefix string
@@ -290,152 +537,175 @@ func (ac *AzureCopy) populateCopyChannel(sourceContainer *models.SimpleContainer
 			newPrefix = container.Name
 		}
 
-		err := ac.populateCopyChannel(container, newPrefix, copyChannel)
-		if err != nil {
-			log.Fatal(err)
-		}
+		visitBlobs(container, newPrefix, visit)
 	}
+}
 
-	return nil
+// skipExistingBlob checks if the blob already exists at the destination and should be skipped.
+// Any failure checking is recorded as a failure for the blob (and it is skipped).
+func (ac *AzureCopy) skipExistingBlob(destContainer *models.SimpleContainer, blob *models.SimpleBlob, result *CopyResult) bool {
+	exists, err := ac.destHandler.BlobExists(*destContainer, blob.DestName)
+	if err != nil {
+		log.Debugf("Unable to copy %s\n", blob.URL)
+		result.AddFailed(blob.URL, blob.DestName, err)
+		return true
+	}
+
+	if exists {
+		fmt.Printf("Skipping %s\n", blob.URL)
+		result.AddSkipped(blob.URL, blob.DestName, errors.New("blob already exists"))
+		return true
+	}
+
+	return false
 }
 
-// copyBlobFromChannel reads blob from channel and copies it to destinationContainer
-func (ac *AzureCopy) copyBlobFromChannel(destContainer *models.SimpleContainer, replaceExisting bool, copyChannel chan models.SimpleBlob) {
+// copyBlob copies a single blob to destinationContainer
+// Failures are recorded in the result so the pool can move onto the next blob.
+func (ac *AzureCopy) copyBlob(destContainer *models.SimpleContainer, replaceExisting bool, blob models.SimpleBlob, result *CopyResult) {
 
-	defer wg.Done()
+	// check if we need to skip it.
+	if !replaceExisting && ac.skipExistingBlob(destContainer, &blob, result) {
+		return
+	}
 
-	for {
-		blob, ok := <-copyChannel
-		if !ok {
-			log.Debugf("Closing channel for copyBlobFromChannel")
-			// closed...   so all writing is done?  Or what?
-			return
-		}
+	sourceURL := blob.URL
+	destName := blob.DestName
 
-		// check if we need to skip it.
-		if !replaceExisting {
-			exists, err := ac.destHandler.BlobExists(*destContainer, blob.DestName)
-			if err != nil {
-				log.Debugf("Unable to copy %s\n", blob.URL)
-				continue
-			}
+	var err error
 
-			if exists {
-				fmt.Printf("Skipping %s\n", blob.URL)
-				continue
-			}
-		}
+	// destinations that can't consume a stream get the blob populated (memory or cache) first.
+	if ac.destHandler.RequiresSeekableBody() {
+		err = ac.copyBlobViaCache(destContainer, &blob)
+	} else {
+		err = ac.streamBlob(destContainer, &blob)
+	}
 
-		log.Debugf("Read blob %s", blob.URL)
-		ac.ReadBlob(&blob)
+	if err != nil {
+		log.Errorf("Unable to copy %s : %s", sourceURL, err)
+		result.AddFailed(sourceURL, destName, err)
+		return
+	}
 
-		// rename name for destination. HACK!
-		blob.Name = blob.DestName
+	result.AddSucceeded(sourceURL, destName)
+}
+
+// copyBlobViaCache populates the blob (memory or cache) then writes it to the destination.
+func (ac *AzureCopy) copyBlobViaCache(destContainer *models.SimpleContainer, blob *models.SimpleBlob) error {
 
-		ac.WriteBlob(destContainer, &blob)
+	log.Debugf("Read blob %s", blob.URL)
+	err := ac.ReadBlob(blob)
+	if err != nil {
+		return err
 	}
+
+	// rename name for destination. HACK!
+	blob.Name = blob.DestName
+
+	return ac.WriteBlob(destContainer, blob)
 }
 
-// copyBlobFromChannelUsingCopyBlobFlag reads blob from channel, makes presigned URL (based on source blob) then triggers Azure CopyBlob operation.
-func (ac *AzureCopy) copyBlobFromChannelUsingCopyBlobFlag(destContainer *models.SimpleContainer, replaceExisting bool, copyChannel chan models.SimpleBlob) {
+// streamBlob copies the blob by piping the source stream directly into the destination.
+// Nothing is held in memory (beyond handler buffers) or cached to disk.
+func (ac *AzureCopy) streamBlob(destContainer *models.SimpleContainer, blob *models.SimpleBlob) error {
 
-	defer wg.Done()
+	log.Debugf("Stream blob %s", blob.URL)
+	reader, size, err := ac.sourceHandler.GetBlobReader(blob)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
 
-	//azureAccountName, azureAccountKey := utils.GetAzureCredentials(false, ac.config)
-    // azureHelper := helpers.NewAzureHelper(azureAccountName, azureAccountKey)
+	// rename name for destination. HACK!
+	blob.Name = blob.DestName
 
-	for {
-		blob, ok := <-copyChannel
-		if !ok {
-			// closed...   so all writing is done?  Or what?
-			return
-		}
+	return ac.destHandler.WriteBlobFromReader(destContainer, blob, reader, size)
+}
 
-		// check if we need to skip it.
-		if !replaceExisting {
-			exists, err := ac.destHandler.BlobExists(*destContainer, blob.DestName)
-			if err != nil {
-				log.Debugf("Unable to copy %s", blob.URL)
-				continue
-			}
+// copyBlobUsingCopyBlobFlag makes presigned URL (based on source blob) then triggers Azure CopyBlob operation.
+// Waits until Azure reports the copy as complete (or failed/aborted).
+func (ac *AzureCopy) copyBlobUsingCopyBlobFlag(destContainer *models.SimpleContainer, replaceExisting bool, blob models.SimpleBlob, result *CopyResult) {
 
-			if exists {
-				fmt.Printf("Skipping %s", blob.URL)
-				continue
-			}
-		}
+	if atomic.LoadInt32(&ac.cancelled) != 0 {
+		result.AddSkipped(blob.URL, blob.DestName, errors.New("cancelled"))
+		return
+	}
 
-		// generate presigned URL
-		url, err := ac.sourceHandler.GeneratePresignedURL(&blob)
-		if err != nil {
-			log.Errorf("Unable to generate presigned URL %s", blob.URL)
-			continue
-		}
+	// check if we need to skip it.
+	if !replaceExisting && ac.skipExistingBlob(destContainer, &blob, result) {
+		return
+	}
+
+	// generate presigned URL
+	url, err := ac.sourceHandler.GeneratePresignedURL(&blob)
+	if err != nil {
+		log.Errorf("Unable to generate presigned URL %s", blob.URL)
+		result.AddFailed(blob.URL, blob.DestName, err)
+		return
+	}
+
+	fmt.Printf("Copying %s to %s\n", blob.Name, destContainer.Name+"/"+blob.DestName)
+
+	// already confirmed dest is Azure (blob or file) in CopyBlobByURL
+	copyHandler := ac.destHandler.(handlers.ServerSideCopyHandler)
+	err = copyHandler.DoCopyBlobUsingAzureCopyBlobFlag(url, destContainer, blob.DestName, blob.Properties.Metadata)
+	if err != nil {
+		log.Errorf("CopyBlob of %s failed %s", blob.URL, err)
+		result.AddFailed(blob.URL, blob.DestName, err)
+		return
+	}
+
+	result.AddSucceeded(blob.URL, blob.DestName)
+}
 
-		fmt.Printf("displaying url just for the fun of it %s\n", url)
-		fmt.Printf("Copying %s to %s\n", blob.Name, destContainer.Name+"/"+blob.DestName)
-		//azureHelper.DoCopyBlobUsingAzureCopyBlobFlag(url, destContainer, blob.DestName)
+// CancelPendingCopies aborts any server side (CopyBlob flag) copies that are still in progress and
+// skips any blobs that haven't been started yet.
+func (ac *AzureCopy) CancelPendingCopies() error {
+	atomic.StoreInt32(&ac.cancelled, 1)
+
+	if copyHandler, ok := ac.destHandler.(handlers.ServerSideCopyHandler); ok {
+		return copyHandler.AbortPendingCopies()
 	}
+
+	return nil
 }
 
 // GetHandlerForURL returns the appropriate handler for a given cloud type.
-func (ac *AzureCopy) GetHandlerForURL(url string, isSource bool, cacheToDisk bool) handlers.CloudHandlerInterface {
+func (ac *AzureCopy) GetHandlerForURL(url string, isSource bool, cacheToDisk bool) (handlers.CloudHandlerInterface, error) {
 	cloudType, isEmulator := ac.getCloudType(url)
-	handler := utils.GetHandler(cloudType, isSource, ac.config, cacheToDisk, isEmulator)
-	return handler
+	return utils.GetHandler(cloudType, isSource, ac.config, cacheToDisk, isEmulator)
 }
 
-func (ac *AzureCopy) GetSourceRootContainer() models.SimpleContainer {
-	rootContainer := ac.sourceHandler.GetRootContainer()
-	return rootContainer
+func (ac *AzureCopy) GetSourceRootContainer() (models.SimpleContainer, error) {
+	return ac.sourceHandler.GetRootContainer()
 }
 
-func (ac *AzureCopy) GetDestRootContainer() models.SimpleContainer {
-	rootContainer := ac.destHandler.GetRootContainer()
-	return rootContainer
+func (ac *AzureCopy) GetDestRootContainer() (models.SimpleContainer, error) {
+	return ac.destHandler.GetRootContainer()
 }
 
 // GetContainerContents populates the container with data.
-func (ac *AzureCopy) GetContainerContents(container *models.SimpleContainer) {
+func (ac *AzureCopy) GetContainerContents(container *models.SimpleContainer) error {
 
 	// check where container came from.
 	if container.IsSource {
-		ac.sourceHandler.GetContainerContents(container)
-	} else {
-		ac.destHandler.GetContainerContents(container)
+		return ac.sourceHandler.GetContainerContents(container)
 	}
+
+	return ac.destHandler.GetContainerContents(container)
 }
 
 // GetDestContainerContents populates the container with data.
-func (ac *AzureCopy) GetDestContainerContents(container *models.SimpleContainer) {
-	ac.destHandler.GetContainerContents(container)
+func (ac *AzureCopy) GetDestContainerContents(container *models.SimpleContainer) error {
+	return ac.destHandler.GetContainerContents(container)
 }
 
 // ReadBlob reads a blob and keeps it in memory OR caches to disk.
 // (or in the special case of azure copyblob flag it will do something tricky, once I get to that part)
-func (ac *AzureCopy) ReadBlob(blob *models.SimpleBlob) {
+func (ac *AzureCopy) ReadBlob(blob *models.SimpleBlob) error {
 
 	log.Debugf("ReadBlob %s", blob.URL)
-	err := ac.sourceHandler.PopulateBlob(blob)
-
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-// doesDestinationBlobExist checks if the destination blob exists
-func (ac *AzureCopy) doesDestinationBlobExist(destContainer *models.SimpleContainer, sourceBlob *models.SimpleBlob) (bool, error) {
-
-	if destContainer == nil {
-		log.Debugf("dest container is nil")
-	} else {
-		log.Debugf("check dest, write dest loc %s ", destContainer.URL)
-	}
-
-	if err := ac.destHandler.WriteBlob(destContainer, sourceBlob); err != nil {
-		log.Fatal("WriteBlob kaboom ", err)
-	}
-	return false, nil
+	return ac.sourceHandler.PopulateBlob(blob)
 }
 
 // WriteBlob writes a source blob (can be from anywhere) to a destination container (can and probably will be a different cloud platform)
@@ -447,20 +717,23 @@ func (ac *AzureCopy) WriteBlob(destContainer *models.SimpleContainer, sourceBlob
 		log.Debugf("write dest loc %s\n", destContainer.URL)
 	}
 
-	if err := ac.destHandler.WriteBlob(destContainer, sourceBlob); err != nil {
-		log.Fatalf("WriteBlob kaboom %s\n", err)
-	}
+	err := ac.destHandler.WriteBlob(destContainer, sourceBlob)
 
-	// if cached delete the cache.
+	// if cached delete the cache, whether the write worked or not.
 	// make sure dont delete if just simply read from local filesystem (due to source being local file)
 	if !sourceBlob.BlobInMemory && ac.config.Command != misc.CommandCopyBlob && sourceBlob.Origin != models.Filesystem {
 		log.Debugf("About to delete cache file %s", sourceBlob.DataCachedAtPath)
-		err := os.Remove(sourceBlob.DataCachedAtPath)
-		if err != nil {
-			log.Errorf("Unable to delete cache file %s", err)
+		removeErr := os.Remove(sourceBlob.DataCachedAtPath)
+		if removeErr != nil {
+			log.Errorf("Unable to delete cache file %s", removeErr)
 		}
 		log.Debugf("deleted cache file %s", sourceBlob.DataCachedAtPath)
 	}
 
+	if err != nil {
+		log.Errorf("WriteBlob failed %s", err)
+		return err
+	}
+
 	return nil
 }
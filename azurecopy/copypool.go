@@ -0,0 +1,61 @@
+package azurecopy
+
+import (
+	"azurecopy/azurecopy/models"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// copyPool is a bounded pool of goroutines used for copying blobs.
+// Each AzureCopy owns its own pool (and WaitGroup) so multiple AzureCopy instances can
+// copy concurrently within the same process without interfering with each other.
+type copyPool struct {
+	workerCount int
+
+	// blobs waiting to be copied. Deliberately small so the listing can't race
+	// ahead of the copying (back-pressure).
+	copyChannel chan models.SimpleBlob
+
+	wg sync.WaitGroup
+}
+
+// newCopyPool factory time!
+func newCopyPool(workerCount uint) *copyPool {
+	cp := copyPool{}
+	cp.workerCount = int(workerCount)
+	if cp.workerCount < 1 {
+		cp.workerCount = 1
+	}
+
+	return &cp
+}
+
+// Start launches the workers. Each blob submitted to the pool is passed to copyFunc by
+// exactly one worker. Must be followed by Wait before the pool is started again.
+func (cp *copyPool) Start(copyFunc func(blob models.SimpleBlob)) {
+
+	cp.copyChannel = make(chan models.SimpleBlob, cp.workerCount)
+
+	log.Debugf("launching %d goroutines", cp.workerCount)
+	for i := 0; i < cp.workerCount; i++ {
+		cp.wg.Add(1)
+		go func() {
+			defer cp.wg.Done()
+			for blob := range cp.copyChannel {
+				copyFunc(blob)
+			}
+		}()
+	}
+}
+
+// Submit queues a blob for copying. Blocks while all workers are busy and the queue is full.
+func (cp *copyPool) Submit(blob models.SimpleBlob) {
+	cp.copyChannel <- blob
+}
+
+// Wait indicates no more blobs will be submitted and waits for the workers to finish.
+func (cp *copyPool) Wait() {
+	close(cp.copyChannel)
+	cp.wg.Wait()
+}
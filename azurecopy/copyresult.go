@@ -0,0 +1,104 @@
+package azurecopy
+
+import (
+	"fmt"
+	"sync"
+)
+
+// BlobResult is the outcome of copying an individual blob.
+type BlobResult struct {
+	// source URL of the blob.
+	SourceURL string
+
+	// name of the blob at the destination.
+	DestName string
+
+	// why the blob failed (or was skipped). nil on success.
+	Err error
+}
+
+// CopyResult is the summary of a copy job.
+// Blobs are recorded as they complete, so a single failing blob doesn't stop the rest of the job.
+type CopyResult struct {
+	Succeeded []BlobResult
+	Skipped   []BlobResult
+	Failed    []BlobResult
+
+	// blobs removed from the destination (mirroring).
+	Deleted []BlobResult
+
+	// multiple copy goroutines record results concurrently.
+	lock sync.Mutex
+
+	// if set, successes and failures are also recorded in the journal.
+	journal *Journal
+}
+
+// NewCopyResult factory time!
+func NewCopyResult() *CopyResult {
+	cr := CopyResult{}
+	cr.Succeeded = []BlobResult{}
+	cr.Skipped = []BlobResult{}
+	cr.Failed = []BlobResult{}
+	cr.Deleted = []BlobResult{}
+	return &cr
+}
+
+// AddSucceeded records a successfully copied blob.
+func (cr *CopyResult) AddSucceeded(sourceURL string, destName string) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	cr.Succeeded = append(cr.Succeeded, BlobResult{SourceURL: sourceURL, DestName: destName})
+
+	if cr.journal != nil {
+		cr.journal.SetState(destName, sourceURL, BlobDone, nil)
+	}
+}
+
+// AddSkipped records a blob that was deliberately not copied.
+func (cr *CopyResult) AddSkipped(sourceURL string, destName string, reason error) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	cr.Skipped = append(cr.Skipped, BlobResult{SourceURL: sourceURL, DestName: destName, Err: reason})
+}
+
+// AddFailed records a blob that failed to copy.
+func (cr *CopyResult) AddFailed(sourceURL string, destName string, err error) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	cr.Failed = append(cr.Failed, BlobResult{SourceURL: sourceURL, DestName: destName, Err: err})
+
+	if cr.journal != nil {
+		cr.journal.SetState(destName, sourceURL, BlobFailed, err)
+	}
+}
+
+// AddDeleted records a blob deleted from the destination.
+func (cr *CopyResult) AddDeleted(destName string) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	cr.Deleted = append(cr.Deleted, BlobResult{DestName: destName})
+}
+
+// HasFailures returns true if any blob failed to copy.
+func (cr *CopyResult) HasFailures() bool {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	return len(cr.Failed) > 0
+}
+
+// DisplaySummary prints the final report of the job, including every failure and why.
+func (cr *CopyResult) DisplaySummary() {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	fmt.Printf("Succeeded: %d Skipped: %d Failed: %d Deleted: %d\n", len(cr.Succeeded), len(cr.Skipped), len(cr.Failed), len(cr.Deleted))
+
+	for _, r := range cr.Failed {
+		name := r.SourceURL
+		if name == "" {
+			name = r.DestName
+		}
+		fmt.Printf("FAILED %s : %s\n", name, r.Err)
+	}
+}
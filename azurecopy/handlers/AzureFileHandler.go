@@ -0,0 +1,814 @@
+package handlers
+
+import (
+	"azurecopy/azurecopy/models"
+	"azurecopy/azurecopy/utils/blobutils"
+	"azurecopy/azurecopy/utils/containerutils"
+	"azurecopy/azurecopy/utils/helpers"
+	"azurecopy/azurecopy/utils/misc"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/Azure/azure-storage-file-go/2017-07-29/azfile"
+)
+
+// azureFileRangeSize the most that can be written by a single UploadRange.
+const azureFileRangeSize = azfile.FileMaxUploadRangeBytes
+
+// AzureFileHandler handles Azure File Storage (SMB shares). eg. https://myacct.file.core.windows.net/myshare/dir1/file
+// Unlike blob storage the directories are real, so they're created (and listed) explicitly.
+// Shares are the equivalent of Azure containers.
+type AzureFileHandler struct {
+	serviceURL azfile.ServiceURL
+
+	// used for signing SAS URLs. Only set if we have the account key.
+	credential *azfile.SharedKeyCredential
+
+	// determine if we're caching the blob to disk during copy operations.
+	// or if we're keeping it in memory
+	cacheToDisk   bool
+	cacheLocation string
+
+	// is this handler for the source or dest?
+	IsSource bool
+
+	// directories already created (or known to exist) when writing, keyed on share/path.
+	createdDirectories     map[string]bool
+	createdDirectoriesLock sync.Mutex
+
+	// server side copies (CopyBlob flag) that haven't completed yet.
+	// keyed on copy ID so they can be aborted if required.
+	pendingCopies     map[string]azfile.FileURL
+	pendingCopiesLock sync.Mutex
+
+	// how long presigned (SAS) URLs are valid for.
+	PresignedURLExpiry time.Duration
+
+	// files larger than DownloadChunkSize are downloaded as byte ranges, DownloadParallelism at a time.
+	DownloadChunkSize   int64
+	DownloadParallelism uint
+
+	// GetContainerContents only lists the immediate children (files and directories) of the directory.
+	// Directories are left unpopulated.
+	HierarchicalListing bool
+}
+
+// NewAzureFileHandler factory to create new one. Evil?
+// File storage (in this API version) only supports the account key or a SAS, not OAuth or anonymous access.
+func NewAzureFileHandler(credentials AzureCredentials, isSource bool, cacheToDisk bool) (*AzureFileHandler, error) {
+	afh := new(AzureFileHandler)
+
+	afh.cacheToDisk = cacheToDisk
+	dir, err := ioutil.TempDir("", "azurecopy")
+	if err != nil {
+		log.Errorf("Unable to create temp directory %s", err)
+		return nil, err
+	}
+
+	afh.cacheLocation = dir
+	afh.IsSource = isSource
+	afh.DownloadChunkSize = defaultDownloadChunkSize
+	afh.DownloadParallelism = defaultDownloadParallelism
+	afh.createdDirectories = make(map[string]bool)
+	afh.pendingCopies = make(map[string]azfile.FileURL)
+	afh.PresignedURLExpiry = defaultPresignedURLExpiry
+
+	u, err := url.Parse(fmt.Sprintf("https://%s.file.core.windows.net", credentials.AccountName))
+	if err != nil {
+		return nil, err
+	}
+
+	var credential azfile.Credential
+	switch {
+	case credentials.SAS != "":
+		log.Debug("using SAS for Azure Files")
+		u.RawQuery = credentials.SAS
+		credential = azfile.NewAnonymousCredential()
+
+	case credentials.AccountKey != "":
+		log.Debug("using account key for Azure Files")
+		afh.credential = azfile.NewSharedKeyCredential(credentials.AccountName, credentials.AccountKey)
+		credential = afh.credential
+
+	default:
+		return nil, errors.New("Azure Files needs an account key or SAS")
+	}
+
+	p := azfile.NewPipeline(credential, azfile.PipelineOptions{})
+	afh.serviceURL = azfile.NewServiceURL(*u, p)
+	return afh, nil
+}
+
+// GetRootContainer gets the shares of the account.
+func (afh *AzureFileHandler) GetRootContainer() (models.SimpleContainer, error) {
+
+	rootContainer := models.NewSimpleContainer()
+
+	for marker := (azfile.Marker{}); marker.NotDone(); {
+		ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+		resp, err := afh.serviceURL.ListSharesSegment(ctx, marker, azfile.ListSharesOptions{})
+		cancel()
+		if err != nil {
+			log.Errorf("Unable to list shares %s", err)
+			return models.SimpleContainer{}, err
+		}
+
+		for _, share := range resp.ShareItems {
+			sc := models.NewSimpleContainer()
+			sc.Name = share.Name
+			sc.Origin = models.AzureFile
+			rootContainer.ContainerSlice = append(rootContainer.ContainerSlice, sc)
+		}
+
+		marker = resp.NextMarker
+	}
+
+	return *rootContainer, nil
+}
+
+// BlobExists checks if the file exists.
+func (afh *AzureFileHandler) BlobExists(container models.SimpleContainer, blobName string) (bool, error) {
+	shareName, filePath := afh.getShareAndFilePath(&container, blobName)
+	fileURL := afh.getFileURL(shareName, filePath)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+	defer cancel()
+
+	_, err := fileURL.GetProperties(ctx)
+	if err != nil {
+		if isAzureFileNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// GetSpecificSimpleContainer given a URL (ending in /) then get the SIMPLE container that represents it.
+// eg. https://myacct.file.core.windows.net/myshare/dir1/dir2/ returns dir2.
+// The share is created if it doesn't exist and this is the destination, a missing source share is an error.
+func (afh *AzureFileHandler) GetSpecificSimpleContainer(URL string) (*models.SimpleContainer, error) {
+
+	if misc.GetLastChar(URL) != "/" {
+		return nil, errors.New("Needs to end with a /")
+	}
+
+	shareName, dirPath, err := afh.validateURL(URL)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+	defer cancel()
+
+	_, err = afh.serviceURL.NewShareURL(shareName).GetProperties(ctx)
+	if err != nil {
+		if afh.IsSource || !isAzureFileNotFound(err) {
+			log.Errorf("Unable to get share %s %s", shareName, err)
+			return nil, err
+		}
+
+		log.Debugf("share %s doesn't exist, creating it", shareName)
+		_, err = afh.CreateContainer(shareName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	shareContainer := models.NewSimpleContainer()
+	shareContainer.Name = shareName
+	shareContainer.Origin = models.AzureFile
+
+	// the directories in the URL.
+	lastContainer := shareContainer
+	for _, segment := range strings.Split(strings.Trim(dirPath, "/"), "/") {
+		if segment != "" {
+			lastContainer = afh.getSubContainer(lastContainer, segment)
+		}
+	}
+
+	return lastContainer, nil
+}
+
+// GetContainerContentsOverChannel lists the files under the directory (recursively), sending each page
+// of each directory as it arrives.
+func (afh *AzureFileHandler) GetContainerContentsOverChannel(sourceContainer models.SimpleContainer, blobChannel chan models.SimpleContainer) error {
+
+	defer close(blobChannel)
+	shareContainer, dirPath := containerutils.GetContainerAndBlobPrefix(&sourceContainer)
+
+	return afh.listDirectories(shareContainer.Name, dirPath, true, func(relativeDir string, resp *azfile.ListFilesAndDirectoriesSegmentResponse) {
+		// copy of container, dont want to send back ever growing container via the channel.
+		containerClone := sourceContainer
+		containerClone.BlobSlice = []*models.SimpleBlob{}
+		containerClone.ContainerSlice = []*models.SimpleContainer{}
+
+		afh.populateSimpleContainer(resp, &containerClone, shareContainer.Name, dirPath, relativeDir, false)
+		blobChannel <- containerClone
+	})
+}
+
+// GetContainerContents populates the passed container with the files (and directories) under it.
+func (afh *AzureFileHandler) GetContainerContents(container *models.SimpleContainer) error {
+
+	shareContainer, dirPath := containerutils.GetContainerAndBlobPrefix(container)
+
+	err := afh.listDirectories(shareContainer.Name, dirPath, !afh.HierarchicalListing, func(relativeDir string, resp *azfile.ListFilesAndDirectoriesSegmentResponse) {
+		afh.populateSimpleContainer(resp, container, shareContainer.Name, dirPath, relativeDir, afh.HierarchicalListing)
+	})
+	if err != nil {
+		return err
+	}
+
+	container.Populated = true
+	return nil
+}
+
+// listDirectories lists the directory dirPath of the share a page at a time. If recursive, every directory under it is listed too.
+// relativeDir is the path (ending in /) of the directory being listed, relative to dirPath.
+func (afh *AzureFileHandler) listDirectories(shareName string, dirPath string, recursive bool, page func(relativeDir string, resp *azfile.ListFilesAndDirectoriesSegmentResponse)) error {
+
+	pending := []string{""}
+	for len(pending) > 0 {
+		relativeDir := pending[0]
+		pending = pending[1:]
+
+		dirURL := afh.getDirectoryURL(shareName, dirPath+relativeDir)
+		for marker := (azfile.Marker{}); marker.NotDone(); {
+			ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+			resp, err := dirURL.ListFilesAndDirectoriesSegment(ctx, marker, azfile.ListFilesAndDirectoriesOptions{})
+			cancel()
+			if err != nil {
+				log.Errorf("Unable to list directory %s/%s %s", shareName, dirPath+relativeDir, err)
+				return err
+			}
+
+			page(relativeDir, resp)
+
+			if recursive {
+				for _, dir := range resp.DirectoryItems {
+					pending = append(pending, relativeDir+dir.Name+"/")
+				}
+			}
+
+			marker = resp.NextMarker
+		}
+	}
+
+	return nil
+}
+
+// populateSimpleContainer adds the files (and if includeDirectories, the directories) of a directory listing to the
+// container. relativeDir is where the listed directory is relative to the container.
+func (afh *AzureFileHandler) populateSimpleContainer(resp *azfile.ListFilesAndDirectoriesSegmentResponse, container *models.SimpleContainer,
+	shareName string, dirPath string, relativeDir string, includeDirectories bool) {
+
+	currentContainer := container
+	for _, segment := range strings.Split(strings.TrimSuffix(relativeDir, "/"), "/") {
+		if segment != "" {
+			currentContainer = afh.getSubContainer(currentContainer, segment)
+		}
+	}
+
+	if includeDirectories {
+		for _, dir := range resp.DirectoryItems {
+			afh.getSubContainer(currentContainer, dir.Name)
+		}
+	}
+
+	for _, file := range resp.FileItems {
+		filePath := dirPath + relativeDir + file.Name
+
+		b := models.SimpleBlob{}
+		b.Name = file.Name
+		b.Origin = models.AzureFile
+		b.ParentContainer = currentContainer
+		b.BlobCloudName = filePath
+		b.URL = urlWithoutSAS(afh.getFileURL(shareName, filePath).URL())
+		if file.Properties != nil {
+			b.Properties.Size = file.Properties.ContentLength
+		}
+		currentContainer.BlobSlice = append(currentContainer.BlobSlice, &b)
+	}
+
+	currentContainer.Populated = true
+}
+
+// getSubContainer gets an existing subcontainer with parent of container and name of segment.
+// otherwise it creates it, adds it to the parent container and returns the new one.
+func (afh *AzureFileHandler) getSubContainer(container *models.SimpleContainer, segment string) *models.SimpleContainer {
+	subContainer := containerutils.GetContainerByName(container, segment)
+	subContainer.Origin = models.AzureFile
+	return subContainer
+}
+
+// GeneratePresignedURL generates a read only SAS URL for the file, signed with the account key.
+// If authenticating with a SAS the URL uses that SAS instead.
+func (afh *AzureFileHandler) GeneratePresignedURL(blob *models.SimpleBlob) (string, error) {
+
+	shareName := afh.generateShareName(*blob)
+	fileURL := afh.getFileURL(shareName, blob.BlobCloudName)
+
+	if afh.credential == nil {
+		return fileURL.String(), nil
+	}
+
+	sasQueryParams := azfile.FileSASSignatureValues{
+		Protocol:    azfile.SASProtocolHTTPS,
+		StartTime:   time.Now().UTC().Add(-5 * time.Minute), // allow for clock skew
+		ExpiryTime:  time.Now().UTC().Add(afh.PresignedURLExpiry),
+		ShareName:   shareName,
+		FilePath:    blob.BlobCloudName,
+		Permissions: azfile.FileSASPermissions{Read: true}.String(),
+	}.NewSASQueryParameters(afh.credential)
+
+	parts := azfile.NewFileURLParts(fileURL.URL())
+	parts.SAS = sasQueryParams
+	u := parts.URL()
+
+	log.Debugf("presigned URL for %s generated", blob.BlobCloudName)
+	return u.String(), nil
+}
+
+// GetSpecificSimpleBlob given a URL (NOT ending in /) then get the SIMPLE blob that represents it.
+func (afh *AzureFileHandler) GetSpecificSimpleBlob(URL string) (*models.SimpleBlob, error) {
+
+	if misc.GetLastChar(URL) == "/" {
+		return nil, errors.New("Cannot end with a /")
+	}
+
+	shareName, filePath, err := afh.validateURL(URL)
+	if err != nil {
+		return nil, err
+	}
+
+	shareContainer := models.NewSimpleContainer()
+	shareContainer.Name = shareName
+	shareContainer.Origin = models.AzureFile
+
+	b := models.SimpleBlob{}
+	b.Name = path.Base(filePath)
+	b.Origin = models.AzureFile
+	b.ParentContainer = shareContainer
+	b.BlobCloudName = filePath
+	b.URL = URL
+	return &b, nil
+}
+
+// ReadBlob reads a file of a given name from a particular SimpleContainer and returns the SimpleBlob
+func (afh *AzureFileHandler) ReadBlob(container models.SimpleContainer, blobName string) (models.SimpleBlob, error) {
+	shareName, filePath := afh.getShareAndFilePath(&container, blobName)
+
+	blob := models.SimpleBlob{}
+	blob.Name = blobName
+	blob.Origin = models.AzureFile
+	blob.ParentContainer = &container
+	blob.BlobCloudName = filePath
+	blob.URL = urlWithoutSAS(afh.getFileURL(shareName, filePath).URL())
+
+	err := afh.PopulateBlob(&blob)
+	return blob, err
+}
+
+// PopulateBlob. Used to read a file IFF we already have a reference to it.
+func (afh *AzureFileHandler) PopulateBlob(blob *models.SimpleBlob) error {
+	shareName := afh.generateShareName(*blob)
+
+	reader, _, err := afh.GetBlobReader(blob)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if !afh.cacheToDisk {
+		blob.DataInMemory, err = ioutil.ReadAll(reader)
+		blob.BlobInMemory = true
+		return err
+	}
+
+	cacheName := misc.GenerateCacheName(shareName + blob.BlobCloudName)
+	blob.DataCachedAtPath = afh.cacheLocation + "/" + cacheName
+	blob.BlobInMemory = false
+	log.Debugf("azure file %s cached at location %s", blob.BlobCloudName, blob.DataCachedAtPath)
+
+	cacheFile, err := os.OpenFile(blob.DataCachedAtPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		log.Errorf("Populate blob %s", err)
+		return err
+	}
+	defer cacheFile.Close()
+
+	_, err = io.Copy(cacheFile, reader)
+	return err
+}
+
+// GetBlobReader opens a stream to the file. Large files are downloaded as parallel ranges.
+func (afh *AzureFileHandler) GetBlobReader(blob *models.SimpleBlob) (io.ReadCloser, int64, error) {
+	shareName := afh.generateShareName(*blob)
+	fileURL := afh.getFileURL(shareName, blob.BlobCloudName)
+
+	// no timeout here, the caller controls how long the body is read for.
+	ctx := context.Background()
+	if !useRangedDownload(blob.Properties.Size, afh.DownloadChunkSize, afh.DownloadParallelism) {
+		resp, err := fileURL.Download(ctx, 0, azfile.CountToEnd, false)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		blob.Properties = azureFilePropertiesFromResponse(resp)
+		return resp.Body(azfile.RetryReaderOptions{}), resp.ContentLength(), nil
+	}
+
+	// first range gives us the properties. The size comes from the listing.
+	size := blob.Properties.Size
+	resp, err := fileURL.Download(ctx, 0, afh.DownloadChunkSize, false)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	blob.Properties = azureFilePropertiesFromResponse(resp)
+	blob.Properties.Size = size
+
+	fetch := func(offset int64, count int64) (io.ReadCloser, error) {
+		r, err := fileURL.Download(ctx, offset, count, false)
+		if err != nil {
+			return nil, err
+		}
+		return r.Body(azfile.RetryReaderOptions{}), nil
+	}
+
+	log.Debugf("downloading %s in ranges of %d", blob.BlobCloudName, afh.DownloadChunkSize)
+	reader := helpers.NewRangedReader(resp.Body(azfile.RetryReaderOptions{}), resp.ContentLength(), size, afh.DownloadChunkSize, afh.DownloadParallelism, fetch)
+	return reader, size, nil
+}
+
+// WriteContainer creates the directories of the container.
+func (afh *AzureFileHandler) WriteContainer(sourceContainer *models.SimpleContainer, destContainer *models.SimpleContainer) error {
+	shareName, dirPath := afh.getShareAndFilePath(destContainer, sourceContainer.Name)
+	return afh.createDirectories(shareName, dirPath)
+}
+
+// WriteBlob writes the (already populated) blob to a file.
+func (afh *AzureFileHandler) WriteBlob(destContainer *models.SimpleContainer, sourceBlob *models.SimpleBlob) error {
+
+	if sourceBlob.BlobInMemory {
+		return afh.WriteBlobFromReader(destContainer, sourceBlob, bytes.NewReader(sourceBlob.DataInMemory), int64(len(sourceBlob.DataInMemory)))
+	}
+
+	cacheFile, err := os.OpenFile(sourceBlob.DataCachedAtPath, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer cacheFile.Close()
+
+	info, err := cacheFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	return afh.WriteBlobFromReader(destContainer, sourceBlob, cacheFile, info.Size())
+}
+
+// WriteBlobFromReader creates the file (and any directories it's in) then writes the stream to it a range at a time.
+// Files are created at their full size, so the size must be known up front.
+func (afh *AzureFileHandler) WriteBlobFromReader(destContainer *models.SimpleContainer, sourceBlob *models.SimpleBlob, reader io.Reader, size int64) error {
+	shareName, filePath := afh.getShareAndFilePath(destContainer, sourceBlob.Name)
+	log.Debugf("Azure File WriteBlobFromReader share %s file %s size %d", shareName, filePath, size)
+
+	if size < 0 {
+		size = sourceBlob.Properties.Size
+	}
+
+	err := afh.createDirectories(shareName, path.Dir(filePath))
+	if err != nil {
+		return err
+	}
+
+	fileURL := afh.getFileURL(shareName, filePath)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+	_, err = fileURL.Create(ctx, size, azureFileHTTPHeaders(sourceBlob.Properties), azureFileMetadata(sourceBlob.Properties.Metadata))
+	cancel()
+	if err != nil {
+		log.Errorf("Unable to create file %s %s", filePath, err)
+		return err
+	}
+
+	buffer := make([]byte, azureFileRangeSize)
+	for offset := int64(0); offset < size; {
+		chunk := buffer
+		if size-offset < int64(len(chunk)) {
+			chunk = chunk[:size-offset]
+		}
+
+		_, err := io.ReadFull(reader, chunk)
+		if err != nil {
+			log.Errorf("Unable to read %s at %d %s", sourceBlob.Name, offset, err)
+			return err
+		}
+
+		// new files are all zeros, no need to write them.
+		if !isAllZeros(chunk) {
+			ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+			_, err = fileURL.UploadRange(ctx, offset, bytes.NewReader(chunk))
+			cancel()
+			if err != nil {
+				log.Errorf("Unable to upload range %d of %s %s", offset, filePath, err)
+				return err
+			}
+		}
+
+		offset += int64(len(chunk))
+	}
+
+	return nil
+}
+
+// createDirectories creates the directory and every directory above it, if they don't already exist.
+func (afh *AzureFileHandler) createDirectories(shareName string, dirPath string) error {
+
+	dirPath = strings.Trim(dirPath, "/.")
+	if dirPath == "" {
+		return nil
+	}
+
+	currentPath := ""
+	for _, segment := range strings.Split(dirPath, "/") {
+		currentPath = path.Join(currentPath, segment)
+		key := shareName + "/" + currentPath
+
+		afh.createdDirectoriesLock.Lock()
+		created := afh.createdDirectories[key]
+		afh.createdDirectoriesLock.Unlock()
+		if created {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+		_, err := afh.getDirectoryURL(shareName, currentPath).Create(ctx, azfile.Metadata{})
+		cancel()
+		if serr, ok := err.(azfile.StorageError); ok {
+			if serr.ServiceCode() != azfile.ServiceCodeResourceAlreadyExists {
+				log.Errorf("Unable to create directory %s %s", currentPath, err)
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+
+		afh.createdDirectoriesLock.Lock()
+		afh.createdDirectories[key] = true
+		afh.createdDirectoriesLock.Unlock()
+	}
+
+	return nil
+}
+
+// DeleteBlob deletes the file.
+func (afh *AzureFileHandler) DeleteBlob(container *models.SimpleContainer, blobName string) error {
+	shareName, filePath := afh.getShareAndFilePath(container, blobName)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+	defer cancel()
+
+	_, err := afh.getFileURL(shareName, filePath).Delete(ctx)
+	if err != nil {
+		log.Errorf("Unable to delete %s %s", filePath, err)
+		return err
+	}
+
+	return nil
+}
+
+// RequiresSeekableBody ranges are buffered individually, so a plain stream is fine.
+func (afh *AzureFileHandler) RequiresSeekableBody() bool {
+	return false
+}
+
+// CreateContainer creates a share. An existing share isn't an error.
+func (afh *AzureFileHandler) CreateContainer(containerName string) (models.SimpleContainer, error) {
+	container := models.SimpleContainer{}
+	container.Name = containerName
+	container.Origin = models.AzureFile
+
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+	defer cancel()
+
+	// 0 quota is the maximum.
+	_, err := afh.serviceURL.NewShareURL(containerName).Create(ctx, azfile.Metadata{}, 0)
+	if serr, ok := err.(azfile.StorageError); ok {
+		if serr.ServiceCode() != azfile.ServiceCodeShareAlreadyExists {
+			log.Errorf("Unable to create share %s %s", containerName, err)
+			return container, err
+		}
+	} else if err != nil {
+		return container, err
+	}
+
+	return container, nil
+}
+
+// GetContainer gets a container. Populating the subtree? OR NOT? hmmmm
+func (afh *AzureFileHandler) GetContainer(containerName string) models.SimpleContainer {
+	var container models.SimpleContainer
+
+	return container
+}
+
+// DoCopyBlobUsingAzureCopyBlobFlag copies to a file using the Copy File operation, so Azure pulls the data
+// directly from sourceURL (a presigned blob or file URL). Blocks until the copy has completed, failed or been aborted.
+func (afh *AzureFileHandler) DoCopyBlobUsingAzureCopyBlobFlag(sourceURL string, destContainer *models.SimpleContainer, destBlobName string, metadata map[string]string) error {
+
+	shareName, filePath := afh.getShareAndFilePath(destContainer, destBlobName)
+	log.Debugf("CopyFile: source %s : dest share %s : file %s", sourceURL, shareName, filePath)
+
+	err := afh.createDirectories(shareName, path.Dir(filePath))
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		return err
+	}
+
+	fileURL := afh.getFileURL(shareName, filePath)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+	defer cancel()
+
+	resp, err := fileURL.StartCopy(ctx, *u, azureFileMetadata(metadata))
+	if err != nil {
+		log.Errorf("Unable to start copy of %s %s", sourceURL, err)
+		return err
+	}
+
+	copyID := resp.CopyID()
+	status := resp.CopyStatus()
+
+	afh.pendingCopiesLock.Lock()
+	afh.pendingCopies[copyID] = fileURL
+	afh.pendingCopiesLock.Unlock()
+
+	defer func() {
+		afh.pendingCopiesLock.Lock()
+		delete(afh.pendingCopies, copyID)
+		afh.pendingCopiesLock.Unlock()
+	}()
+
+	description := ""
+	for status == azfile.CopyStatusPending {
+		time.Sleep(copyBlobPollInterval)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+		props, err := fileURL.GetProperties(ctx)
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		status = props.CopyStatus()
+		description = props.CopyStatusDescription()
+	}
+
+	switch status {
+	case azfile.CopyStatusSuccess:
+		return nil
+	case azfile.CopyStatusAborted:
+		return fmt.Errorf("copy of %s aborted %s", filePath, description)
+	}
+
+	return fmt.Errorf("copy of %s failed (%s) %s", filePath, status, description)
+}
+
+// AbortPendingCopies aborts every server side copy that hasn't completed yet.
+func (afh *AzureFileHandler) AbortPendingCopies() error {
+	afh.pendingCopiesLock.Lock()
+	defer afh.pendingCopiesLock.Unlock()
+
+	var lastErr error
+	for copyID, fileURL := range afh.pendingCopies {
+		ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+		_, err := fileURL.AbortCopy(ctx, copyID)
+		cancel()
+		if err != nil {
+			log.Errorf("Unable to abort copy %s %s", copyID, err)
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+// validateURL returns the share and the path within it.
+// eg. https://myacct.file.core.windows.net/myshare/dir1/file returns myshare and dir1/file
+func (afh *AzureFileHandler) validateURL(URL string) (string, string, error) {
+	u, err := url.Parse(URL)
+	if err != nil {
+		return "", "", err
+	}
+
+	sp := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+	if sp[0] == "" {
+		return "", "", fmt.Errorf("No share in %s", URL)
+	}
+
+	filePath := ""
+	if len(sp) > 1 {
+		filePath = sp[1]
+	}
+
+	return sp[0], filePath, nil
+}
+
+// getShareAndFilePath gets the share and the path of the file/directory within it.
+func (afh *AzureFileHandler) getShareAndFilePath(container *models.SimpleContainer, name string) (string, string) {
+	shareContainer, dirPath := containerutils.GetContainerAndBlobPrefix(container)
+	return shareContainer.Name, dirPath + name
+}
+
+// generateShareName gets the share the blob is in.
+func (afh *AzureFileHandler) generateShareName(blob models.SimpleBlob) string {
+	currentContainer := blob.ParentContainer
+
+	for currentContainer.ParentContainer != nil {
+		currentContainer = currentContainer.ParentContainer
+	}
+	return currentContainer.Name
+}
+
+func (afh *AzureFileHandler) getDirectoryURL(shareName string, dirPath string) azfile.DirectoryURL {
+	dirURL := afh.serviceURL.NewShareURL(shareName).NewRootDirectoryURL()
+
+	dirPath = strings.Trim(dirPath, "/.")
+	if dirPath != "" {
+		dirURL = dirURL.NewDirectoryURL(dirPath)
+	}
+	return dirURL
+}
+
+func (afh *AzureFileHandler) getFileURL(shareName string, filePath string) azfile.FileURL {
+	dirPath, fileName := path.Split(filePath)
+	return afh.getDirectoryURL(shareName, dirPath).NewFileURL(fileName)
+}
+
+func isAzureFileNotFound(err error) bool {
+	if serr, ok := err.(azfile.StorageError); ok {
+		return serr.Response() != nil && serr.Response().StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+// azureFilePropertiesFromResponse converts the headers returned when reading a file.
+func azureFilePropertiesFromResponse(resp *azfile.RetryableDownloadResponse) models.BlobProperties {
+	p := models.BlobProperties{}
+	p.Size = resp.ContentLength()
+	p.LastModified = resp.LastModified()
+	p.ETag = string(resp.ETag())
+	p.ContentType = resp.ContentType()
+	p.ContentEncoding = resp.ContentEncoding()
+	p.ContentLanguage = resp.ContentLanguage()
+	p.ContentDisposition = resp.ContentDisposition()
+	p.CacheControl = resp.CacheControl()
+	p.Metadata = blobutils.NormaliseMetadata(resp.NewMetadata())
+	return p
+}
+
+// azureFileHTTPHeaders converts the blob properties into the headers set when creating a file.
+func azureFileHTTPHeaders(properties models.BlobProperties) azfile.FileHTTPHeaders {
+	headers := azfile.FileHTTPHeaders{}
+	headers.ContentType = properties.ContentType
+	headers.ContentEncoding = properties.ContentEncoding
+	headers.ContentLanguage = properties.ContentLanguage
+	headers.ContentDisposition = properties.ContentDisposition
+	headers.CacheControl = properties.CacheControl
+
+	if len(properties.ContentMD5) == len(headers.ContentMD5) {
+		copy(headers.ContentMD5[:], properties.ContentMD5)
+	}
+
+	return headers
+}
+
+// azureFileMetadata converts metadata keys to ones Azure accepts.
+func azureFileMetadata(metadata map[string]string) azfile.Metadata {
+	m := azfile.Metadata{}
+	for k, v := range blobutils.AzureMetadata(metadata) {
+		m[k] = v
+	}
+	return m
+}
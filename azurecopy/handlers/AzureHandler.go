@@ -2,20 +2,27 @@ package handlers
 
 import (
 	"azurecopy/azurecopy/models"
+	"azurecopy/azurecopy/utils/blobutils"
 	"azurecopy/azurecopy/utils/containerutils"
+	"azurecopy/azurecopy/utils/helpers"
 	"azurecopy/azurecopy/utils/misc"
+	"crypto/md5"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/satori/uuid"
 
+	"github.com/Azure/azure-pipeline-go/pipeline"
 	storage "github.com/azure/azure-storage-blob-go/2016-05-31/azblob"
 	"time"
 	"context"
@@ -23,9 +30,94 @@ import (
 	"bytes"
 )
 
+// defaultAzureBlockSize is the default size of each block written via PutBlock.
+// With the 50000 block limit that covers blobs up to roughly 195G, larger blobs get larger blocks.
+const defaultAzureBlockSize = 1024 * 1024 * 4
+
+// defaultAzureBlockParallelism how many blocks of a blob are uploaded at once.
+const defaultAzureBlockParallelism = 4
+
+// limits for block blobs in this version of the API. Gives a maximum blob size of roughly 4.75T.
+const (
+	azureMaxBlockSize  = 1024 * 1024 * 100
+	azureMaxBlockCount = 50000
+)
+
+// azureMaxWriteSize the most that can be written by a single PutPages or AppendBlock.
+const azureMaxWriteSize = 1024 * 1024 * 4
+
+// azureAPIVersion the API version the SDK implements. Used for requests sent directly.
+const azureAPIVersion = "2016-05-31"
+
+// azurePageSize page blobs are written in (and sized in multiples of) 512 byte pages.
+const azurePageSize = 512
+
+// Azure blob types, as returned in x-ms-blob-type.
+const (
+	AzureBlockBlob  = "BlockBlob"
+	AzurePageBlob   = "PageBlob"
+	AzureAppendBlob = "AppendBlob"
+)
+
+// Azure access tiers for block blobs. Archived blobs can't be read until they're rehydrated.
+const (
+	AzureTierHot     = "Hot"
+	AzureTierCool    = "Cool"
+	AzureTierArchive = "Archive"
+)
+
+// azureSetTierAPIVersion Set Blob Tier isn't part of the API version the SDK implements, so that
+// one request is sent with a newer version.
+const azureSetTierAPIVersion = "2017-04-17"
+
+// azureTokenAPIVersion the service only accepts OAuth bearer tokens from this version on, so requests
+// authenticated with a token are sent as this version rather than the one the SDK implements.
+const azureTokenAPIVersion = "2017-11-09"
+
+// copyBlobPollInterval how often the status of a server side copy is checked.
+const copyBlobPollInterval = 5 * time.Second
+
+// well known storage emulator (Azurite) account.
+const (
+	emulatorAccountName = "devstoreaccount1"
+	emulatorAccountKey  = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+	emulatorEndpoint    = "http://127.0.0.1:10000"
+)
+
+// how long before it expires an OAuth token is refreshed.
+const tokenRefreshMargin = 5 * time.Minute
+
+// AzureCredentials everything configured for authenticating with Azure. The handler uses the first of
+// SAS, account key, OAuth token/service principal that is set, otherwise anonymous access (public containers).
+type AzureCredentials struct {
+	AccountName string
+	AccountKey  string
+
+	// container or account level SAS query string, taken from the URL. eg. sv=...&sig=...
+	SAS string
+
+	// OAuth bearer token, or the service principal to get one for.
+	Token        string
+	TenantID     string
+	ClientID     string
+	ClientSecret string
+}
+
 type AzureHandler struct {
 	serviceURL storage.ServiceURL
 
+	// used directly for requests the SDK doesn't support (eg. setting the tier).
+	pipeline pipeline.Pipeline
+
+	// used for signing SAS URLs. Only set if we have the account key.
+	credential *storage.SharedKeyCredential
+
+	// SAS query string appended to every request, if authenticating with a SAS.
+	sas string
+
+	// set if authenticating with an OAuth token.
+	tokenCredential *azureTokenCredential
+
 	// determine if we're caching the blob to disk during copy operations.
 	// or if we're keeping it in memory
 	cacheToDisk   bool
@@ -36,59 +128,275 @@ type AzureHandler struct {
 
 	// dealing with emulator.
 	IsEmulator bool
+
+	// account name is the first segment of the path (http://127.0.0.1:10000/devstoreaccount1/container/blob)
+	// rather than part of the host. True for the emulator and custom endpoints with a path.
+	accountInPath bool
+
+	// server side copies (CopyBlob flag) that haven't completed yet.
+	// keyed on copy ID so they can be aborted if required.
+	pendingCopies     map[string]storage.BlobURL
+	pendingCopiesLock sync.Mutex
+
+	// how long presigned (SAS) URLs are valid for.
+	PresignedURLExpiry time.Duration
+
+	// when resuming a job, blocks already staged (but not committed) by a previous attempt are
+	// reused instead of uploaded again.
+	ReuseStagedBlocks bool
+
+	// blobs larger than DownloadChunkSize are downloaded as byte ranges, DownloadParallelism at a time.
+	DownloadChunkSize   int64
+	DownloadParallelism uint
+
+	// GetContainerContents only lists the immediate children (blobs and virtual directories) of the container
+	// using a delimiter, rather than every blob under it. Virtual directories are left unpopulated.
+	HierarchicalListing bool
+
+	// list snapshots of blobs as well as the blobs. Each snapshot is listed (and copied) as a
+	// separate blob, named after the blob and the snapshot time. eg. myblob@2017-06-01T101500.1234567Z
+	IncludeSnapshots bool
+
+	// tier (Hot, Cool or Archive) set on block blobs when they're written. Empty for the account default.
+	AccessTier string
+
+	// type (BlockBlob, PageBlob or AppendBlob) blobs are written as. Empty to keep the type of the source blob.
+	BlobType string
+
+	// block blobs are written in blocks of BlockSize (bigger if the blob would need more than 50000 blocks),
+	// BlockParallelism blocks at a time.
+	BlockSize        int64
+	BlockParallelism uint
 }
 
 // NewAzureHandler factory to create new one. Evil?
-func NewAzureHandler(accountName string, accountKey string, isSource bool, cacheToDisk bool, isEmulator bool) (*AzureHandler, error) {
+// endpoint is the blob service URL for sovereign clouds, private endpoints etc. eg. https://myacct.blob.core.chinacloudapi.cn
+// or http://azurite:10000/devstoreaccount1. Leave empty for public Azure (or the emulator on 127.0.0.1:10000).
+// If isEmulator and no credentials are given the well known emulator account is used.
+func NewAzureHandler(credentials AzureCredentials, endpoint string, isSource bool, cacheToDisk bool, isEmulator bool) (*AzureHandler, error) {
 	ah := new(AzureHandler)
 
 	ah.cacheToDisk = cacheToDisk
 	dir, err := ioutil.TempDir("", "azurecopy")
 	if err != nil {
-		log.Fatalf("Unable to create temp directory %s", err)
+		log.Errorf("Unable to create temp directory %s", err)
+		return nil, err
 	}
 
 	ah.cacheLocation = dir
 	ah.IsSource = isSource
+	ah.DownloadChunkSize = defaultDownloadChunkSize
+	ah.DownloadParallelism = defaultDownloadParallelism
+	ah.BlockSize = defaultAzureBlockSize
+	ah.BlockParallelism = defaultAzureBlockParallelism
 	ah.IsEmulator = isEmulator
+	ah.pendingCopies = make(map[string]storage.BlobURL)
+	ah.PresignedURLExpiry = defaultPresignedURLExpiry
 
-	if isEmulator || (accountName == "" && accountKey == "") {
-		// set emulator accountName and accountKey
+	if isEmulator && credentials.AccountName == "" && credentials.AccountKey == "" {
+		credentials.AccountName = emulatorAccountName
+		credentials.AccountKey = emulatorAccountKey
 	}
 
-	credential := storage.NewSharedKeyCredential(accountName, accountKey)
-	p := storage.NewPipeline(credential, storage.PipelineOptions{})
-	u, _ := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net", accountName))
-	serviceURL := storage.NewServiceURL(*u, p)
+	serviceEndpoint := fmt.Sprintf("https://%s.blob.core.windows.net", credentials.AccountName)
+	if endpoint != "" {
+		serviceEndpoint = strings.TrimSuffix(endpoint, "/")
+	} else if isEmulator {
+		serviceEndpoint = emulatorEndpoint + "/" + credentials.AccountName
+	}
 
+	u, err := url.Parse(serviceEndpoint)
 	if err != nil {
+		log.Errorf("Invalid Azure endpoint %s %s", serviceEndpoint, err)
+		return nil, err
+	}
+	ah.accountInPath = strings.Trim(u.Path, "/") != ""
 
-		// indicate error somehow..  still trying to figure that out with GO.
+	// Azurite at another address (eg. a container in CI) still uses the well known account.
+	if credentials.AccountName == "" && credentials.AccountKey == "" && strings.Trim(u.Path, "/") == emulatorAccountName {
+		credentials.AccountName = emulatorAccountName
+		credentials.AccountKey = emulatorAccountKey
+	}
+
+	credential, err := ah.newCredential(credentials)
+	if err != nil {
 		return nil, err
 	}
 
+	// the SAS goes on every URL generated from the service URL.
+	u.RawQuery = ah.sas
+
+	p := storage.NewPipeline(credential, storage.PipelineOptions{})
+	serviceURL := storage.NewServiceURL(*u, p)
+
 	ah.serviceURL = serviceURL
+	ah.pipeline = p
 	return ah, nil
 }
 
+// newCredential picks the credential from what's been configured.
+func (ah *AzureHandler) newCredential(credentials AzureCredentials) (storage.Credential, error) {
+
+	switch {
+	case credentials.SAS != "":
+		log.Debug("using SAS for Azure")
+		ah.sas = credentials.SAS
+		return storage.NewAnonymousCredential(), nil
+
+	case credentials.AccountKey != "":
+		log.Debug("using account key for Azure")
+		ah.credential = storage.NewSharedKeyCredential(credentials.AccountName, credentials.AccountKey)
+		return ah.credential, nil
+
+	case credentials.Token != "":
+		log.Debug("using OAuth token for Azure")
+		ah.tokenCredential = newAzureTokenCredential(credentials.Token)
+		return ah.tokenCredential, nil
+
+	case credentials.ClientID != "":
+		log.Debug("using service principal for Azure")
+		tokenCredential, err := newServicePrincipalCredential(credentials)
+		if err != nil {
+			return nil, err
+		}
+		ah.tokenCredential = tokenCredential
+		return tokenCredential, nil
+	}
+
+	log.Debug("no Azure credentials, using anonymous access")
+	return storage.NewAnonymousCredential(), nil
+}
+
+// newServicePrincipalCredential gets an OAuth token for the service principal.
+// Tokens only last an hour or so, so it's refreshed in the background before it expires, until the handler is closed.
+func newServicePrincipalCredential(credentials AzureCredentials) (*azureTokenCredential, error) {
+
+	token, expiry, err := helpers.GetAzureADToken(credentials.TenantID, credentials.ClientID, credentials.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenCredential := newAzureTokenCredential(token)
+
+	go func() {
+		for {
+			timer := time.NewTimer(time.Until(expiry.Add(-tokenRefreshMargin)))
+			select {
+			case <-tokenCredential.stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			token, newExpiry, err := helpers.GetAzureADToken(credentials.TenantID, credentials.ClientID, credentials.ClientSecret)
+			if err != nil {
+				// try again in a minute, the current token is still valid for a while.
+				log.Errorf("Unable to refresh Azure AD token %s", err)
+				expiry = time.Now().Add(tokenRefreshMargin + time.Minute)
+				continue
+			}
+
+			tokenCredential.setToken(token)
+			expiry = newExpiry
+		}
+	}()
+
+	return tokenCredential, nil
+}
+
+// azureTokenCredential authenticates requests with an OAuth bearer token.
+// The SDK's API version predates OAuth, so requests are sent as azureTokenAPIVersion instead (as doRequest
+// does for operations the SDK doesn't support). The responses used here are the same in both versions.
+type azureTokenCredential struct {
+	// only there so this satisfies storage.Credential, requests never reach it.
+	storage.Credential
+
+	lock  sync.RWMutex
+	token string
+
+	// closed to stop refreshing the token.
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newAzureTokenCredential(token string) *azureTokenCredential {
+	return &azureTokenCredential{Credential: storage.NewAnonymousCredential(), token: token, stop: make(chan struct{})}
+}
+
+func (tc *azureTokenCredential) setToken(token string) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	tc.token = token
+}
+
+// New creates the policy that adds the token to each request. Implements pipeline.Factory.
+func (tc *azureTokenCredential) New(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.Policy {
+	return azureTokenPolicy{next: next, credential: tc}
+}
+
+// close stops refreshing the token.
+func (tc *azureTokenCredential) close() {
+	tc.stopOnce.Do(func() { close(tc.stop) })
+}
+
+type azureTokenPolicy struct {
+	next       pipeline.Policy
+	credential *azureTokenCredential
+}
+
+func (tp azureTokenPolicy) Do(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+
+	// versions are dates, so compare as strings.
+	if request.Header.Get("x-ms-version") < azureTokenAPIVersion {
+		request.Header.Set("x-ms-version", azureTokenAPIVersion)
+	}
+
+	tp.credential.lock.RLock()
+	request.Header.Set("Authorization", "Bearer "+tp.credential.token)
+	tp.credential.lock.RUnlock()
+
+	return tp.next.Do(ctx, request)
+}
+
+// Close stops refreshing the OAuth token, if there is one.
+func (ah *AzureHandler) Close() error {
+	if ah.tokenCredential != nil {
+		ah.tokenCredential.close()
+	}
+	return nil
+}
+
+// urlWithoutSAS returns the URL without the query, so the SAS isn't displayed/recorded with the blob.
+func urlWithoutSAS(u url.URL) string {
+	u.RawQuery = ""
+	return u.String()
+}
+
 // GetRootContainer gets root container of Azure. In reality there isn't a root container, but this would basically be a SimpleContainer
 // that has the containerSlice populated with the real Azure containers.
-func (ah *AzureHandler) GetRootContainer() models.SimpleContainer {
+// Follows the continuation marker, so accounts with more than 5000 containers are fully listed.
+func (ah *AzureHandler) GetRootContainer() (models.SimpleContainer, error) {
 
-	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
-	defer cancel()
-	containerResponse, _:= ah.serviceURL.ListContainers( ctx, storage.Marker{}, storage.ListContainersOptions{}  )
 	rootContainer := models.NewSimpleContainer()
 
-	for _, c := range containerResponse.Containers {
-		sc := models.NewSimpleContainer()
-		sc.Name = c.Name
-		sc.Origin = models.Azure
+	for marker := (storage.Marker{}); marker.NotDone(); {
+		ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+		containerResponse, err := ah.serviceURL.ListContainers(ctx, marker, storage.ListContainersOptions{})
+		cancel()
+		if err != nil {
+			log.Errorf("Unable to list containers %s", err)
+			return models.SimpleContainer{}, err
+		}
+
+		for _, c := range containerResponse.Containers {
+			sc := ah.newAzureSimpleContainer(c.Name)
+			rootContainer.ContainerSlice = append(rootContainer.ContainerSlice, sc)
+		}
 
-		rootContainer.ContainerSlice = append(rootContainer.ContainerSlice, sc)
+		marker = containerResponse.NextMarker
 	}
 
-	return *rootContainer
+	return *rootContainer, nil
 }
 
 // BlobExists checks if blob exists
@@ -128,23 +436,28 @@ func (ah *AzureHandler) GetSpecificSimpleContainer(URL string) (*models.SimpleCo
 
 	_, containerName, blobPrefix, _, err := ah.validateURL(URL)
 	if err != nil {
-		log.Fatal("GetSpecificSimpleContainer err", err)
+		return nil, err
 	}
 
-	var simpleContainer *models.SimpleContainer
-
-	simpleContainer, err = ah.getAzureContainerAsSimpleContainer(containerName)
+	exists, err := ah.containerExists(containerName)
 	if err != nil {
+		return nil, err
+	}
 
-		log.Debugf("container %s didn't exist, trying to create it: %s", containerName, err)
+	if !exists {
+		if ah.IsSource {
+			return nil, fmt.Errorf("Container %s does not exist", containerName)
+		}
 
-		_, _ = ah.getOrCreateContainer( containerName)
-		simpleContainer, err = ah.getAzureContainerAsSimpleContainer(containerName)
+		log.Debugf("container %s doesn't exist, creating it", containerName)
+		_, err = ah.getOrCreateContainer(containerName)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	simpleContainer := ah.newAzureSimpleContainer(containerName)
+
 	subContainer, lastContainer := ah.generateSubContainers(simpleContainer, blobPrefix)
 
 	if subContainer != nil {
@@ -159,49 +472,87 @@ func (ah *AzureHandler) GetSpecificSimpleContainer(URL string) (*models.SimpleCo
 // This returns a COPY of the original source container but has been populated with *some* of the blobs/subcontainers in it.
 func (ah *AzureHandler) GetContainerContentsOverChannel(sourceContainer models.SimpleContainer, blobChannel chan models.SimpleContainer) error {
 
+	defer close(blobChannel)
 	azureContainer, blobPrefix := containerutils.GetContainerAndBlobPrefix(&sourceContainer)
 
-	containerURL := ah.serviceURL.NewContainerURL(azureContainer.Name)
-
-	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
-	defer cancel()
-
-	marker := storage.Marker{}
-
 	// now we have the azure container and the prefix, we should be able to get a list of
 	// SimpleContainers and SimpleBlobs to add this to original container.
-	// Keep max results to 1000, can loop through and
-	// params := storage.ListBlobsParameters{Prefix: blobPrefix, MaxResults: 1000}
-	done := false
-	for done == false {
+	// Each page (up to 5000 blobs) is sent as it arrives.
+	return ah.listBlobPages(azureContainer.Name, blobPrefix, "", func(blobListResponse *storage.ListBlobsResponse) {
 		// copy of container, dont want to send back ever growing container via the channel.
 		containerClone := sourceContainer
+		containerClone.BlobSlice = []*models.SimpleBlob{}
+		containerClone.ContainerSlice = []*models.SimpleContainer{}
 
-		//azureContainer := ah.blobStorageClient.GetContainerReference(azureContainer.Name)
-		blobListResponse, err := containerURL.ListBlobs( ctx, marker, storage.ListBlobsOptions{ Prefix: blobPrefix})
-		if err != nil {
-			log.Fatal("Error")
-		}
-
-		ah.populateSimpleContainer(blobListResponse, &containerClone, blobPrefix)
+		ah.populateSimpleContainer(blobListResponse, &containerClone, azureContainer.Name, blobPrefix)
 
 		// return entire container via channel.
 		blobChannel <- containerClone
+	})
+}
 
-		// if marker, then keep going.
-		if blobListResponse.NextMarker.NotDone() {
-			marker = blobListResponse.NextMarker
-		} else {
-			done = true
+// listBlobPages lists the blobs starting with blobPrefix, following the continuation marker until every page has been read.
+// If delimiter is set only the immediate children are listed, deeper blobs are rolled up into BlobPrefix entries.
+// Each page gets its own timeout, so listing huge containers doesn't time out.
+func (ah *AzureHandler) listBlobPages(azureContainerName string, blobPrefix string, delimiter string, page func(blobListResponse *storage.ListBlobsResponse)) error {
+
+	containerURL := ah.serviceURL.NewContainerURL(azureContainerName)
+	options := azureListBlobsOptions(blobPrefix)
+	options.Delimiter = delimiter
+	options.Details.Snapshots = ah.IncludeSnapshots
+
+	for marker := (storage.Marker{}); marker.NotDone(); {
+		ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+		blobListResponse, err := containerURL.ListBlobs(ctx, marker, options)
+		cancel()
+		if err != nil {
+			log.Errorf("Unable to list container %s %s", azureContainerName, err)
+			return err
 		}
+
+		page(blobListResponse)
+		marker = blobListResponse.NextMarker
 	}
 
-	close(blobChannel)
 	return nil
 }
 
+// GeneratePresignedURL generates a read only SAS URL for the blob, signed with the account key.
+// If authenticating with a SAS the URL uses that SAS instead.
 func (ah *AzureHandler) GeneratePresignedURL(blob *models.SimpleBlob) (string, error) {
-	return "", nil
+
+	azureContainerName := ah.generateAzureContainerName(*blob)
+	blobURL := ah.getSourceBlobURL(blob)
+
+	// can't sign without the account key. The SAS we were given (or public access) already gives access to the blob.
+	if ah.credential == nil {
+		if ah.tokenCredential != nil {
+			return "", errors.New("Presigned URLs need an account key or SAS, not an OAuth token")
+		}
+		return blobURL.String(), nil
+	}
+
+	// the emulator (and some private endpoints) are http only.
+	protocol := storage.SASProtocolHTTPS
+	if ah.serviceURL.URL().Scheme == "http" {
+		protocol = storage.SASProtocolHTTPSandHTTP
+	}
+
+	sasQueryParams := storage.BlobSASSignatureValues{
+		Protocol:      protocol,
+		StartTime:     time.Now().UTC().Add(-5 * time.Minute), // allow for clock skew
+		ExpiryTime:    time.Now().UTC().Add(ah.PresignedURLExpiry),
+		ContainerName: azureContainerName,
+		BlobName:      blob.BlobCloudName,
+		Permissions:   storage.BlobSASPermissions{Read: true}.String(),
+	}.NewSASQueryParameters(ah.credential)
+
+	parts := storage.NewBlobURLParts(blobURL.URL())
+	parts.SAS = sasQueryParams
+	u := parts.URL()
+
+	log.Debugf("presigned URL for %s generated", blob.BlobCloudName)
+	return u.String(), nil
 }
 
 // GetSpecificSimpleBlob given a URL (NOT ending in /) then get the SIMPLE blob that represents it.
@@ -219,7 +570,7 @@ func (ah *AzureHandler) GetSpecificSimpleBlob(URL string) (*models.SimpleBlob, e
 		return nil, err
 	}
 
-	simpleContainer, err := ah.getAzureContainerAsSimpleContainer(containerName)
+	simpleContainer := ah.newAzureSimpleContainer(containerName)
 
 	b := models.SimpleBlob{}
 
@@ -236,29 +587,22 @@ func (ah *AzureHandler) GetSpecificSimpleBlob(URL string) (*models.SimpleBlob, e
 // ie we might have RootSimpleContainer -> SimpleContainer(myrealcontainer) -> SimpleContainer(vdir1) -> SimpleContainer(vdir2)
 // and if the blobName is "myblob" then the REAL underlying Azure structure would be container == "myrealcontainer"
 // and the blob name is vdir/vdir2/myblob
-func (ah *AzureHandler) ReadBlob(container models.SimpleContainer, blobName string) models.SimpleBlob {
+func (ah *AzureHandler) ReadBlob(container models.SimpleContainer, blobName string) (models.SimpleBlob, error) {
 	var blob models.SimpleBlob
 
-	return blob
+	return blob, nil
 }
 
 // PopulateBlob. Used to read a blob IFF we already have a reference to it.
 func (ah *AzureHandler) PopulateBlob(blob *models.SimpleBlob) error {
 	azureContainerName := ah.generateAzureContainerName(*blob)
-	azureBlobName := blob.BlobCloudName
-
-	containerURL := ah.serviceURL.NewContainerURL(azureContainerName)
-	blobURL := containerURL.NewBlobURL(azureBlobName)
-
-	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
-	defer cancel()
 
-
-	resp, err := blobURL.GetBlob(ctx, storage.BlobRange{}, storage.BlobAccessConditions{}, false)
+	// large blobs are downloaded in parallel ranges.
+	reader, _, err := ah.GetBlobReader(blob)
 	if err != nil {
-		return  err
+		return err
 	}
-	defer resp.Body().Close()
+	defer reader.Close()
 
 	// file stream for cache.
 	var cacheFile *os.File
@@ -266,19 +610,20 @@ func (ah *AzureHandler) PopulateBlob(blob *models.SimpleBlob) error {
 	// populate this to disk.
 	if ah.cacheToDisk {
 
-		cacheName := misc.GenerateCacheName(azureContainerName + blob.BlobCloudName)
+		// snapshots of the blob need their own cache files.
+		cacheName := misc.GenerateCacheName(azureContainerName + blob.BlobCloudName + blob.Snapshot.String())
 		blob.DataCachedAtPath = ah.cacheLocation + "/" + cacheName
 		log.Debugf("azure blob %s cached at location %s", blob.BlobCloudName, blob.DataCachedAtPath)
-		cacheFile, err = os.OpenFile(blob.DataCachedAtPath, os.O_WRONLY|os.O_CREATE, 0666)
-		defer cacheFile.Close()
-
+		cacheFile, err = os.OpenFile(blob.DataCachedAtPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 		if err != nil {
-			log.Fatalf("Populate blob %s", err)
+			log.Errorf("Populate blob %s", err)
 			return err
 		}
+		defer cacheFile.Close()
 	} else {
 		blob.DataInMemory = []byte{}
 	}
+	blob.BlobInMemory = !ah.cacheToDisk
 
 	// 100k buffer... way too small?
 	buffer := make([]byte, 1024*100)
@@ -286,8 +631,11 @@ func (ah *AzureHandler) PopulateBlob(blob *models.SimpleBlob) error {
 
 	finishedProcessing := false
 	for finishedProcessing == false {
-		numBytesRead, err = resp.Body().Read(buffer)
+		numBytesRead, err = reader.Read(buffer)
 		if err != nil {
+			if err != io.EOF {
+				return err
+			}
 			finishedProcessing = true
 		}
 
@@ -300,7 +648,6 @@ func (ah *AzureHandler) PopulateBlob(blob *models.SimpleBlob) error {
 		if ah.cacheToDisk {
 			_, err = cacheFile.Write(buffer[:numBytesRead])
 			if err != nil {
-				log.Fatal(err)
 				return err
 			}
 		} else {
@@ -334,13 +681,82 @@ func (ah *AzureHandler) WriteBlob(destContainer *models.SimpleContainer, sourceB
 	}
 
 	if err != nil {
-		log.Fatal(err)
 		return err
 	}
 
 	return nil
 }
 
+// GetBlobReader opens a stream to the Azure blob. The response body is handed back to the caller
+// so the blob is never held in memory or cached to disk.
+func (ah *AzureHandler) GetBlobReader(blob *models.SimpleBlob) (io.ReadCloser, int64, error) {
+	blobURL := ah.getSourceBlobURL(blob)
+
+	// no timeout here, the caller controls how long the body is read for.
+	ctx := context.Background()
+	if !useRangedDownload(blob.Properties.Size, ah.DownloadChunkSize, ah.DownloadParallelism) {
+		resp, err := blobURL.GetBlob(ctx, storage.BlobRange{}, storage.BlobAccessConditions{}, false)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		blob.Properties = azurePropertiesFromResponse(resp)
+		return resp.Body(), resp.ContentLength(), nil
+	}
+
+	// first range gives us the properties. The size comes from the listing.
+	size := blob.Properties.Size
+	resp, err := blobURL.GetBlob(ctx, storage.BlobRange{Offset: 0, Count: ah.DownloadChunkSize}, storage.BlobAccessConditions{}, false)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	blob.Properties = azurePropertiesFromResponse(resp)
+	blob.Properties.Size = size
+
+	// the rest of the ranges must come from the same version of the blob.
+	accessConditions := storage.BlobAccessConditions{HTTPAccessConditions: storage.HTTPAccessConditions{IfMatch: resp.ETag()}}
+	fetch := func(offset int64, count int64) (io.ReadCloser, error) {
+		r, err := blobURL.GetBlob(ctx, storage.BlobRange{Offset: offset, Count: count}, accessConditions, false)
+		if err != nil {
+			return nil, err
+		}
+		return r.Body(), nil
+	}
+
+	log.Debugf("downloading %s in ranges of %d", blob.BlobCloudName, ah.DownloadChunkSize)
+	reader := helpers.NewRangedReader(resp.Body(), resp.ContentLength(), size, ah.DownloadChunkSize, ah.DownloadParallelism, fetch)
+	return reader, size, nil
+}
+
+// WriteBlobFromReader writes the stream to Azure as a block, page or append blob.
+func (ah *AzureHandler) WriteBlobFromReader(destContainer *models.SimpleContainer, sourceBlob *models.SimpleBlob, reader io.Reader, size int64) error {
+	log.Debugf("Azure WriteBlobFromReader destcont %s blob %s size %d", destContainer.Name, sourceBlob.Name, size)
+	return ah.writeBlobFromReader(destContainer, sourceBlob, reader, size)
+}
+
+// DeleteBlob deletes the blob (and any snapshots of it).
+func (ah *AzureHandler) DeleteBlob(container *models.SimpleContainer, blobName string) error {
+	azureContainerName, azureBlobName := ah.getContainerAndBlobNames(container, blobName)
+	blobURL, _ := ah.getBlobURL(azureContainerName, azureBlobName)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+	defer cancel()
+
+	_, err := blobURL.Delete(ctx, storage.DeleteSnapshotsOptionInclude, storage.BlobAccessConditions{})
+	if err != nil {
+		log.Errorf("Unable to delete %s %s", azureBlobName, err)
+		return err
+	}
+
+	return nil
+}
+
+// RequiresSeekableBody Azure blocks are buffered individually, so a plain stream is fine.
+func (ah *AzureHandler) RequiresSeekableBody() bool {
+	return false
+}
+
 // CreateContainer creates an Azure container.
 // ie will only do ROOT level containers (ie REAL Azure container)
 func (ah *AzureHandler) CreateContainer(containerName string) (models.SimpleContainer, error) {
@@ -348,7 +764,7 @@ func (ah *AzureHandler) CreateContainer(containerName string) (models.SimpleCont
 
 	_, err := ah.getOrCreateContainer(containerName)
 	if err != nil {
-		log.Fatal(err)
+		return container, err
 	}
 
 	// dont get it...  creates an empty simplecontainer...  this needs to be relooked at!
@@ -370,31 +786,125 @@ func (ah *AzureHandler) GetContainer(containerName string) models.SimpleContaine
 //
 // For Azure only the children of the root node can be a real azure container. Everything else
 // is a blob or a blob pretending to have vdirs.
-//
-// TODO(kpfaulkner) use marker and get next lot of results when we have > 5000 blobs.
 func (ah *AzureHandler) GetContainerContents(container *models.SimpleContainer) error {
 
 	azureContainer, blobPrefix := containerutils.GetContainerAndBlobPrefix(container)
 
+	delimiter := ""
+	if ah.HierarchicalListing {
+		delimiter = "/"
+	}
+
 	// now we have the azure container and the prefix, we should be able to get a list of
 	// SimpleContainers and SimpleBlobs to add this to original container.
-	containerURL := ah.serviceURL.NewContainerURL(azureContainer.Name)
-	ctx := context.Background() // This example uses a never-expiring context
+	return ah.listBlobPages(azureContainer.Name, blobPrefix, delimiter, func(blobListResponse *storage.ListBlobsResponse) {
+		ah.populateSimpleContainer(blobListResponse, container, azureContainer.Name, blobPrefix)
+	})
+}
+
+// DoCopyBlobUsingAzureCopyBlobFlag copy using Azure CopyBlob flag.
+// Azure pulls the blob directly from sourceURL (typically a presigned URL) so the data never passes through us.
+// HTTP properties are taken from the source response by Azure, the metadata has to be passed in. If metadata is
+// empty and the source is Azure, the source metadata is kept.
+// Blocks until the copy has completed, failed or been aborted.
+func (ah *AzureHandler) DoCopyBlobUsingAzureCopyBlobFlag(sourceURL string, destContainer *models.SimpleContainer, destBlobName string, metadata map[string]string) error {
 
-	blobListResponse, err := containerURL.ListBlobs(ctx, storage.Marker{}, storage.ListBlobsOptions{Prefix: blobPrefix}  )
+	azureContainerName, azureBlobName := ah.getContainerAndBlobNames(destContainer, destBlobName)
+	log.Debugf("CopyBlob: source %s : dest container %s : blobname %s", sourceURL, azureContainerName, azureBlobName)
+
+	_, err := ah.getOrCreateContainer(azureContainerName)
 	if err != nil {
-		log.Fatal("Error")
+		return err
 	}
 
-	ah.populateSimpleContainer(blobListResponse, azureContainer, blobPrefix)
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		return err
+	}
 
-	return nil
+	blobURL, _ := ah.getBlobURL(azureContainerName, azureBlobName)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+	defer cancel()
+
+	resp, err := blobURL.StartCopy(ctx, *u, azureMetadata(metadata), storage.BlobAccessConditions{}, storage.BlobAccessConditions{})
+	if err != nil {
+		log.Errorf("Unable to start copy of %s %s", sourceURL, err)
+		return err
+	}
+
+	copyID := resp.CopyID()
+	status := resp.CopyStatus()
+
+	ah.pendingCopiesLock.Lock()
+	ah.pendingCopies[copyID] = *blobURL
+	ah.pendingCopiesLock.Unlock()
+
+	defer func() {
+		ah.pendingCopiesLock.Lock()
+		delete(ah.pendingCopies, copyID)
+		ah.pendingCopiesLock.Unlock()
+	}()
+
+	// small blobs are often copied synchronously, so might not even need to poll.
+	description := ""
+	for status == storage.CopyStatusPending {
+		time.Sleep(copyBlobPollInterval)
+
+		status, description, err = ah.getCopyStatus(blobURL)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch status {
+	case storage.CopyStatusSuccess:
+		// the copy keeps the type of the source, but not the tier.
+		if ah.AccessTier != "" {
+			return ah.setBlobTier(azureContainerName, azureBlobName)
+		}
+		return nil
+	case storage.CopyStatusAborted:
+		return fmt.Errorf("copy of %s aborted %s", azureBlobName, description)
+	}
+
+	return fmt.Errorf("copy of %s failed (%s) %s", azureBlobName, status, description)
 }
 
-// DoCopyBlobUsingAzureCopyBlobFlag copy using Azure CopyBlob flag.
-func (ah *AzureHandler) DoCopyBlobUsingAzureCopyBlobFlag(sourceBlob *models.SimpleBlob, destContainer *models.SimpleContainer, destBlobName string) error {
+// getCopyStatus gets the status of the last copy into the blob.
+func (ah *AzureHandler) getCopyStatus(blobURL *storage.BlobURL) (storage.CopyStatusType, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+	defer cancel()
 
-	return nil
+	props, err := blobURL.GetPropertiesAndMetadata(ctx, storage.BlobAccessConditions{})
+	if err != nil {
+		return "", "", err
+	}
+
+	return props.CopyStatus(), props.CopyStatusDescription(), nil
+}
+
+// AbortPendingCopies aborts all CopyBlob operations started by this handler that haven't completed.
+// The goroutines waiting on these copies will then report them as aborted.
+func (ah *AzureHandler) AbortPendingCopies() error {
+	ah.pendingCopiesLock.Lock()
+	defer ah.pendingCopiesLock.Unlock()
+
+	var lastErr error
+	for copyID, blobURL := range ah.pendingCopies {
+		log.Debugf("aborting copy %s", copyID)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+		_, err := blobURL.AbortCopy(ctx, copyID, storage.LeaseAccessConditions{})
+		cancel()
+
+		if err != nil {
+			log.Errorf("Unable to abort copy %s %s", copyID, err)
+			lastErr = err
+		}
+	}
+
+	return lastErr
 }
 
 // Get container... or create a new one.
@@ -448,18 +958,56 @@ func (ah *AzureHandler) generateSubContainers(azureContainer *models.SimpleConta
 	return containerToReturn, lastContainer
 }
 
-func (ah *AzureHandler) getAzureContainerAsSimpleContainer(containerName string) (*models.SimpleContainer, error) {
+// newAzureSimpleContainer the SimpleContainer for a real Azure container.
+func (ah *AzureHandler) newAzureSimpleContainer(containerName string) *models.SimpleContainer {
+	container := models.NewSimpleContainer()
+	container.Name = containerName
+	container.Origin = models.Azure
+	return container
+}
+
+// containerExists checks the container via its properties, rather than listing every container in the account.
+// A container SAS can't read the container properties, so then a single blob is listed instead.
+// If the destination SAS can't do either (eg. write only) the container is assumed to exist.
+func (ah *AzureHandler) containerExists(containerName string) (bool, error) {
 
-	rootContainer := ah.GetRootContainer()
+	containerURL := ah.serviceURL.NewContainerURL(containerName)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+	defer cancel()
 
-	for _, container := range rootContainer.ContainerSlice {
-		if container.Name == containerName {
-			return container, nil
+	_, err := containerURL.GetPropertiesAndMetadata(ctx, storage.LeaseAccessConditions{})
+	if err == nil {
+		return true, nil
+	}
+
+	if azureStatusCode(err) == http.StatusForbidden && ah.sas != "" {
+		_, err = containerURL.ListBlobs(ctx, storage.Marker{}, storage.ListBlobsOptions{MaxResults: 1})
+		if err == nil {
+			return true, nil
 		}
 	}
 
-	return nil, errors.New("Unable to find container")
+	switch azureStatusCode(err) {
+	case http.StatusNotFound:
+		return false, nil
+	case http.StatusForbidden:
+		if !ah.IsSource {
+			log.Debugf("unable to check container %s exists, assuming it does: %s", containerName, err)
+			return true, nil
+		}
+	}
 
+	log.Errorf("Unable to get container %s %s", containerName, err)
+	return false, err
+}
+
+// azureStatusCode the HTTP status of a failed request, 0 if it isn't a storage service error.
+func azureStatusCode(err error) int {
+	if serr, ok := err.(storage.StorageError); ok && serr.Response() != nil {
+		return serr.Response().StatusCode
+	}
+	return 0
 }
 
 
@@ -492,10 +1040,11 @@ func (ah *AzureHandler) validateURL(URL string) (string, string, string, string,
 	var containerName string
 	var blobName string
 
-	if !ah.IsEmulator {
+	if !ah.accountInPath {
 		containerName = sp[1]
 		blobName = strings.Join(sp[2:], "/")
 	} else {
+		accountName = sp[1]
 		containerName = sp[2]
 		blobName = strings.Join(sp[3:], "/")
 	}
@@ -505,7 +1054,7 @@ func (ah *AzureHandler) validateURL(URL string) (string, string, string, string,
 }
 
 
-// PopulateBlob. Used to read a blob IFF we already have a reference to it.
+// getBlobURL gets the URL of the blob itself (not a snapshot).
 func (ah *AzureHandler) getBlobURL( containerName string, azureBlobName string) (*storage.BlobURL, error) {
 	containerURL := ah.serviceURL.NewContainerURL(containerName)
 	blobURL := containerURL.NewBlobURL(azureBlobName)
@@ -513,6 +1062,17 @@ func (ah *AzureHandler) getBlobURL( containerName string, azureBlobName string)
 	return &blobURL, nil
 }
 
+// getSourceBlobURL gets the URL of the blob, or the snapshot of it the SimpleBlob represents.
+func (ah *AzureHandler) getSourceBlobURL(blob *models.SimpleBlob) storage.BlobURL {
+	azureContainerName := ah.generateAzureContainerName(*blob)
+	blobURL, _ := ah.getBlobURL(azureContainerName, blob.BlobCloudName)
+
+	if !blob.Snapshot.IsZero() {
+		return blobURL.WithSnapshot(blob.Snapshot)
+	}
+	return *blobURL
+}
+
 // generateAzureContainerName gets the REAL Azure container name for the simpleBlob
 func (ah *AzureHandler) generateAzureContainerName(blob models.SimpleBlob) string {
 	currentContainer := blob.ParentContainer
@@ -548,105 +1108,389 @@ func (ah *AzureHandler) getContainerAndBlobNames(destContainer *models.SimpleCon
 
 // writeBlobFromCache.. read the cache file and pass the byte slice onto the real writer.
 func (ah *AzureHandler) writeBlobFromCache(destContainer *models.SimpleContainer, sourceBlob *models.SimpleBlob) error {
+
+	// need to get cache dir from somewhere!
+	cacheFile, err := os.OpenFile(sourceBlob.DataCachedAtPath, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer cacheFile.Close()
+
+	info, err := cacheFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	return ah.writeBlobFromReader(destContainer, sourceBlob, cacheFile, info.Size())
+}
+
+func (ah *AzureHandler) writeBlobFromMemory(destContainer *models.SimpleContainer, sourceBlob *models.SimpleBlob) error {
+	return ah.writeBlobFromReader(destContainer, sourceBlob, bytes.NewReader(sourceBlob.DataInMemory), int64(len(sourceBlob.DataInMemory)))
+}
+
+// writeBlobFromReader writes the stream as the type of blob required. size is -1 if unknown.
+func (ah *AzureHandler) writeBlobFromReader(destContainer *models.SimpleContainer, sourceBlob *models.SimpleBlob, reader io.Reader, size int64) error {
 	azureContainerName, azureBlobName := ah.getContainerAndBlobNames(destContainer, sourceBlob.Name)
 
-	_, err := ah.getOrCreateContainer( azureContainerName)
+	_, err := ah.getOrCreateContainer(azureContainerName)
 	if err != nil {
-		log.Fatal(err)
 		return err
 	}
 
-	log.Debugf("writeBlobFromCache container: %s blob: %s", azureContainerName, azureBlobName)
-	// file stream for cache.
-	var cacheFile *os.File
+	blobType := ah.destBlobType(sourceBlob)
+	log.Debugf("writeBlobFromReader container: %s blob: %s type: %s", azureContainerName, azureBlobName, blobType)
 
-	// need to get cache dir from somewhere!
-	cacheFile, err = os.OpenFile(sourceBlob.DataCachedAtPath, os.O_RDONLY, 0)
+	// the size from the listing will do if the stream length isn't known.
+	if size < 0 {
+		size = sourceBlob.Properties.Size
+	}
+
+	switch blobType {
+	case AzurePageBlob:
+		return ah.writePageBlobFromReader(azureContainerName, azureBlobName, sourceBlob.Properties, reader, size)
+	case AzureAppendBlob:
+		return ah.writeAppendBlobFromReader(azureContainerName, azureBlobName, sourceBlob.Properties, reader)
+	}
+
+	err = ah.writeBlockBlobFromReader(azureContainerName, azureBlobName, sourceBlob, reader, size)
 	if err != nil {
-		log.Fatal(err)
 		return err
 	}
-	defer cacheFile.Close()
 
-	buffer := make([]byte, 1024*100)
-	numBytesRead := 0
+	if ah.AccessTier != "" {
+		return ah.setBlobTier(azureContainerName, azureBlobName)
+	}
+	return nil
+}
+
+// destBlobType the type of blob the source blob is written as.
+func (ah *AzureHandler) destBlobType(sourceBlob *models.SimpleBlob) string {
+	if ah.BlobType != "" {
+		return ah.BlobType
+	}
+
+	// other clouds only have the one type.
+	if sourceBlob.Properties.BlobType != "" {
+		return sourceBlob.Properties.BlobType
+	}
+	return AzureBlockBlob
+}
+
+// writeBlockBlobFromReader reads the stream a block at a time, writing each block to Azure as it goes.
+// Once the stream is exhausted the block list is committed.
+func (ah *AzureHandler) writeBlockBlobFromReader(azureContainerName string, azureBlobName string, sourceBlob *models.SimpleBlob, reader io.Reader, size int64) error {
+
+	blockSize := ah.blockSizeFor(size)
+	blockIDPrefix := generateBlockIDPrefix(sourceBlob, blockSize)
+	log.Debugf("writing %s in blocks of %d", azureBlobName, blockSize)
+
+	stagedBlocks := map[string]int32{}
+	if ah.ReuseStagedBlocks {
+		stagedBlocks = ah.getStagedBlocks(azureContainerName, azureBlobName)
+	}
+
+	parallelism := int(ah.BlockParallelism)
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	// buffers are reused between blocks, so at most parallelism blocks are held in memory.
+	// Allocated on demand so small blobs don't allocate every buffer.
+	buffers := make(chan []byte, parallelism)
+	for i := 0; i < parallelism; i++ {
+		buffers <- nil
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var uploadErr error
+
+	failed := func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return uploadErr != nil
+	}
+
 	blockIDList := []string{}
 	finishedProcessing := false
-	for finishedProcessing == false {
-		numBytesRead, err = cacheFile.Read(buffer)
-		if err != nil {
+	for !finishedProcessing && !failed() {
+		buffer := <-buffers
+		if buffer == nil {
+			buffer = make([]byte, blockSize)
+		}
+
+		numBytesRead, err := io.ReadFull(reader, buffer)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			finishedProcessing = true
-			continue
+		} else if err != nil {
+			buffers <- buffer
+			lock.Lock()
+			uploadErr = err
+			lock.Unlock()
+			break
 		}
 
 		if numBytesRead <= 0 {
-			finishedProcessing = true
+			buffers <- buffer
 			continue
 		}
-		blockID, err := ah.writeMemoryToBlob(azureContainerName, azureBlobName, buffer[:numBytesRead])
-		if err != nil {
-			log.Fatal("Unable to write memory to blob ", err)
+
+		if len(blockIDList) >= azureMaxBlockCount {
+			buffers <- buffer
+			lock.Lock()
+			uploadErr = fmt.Errorf("%s needs more than %d blocks of %d bytes", azureBlobName, azureMaxBlockCount, blockSize)
+			lock.Unlock()
+			break
 		}
 
+		blockID := generateBlockID(blockIDPrefix, len(blockIDList))
 		blockIDList = append(blockIDList, blockID)
+
+		// still have to read the source to get to the next block, but can skip the upload.
+		if size, ok := stagedBlocks[blockID]; ok && int(size) == numBytesRead {
+			log.Debugf("reusing staged block %s", blockID)
+			buffers <- buffer
+			continue
+		}
+
+		wg.Add(1)
+		go func(blockID string, buffer []byte, data []byte) {
+			defer wg.Done()
+			defer func() { buffers <- buffer }()
+
+			err := ah.putBlock(azureContainerName, azureBlobName, blockID, data)
+			if err != nil {
+				lock.Lock()
+				if uploadErr == nil {
+					uploadErr = err
+				}
+				lock.Unlock()
+			}
+		}(blockID, buffer, buffer[:numBytesRead])
+	}
+
+	wg.Wait()
+
+	// staged blocks are left for a resumed job to reuse.
+	if uploadErr != nil {
+		log.Errorf("Unable to write blocks of %s %s", azureBlobName, uploadErr)
+		return uploadErr
 	}
 
 	// finialize the blob
-	err = ah.putBlockIDList(azureContainerName, azureBlobName, blockIDList)
+	err := ah.putBlockIDList(azureContainerName, azureBlobName, blockIDList, sourceBlob.Properties)
 	if err != nil {
-		log.Fatal("putBlockIDList failed ", err)
+		log.Errorf("putBlockIDList failed %s", err)
+		return err
 	}
 
 	return nil
 }
 
-func (ah *AzureHandler) writeBlobFromMemory(destContainer *models.SimpleContainer, sourceBlob *models.SimpleBlob) error {
+// blockSizeFor the size of the blocks the blob is written in. BlockSize unless the blob would need
+// more than 50000 blocks, in which case the blocks are made big enough (up to the 100M limit).
+// size is -1 if unknown.
+func (ah *AzureHandler) blockSizeFor(size int64) int64 {
+	blockSize := ah.BlockSize
+	if blockSize <= 0 {
+		blockSize = defaultAzureBlockSize
+	}
 
-	azureContainerName, azureBlobName := ah.getContainerAndBlobNames(destContainer, sourceBlob.Name)
+	if size > blockSize*azureMaxBlockCount {
+		// round up to the next MB.
+		blockSize = (size/azureMaxBlockCount/(1024*1024) + 1) * 1024 * 1024
+	}
 
-	_, err := ah.getOrCreateContainer(azureContainerName)
+	if blockSize > azureMaxBlockSize {
+		blockSize = azureMaxBlockSize
+	}
+
+	return blockSize
+}
+
+// writePageBlobFromReader creates a page blob of size bytes then writes the stream to it.
+// Pages that are all zeros are skipped, so sparse disks (VHDs) only transfer the data actually used.
+func (ah *AzureHandler) writePageBlobFromReader(containerName string, blobName string, properties models.BlobProperties, reader io.Reader, size int64) error {
+
+	if size < 0 {
+		return fmt.Errorf("Size of %s is unknown, so it can't be written as a page blob", blobName)
+	}
+	if size%azurePageSize != 0 {
+		return fmt.Errorf("%s is %d bytes, page blobs must be a multiple of %d bytes", blobName, size, azurePageSize)
+	}
+
+	containerURL := ah.serviceURL.NewContainerURL(containerName)
+	blobURL := containerURL.NewPageBlobURL(blobName)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+	_, err := blobURL.Create(ctx, size, 0, azureHTTPHeaders(properties), azureMetadata(properties.Metadata), storage.BlobAccessConditions{})
+	cancel()
 	if err != nil {
-		log.Fatal(err)
+		log.Errorf("Unable to create page blob %s %s", blobName, err)
 		return err
 	}
 
-	totalBytes := len(sourceBlob.DataInMemory)
-	bufferSize := 1024 * 100
-	buffer := make([]byte, bufferSize)
-	numBytesRead := 0
-	bytesWritten := 0
+	buffer := make([]byte, azureMaxWriteSize)
+	for offset := int64(0); offset < size; {
+		chunk := buffer
+		if size-offset < int64(len(chunk)) {
+			chunk = chunk[:size-offset]
+		}
 
-	blockIDList := []string{}
+		_, err := io.ReadFull(reader, chunk)
+		if err != nil {
+			log.Errorf("Unable to read page %d of %s %s", offset/azurePageSize, blobName, err)
+			return err
+		}
+
+		if !isAllZeros(chunk) {
+			err = ah.writePages(blobURL, offset, chunk)
+			if err != nil {
+				return err
+			}
+		} else {
+			log.Debugf("skipping empty pages at %d", offset)
+		}
 
-	for bytesWritten < totalBytes {
+		offset += int64(len(chunk))
+	}
 
-		checkNumBytesToRead := bufferSize
-		if totalBytes-numBytesRead < bufferSize {
-			checkNumBytesToRead = totalBytes - numBytesRead
+	return nil
+}
+
+// writePages writes data (a multiple of the page size) to the page blob at offset.
+func (ah *AzureHandler) writePages(blobURL storage.PageBlobURL, offset int64, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+	defer cancel()
+
+	pageRange := storage.PageRange{Start: offset, End: offset + int64(len(data)) - 1}
+	_, err := blobURL.PutPages(ctx, pageRange, bytes.NewReader(data), storage.BlobAccessConditions{})
+	if err != nil {
+		log.Errorf("Unable to PutPages %d-%d %s", pageRange.Start, pageRange.End, err)
+		return err
+	}
+
+	return nil
+}
+
+func isAllZeros(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
 		}
+	}
+	return true
+}
+
+// writeAppendBlobFromReader creates an append blob and appends the stream to it a block at a time.
+func (ah *AzureHandler) writeAppendBlobFromReader(containerName string, blobName string, properties models.BlobProperties, reader io.Reader) error {
 
-		// write 100k at a time?
-		// too small? too big?
-		buffer = sourceBlob.DataInMemory[numBytesRead : numBytesRead+checkNumBytesToRead]
+	containerURL := ah.serviceURL.NewContainerURL(containerName)
+	blobURL := containerURL.NewAppendBlobURL(blobName)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+	_, err := blobURL.Create(ctx, azureHTTPHeaders(properties), azureMetadata(properties.Metadata), storage.BlobAccessConditions{})
+	cancel()
+	if err != nil {
+		log.Errorf("Unable to create append blob %s %s", blobName, err)
+		return err
+	}
+
+	buffer := make([]byte, azureMaxWriteSize)
+	finishedProcessing := false
+	for finishedProcessing == false {
+		numBytesRead, err := io.ReadFull(reader, buffer)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			finishedProcessing = true
+		} else if err != nil {
+			return err
+		}
+
+		if numBytesRead <= 0 {
+			continue
+		}
 
-		blockID, err := ah.writeMemoryToBlob(azureContainerName, azureBlobName, buffer)
+		ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+		_, err = blobURL.AppendBlock(ctx, bytes.NewReader(buffer[:numBytesRead]), storage.BlobAccessConditions{})
+		cancel()
 		if err != nil {
-			log.Fatal("Unable to write memory to blob ", err)
+			log.Errorf("Unable to AppendBlock to %s %s", blobName, err)
+			return err
 		}
+	}
 
-		blockIDList = append(blockIDList, blockID)
+	return nil
+}
+
+// setBlobTier sets the access tier of a block blob to AccessTier.
+// Sent directly through the pipeline since the SDK doesn't support it.
+func (ah *AzureHandler) setBlobTier(containerName string, blobName string) error {
+
+	blobURL, _ := ah.getBlobURL(containerName, blobName)
+	u := blobURL.URL()
+	query := u.Query()
+	query.Set("comp", "tier")
+	u.RawQuery = query.Encode()
+
+	headers := map[string]string{
+		"x-ms-version":     azureSetTierAPIVersion,
+		"x-ms-access-tier": ah.AccessTier,
 	}
 
-	// finialize the blob
-	err = ah.putBlockIDList(destContainer.Name, sourceBlob.Name, blockIDList)
+	_, err := ah.doRequest(http.MethodPut, u, nil, headers, http.StatusOK, http.StatusAccepted)
 	if err != nil {
-		log.Fatal("putBlockIDList failed ", err)
+		log.Errorf("Unable to set tier of %s to %s %s", blobName, ah.AccessTier, err)
+		return err
 	}
 
+	log.Debugf("%s tier set to %s", blobName, ah.AccessTier)
 	return nil
 }
 
-func (ah *AzureHandler) putBlockIDList(containerName string, blobName string, blockIDList []string) error {
+// doRequest sends a request the SDK doesn't support through the same pipeline as everything else, so it's
+// authenticated (and retried) the same way. Returns an error unless the status is one of statusCodes.
+// The response body is discarded.
+func (ah *AzureHandler) doRequest(method string, u url.URL, body []byte, headers map[string]string, statusCodes ...int) (*http.Response, error) {
+
+	var bodyReader io.ReadSeeker
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+
+	request, err := pipeline.NewRequest(method, u, bodyReader)
+	if err != nil {
+		return nil, err
+	}
+
+	// the length is part of what's signed.
+	request.Header.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+	for k, v := range headers {
+		request.Header.Set(k, v)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+	defer cancel()
+
+	resp, err := ah.pipeline.Do(ctx, nil, request)
+	if err != nil {
+		return nil, err
+	}
+
+	httpResponse := resp.Response()
+	io.Copy(ioutil.Discard, httpResponse.Body)
+	httpResponse.Body.Close()
+
+	for _, statusCode := range statusCodes {
+		if httpResponse.StatusCode == statusCode {
+			return httpResponse, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s %s failed: %s", method, u.Path, httpResponse.Status)
+}
+
+// putBlockIDList commits the blocks, setting the HTTP headers and metadata from the source blob properties.
+func (ah *AzureHandler) putBlockIDList(containerName string, blobName string, blockIDList []string, properties models.BlobProperties) error {
 
 	log.Debugf("putBlockIDList container %s: blobName %s", containerName, blobName)
 
@@ -655,37 +1499,85 @@ func (ah *AzureHandler) putBlockIDList(containerName string, blobName string, bl
 
 	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
 	defer cancel()
-	_, err := blobURL.PutBlockList(ctx, blockIDList, storage.BlobHTTPHeaders{}, storage.Metadata{}, storage.BlobAccessConditions{})
+	_, err := blobURL.PutBlockList(ctx, blockIDList, azureHTTPHeaders(properties), azureMetadata(properties.Metadata), storage.BlobAccessConditions{})
 	return err
 
 }
 
-func (ah *AzureHandler) writeMemoryToBlob(containerName string, blobName string, buffer []byte) (string, error) {
+// putBlock stages a single block, sending its MD5 so Azure verifies the block arrived intact.
+// Sent directly through the pipeline since the SDK's PutBlock can't send the MD5.
+func (ah *AzureHandler) putBlock(containerName string, blobName string, blockID string, data []byte) error {
+	log.Debugf("blockID %s", blockID)
+
+	hash := md5.Sum(data)
+	contentMD5 := base64.StdEncoding.EncodeToString(hash[:])
 
-	// generate hash of bytearray.
-	blockID := ""
+	blobURL, _ := ah.getBlobURL(containerName, blobName)
+	u := blobURL.URL()
+	query := u.Query()
+	query.Set("comp", "block")
+	query.Set("blockid", blockID)
+	u.RawQuery = query.Encode()
 
-	//hasher := sha1.New()
-	//hasher.Write(buffer)
-	//blockID = hex.EncodeToString(hasher.Sum(nil))
-	blockID = fmt.Sprintf("%s", uuid.NewV1())
+	headers := map[string]string{
+		"x-ms-version": azureAPIVersion,
+		"Content-MD5":  contentMD5,
+	}
 
-	blockID = base64.StdEncoding.EncodeToString([]byte(blockID))
+	resp, err := ah.doRequest(http.MethodPut, u, data, headers, http.StatusCreated)
+	if err != nil {
+		log.Errorf("Unable to PutBlock %s %s", blockID, err)
+		return err
+	}
+
+	// Azure rejects a block that doesn't match the MD5 we sent, and returns the MD5 it calculated.
+	if returnedMD5 := resp.Header.Get("Content-MD5"); returnedMD5 != "" && returnedMD5 != contentMD5 {
+		return fmt.Errorf("MD5 of block %s of %s is %s, expected %s", blockID, blobName, returnedMD5, contentMD5)
+	}
+
+	return nil
+}
+
+// generateBlockIDPrefix generates the part of the block IDs that identifies the source blob (and version of it).
+// Block IDs are deterministic so a resumed copy of the same source can tell which blocks a previous attempt
+// already staged. If the source has changed, the prefix changes and nothing is reused.
+func generateBlockIDPrefix(sourceBlob *models.SimpleBlob, blockSize int64) string {
+	source := fmt.Sprintf("%s|%s|%d|%s|%s|%d", sourceBlob.URL, sourceBlob.Name, sourceBlob.Properties.Size,
+		sourceBlob.Properties.LastModified.UTC().Format(time.RFC3339Nano), sourceBlob.Properties.ETag, blockSize)
+
+	hasher := md5.New()
+	hasher.Write([]byte(source))
+	return hex.EncodeToString(hasher.Sum(nil))[:16]
+}
+
+// generateBlockID generates the ID for the block at index. All block IDs within a blob must be the same length.
+func generateBlockID(prefix string, index int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s%08d", prefix, index)))
+}
+
+// getStagedBlocks gets the uncommitted blocks (and their sizes) of a blob.
+// Any failure just means nothing is reused.
+func (ah *AzureHandler) getStagedBlocks(containerName string, blobName string) map[string]int32 {
+	stagedBlocks := map[string]int32{}
 
 	containerURL := ah.serviceURL.NewContainerURL(containerName)
 	blobURL := containerURL.NewBlockBlobURL(blobName)
-	log.Debugf("blockID %s", blockID)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
 	defer cancel()
 
-	_, err := blobURL.PutBlock(ctx, blockID, bytes.NewReader(buffer), storage.LeaseAccessConditions{})
-
+	blockList, err := blobURL.GetBlockList(ctx, storage.BlockListUncommitted, storage.LeaseAccessConditions{})
 	if err != nil {
-		log.Fatal("Unable to PutBlock ", blockID)
+		log.Debugf("Unable to get staged blocks for %s %s", blobName, err)
+		return stagedBlocks
+	}
+
+	for _, block := range blockList.UncommittedBlocks {
+		stagedBlocks[block.Name] = block.Size
 	}
 
-	return blockID, nil
+	log.Debugf("%s has %d staged blocks", blobName, len(stagedBlocks))
+	return stagedBlocks
 }
 
 
@@ -696,20 +1588,35 @@ func (ah *AzureHandler) writeMemoryToBlob(containerName string, blobName string,
 // vdir1/blob2
 // vdir1/vdir3/blob3
 // blob4
-func (ah *AzureHandler) populateSimpleContainer(blobListResponse *storage.ListBlobsResponse, container *models.SimpleContainer, blobPrefix string) {
+// blobPrefix (the path of the container within the real Azure container) is pruned from the blob names.
+func (ah *AzureHandler) populateSimpleContainer(blobListResponse *storage.ListBlobsResponse, container *models.SimpleContainer, azureContainerName string, blobPrefix string) {
+
+	containerURL := ah.serviceURL.NewContainerURL(azureContainerName)
+
+	// virtual directories from a hierarchical listing. Contents aren't known until they're listed.
+	for _, prefix := range blobListResponse.Blobs.BlobPrefix {
+		vdirName := strings.TrimSuffix(strings.TrimPrefix(prefix.Name, blobPrefix), "/")
+		if vdirName != "" {
+			ah.getSubContainer(container, vdirName)
+		}
+	}
 
 	for _, blob := range blobListResponse.Blobs.Blob {
 
 		log.Debugf("populateSimpleContainer blob %s", blob.Name)
-		sp := strings.Split(blob.Name, "/")
+		prunedBlobName := strings.TrimPrefix(blob.Name, blobPrefix)
+		sp := strings.Split(prunedBlobName, "/")
 
 		// if no / then no subdirs etc. Just add as is.
 		if len(sp) == 1 {
 			b := models.SimpleBlob{}
-			b.Name = blob.Name
+			b.Name = prunedBlobName
 			b.Origin = container.Origin
 			b.ParentContainer = container
 			b.BlobCloudName = blob.Name
+			b.Properties = azurePropertiesFromListing(blob.Properties, blob.Metadata)
+			b.URL = urlWithoutSAS(containerURL.NewBlobURL(blob.Name).URL())
+			setAzureSnapshot(&b, blob.Snapshot, containerURL)
 			// add to the blob slice within the container
 			container.BlobSlice = append(container.BlobSlice, &b)
 		} else {
@@ -734,10 +1641,9 @@ func (ah *AzureHandler) populateSimpleContainer(blobListResponse *storage.ListBl
 			b.Origin = container.Origin
 			b.ParentContainer = container
 			b.BlobCloudName = blob.Name // cloud specific name... ie the REAL name.
-
-			containerURL := ah.serviceURL.NewContainerURL(container.Name)
-			blobURL := containerURL.NewBlobURL(blob.Name)
-			b.URL = blobURL.String()
+			b.Properties = azurePropertiesFromListing(blob.Properties, blob.Metadata)
+			b.URL = urlWithoutSAS(containerURL.NewBlobURL(blob.Name).URL())
+			setAzureSnapshot(&b, blob.Snapshot, containerURL)
 			currentContainer.BlobSlice = append(currentContainer.BlobSlice, &b)
 			currentContainer.Populated = true
 		}
@@ -745,6 +1651,19 @@ func (ah *AzureHandler) populateSimpleContainer(blobListResponse *storage.ListBl
 	container.Populated = true
 }
 
+// setAzureSnapshot makes the SimpleBlob represent a snapshot of the blob, if snapshot is set.
+// The snapshot time is added to the name so each snapshot is copied as a separate blob.
+// eg. myblob@2017-06-01T101500.1234567Z (no colons, so it's a valid filename everywhere).
+func setAzureSnapshot(b *models.SimpleBlob, snapshot time.Time, containerURL storage.ContainerURL) {
+	if snapshot.IsZero() {
+		return
+	}
+
+	b.Snapshot = snapshot
+	b.Name = b.Name + "@" + snapshot.UTC().Format("2006-01-02T150405.0000000Z")
+	b.URL = urlWithoutSAS(containerURL.NewBlobURL(b.BlobCloudName).WithSnapshot(snapshot).URL())
+}
+
 // getSubContainer gets an existing subcontainer with parent of container and name of segment.
 // otherwise it creates it, adds it to the parent container and returns the new one.
 func (ah *AzureHandler) getSubContainer(container *models.SimpleContainer, segment string) *models.SimpleContainer {
@@ -764,3 +1683,90 @@ func (ah *AzureHandler) getSubContainer(container *models.SimpleContainer, segme
 	container.ContainerSlice = append(container.ContainerSlice, &newContainer)
 	return &newContainer
 }
+
+// azureListBlobsOptions lists blobs with their metadata, so it can be carried across with the blob.
+func azureListBlobsOptions(blobPrefix string) storage.ListBlobsOptions {
+	return storage.ListBlobsOptions{Prefix: blobPrefix, Details: storage.BlobListingDetails{Metadata: true}}
+}
+
+// azurePropertiesFromListing converts the properties returned when listing blobs.
+// MD5 is only retrieved when the blob is read.
+func azurePropertiesFromListing(props storage.BlobProperties, metadata storage.Metadata) models.BlobProperties {
+	p := models.BlobProperties{}
+	p.LastModified = props.LastModified
+	p.ETag = string(props.Etag)
+	p.BlobType = string(props.BlobType)
+	p.Metadata = blobutils.NormaliseMetadata(metadata)
+
+	if props.ContentLength != nil {
+		p.Size = *props.ContentLength
+	}
+	if props.ContentType != nil {
+		p.ContentType = *props.ContentType
+	}
+	if props.ContentEncoding != nil {
+		p.ContentEncoding = *props.ContentEncoding
+	}
+	if props.ContentLanguage != nil {
+		p.ContentLanguage = *props.ContentLanguage
+	}
+	if props.ContentDisposition != nil {
+		p.ContentDisposition = *props.ContentDisposition
+	}
+	if props.CacheControl != nil {
+		p.CacheControl = *props.CacheControl
+	}
+
+	return p
+}
+
+// azurePropertiesFromResponse converts the headers returned when reading a blob.
+func azurePropertiesFromResponse(resp *storage.GetResponse) models.BlobProperties {
+	p := models.BlobProperties{}
+	p.Size = resp.ContentLength()
+	p.LastModified = resp.LastModified()
+	p.ETag = string(resp.ETag())
+	p.BlobType = string(resp.BlobType())
+	p.ContentType = resp.ContentType()
+	p.ContentEncoding = resp.ContentEncoding()
+	p.ContentLanguage = resp.ContentLanguage()
+	p.ContentDisposition = resp.ContentDisposition()
+	p.CacheControl = resp.CacheControl()
+	p.Metadata = blobutils.NormaliseMetadata(resp.NewMetadata())
+
+	// blobs written without an MD5 return all zeros.
+	contentMD5 := resp.ContentMD5()
+	for _, b := range contentMD5 {
+		if b != 0 {
+			p.ContentMD5 = append([]byte{}, contentMD5[:]...)
+			break
+		}
+	}
+
+	return p
+}
+
+// azureHTTPHeaders converts the blob properties into the headers set when committing a blob.
+func azureHTTPHeaders(properties models.BlobProperties) storage.BlobHTTPHeaders {
+	headers := storage.BlobHTTPHeaders{}
+	headers.ContentType = properties.ContentType
+	headers.ContentEncoding = properties.ContentEncoding
+	headers.ContentLanguage = properties.ContentLanguage
+	headers.ContentDisposition = properties.ContentDisposition
+	headers.CacheControl = properties.CacheControl
+
+	if len(properties.ContentMD5) == len(headers.ContentMD5) {
+		copy(headers.ContentMD5[:], properties.ContentMD5)
+	}
+
+	return headers
+}
+
+// azureMetadata converts metadata keys to ones Azure accepts.
+func azureMetadata(metadata map[string]string) storage.Metadata {
+	m := storage.Metadata{}
+	for k, v := range blobutils.AzureMetadata(metadata) {
+		m[k] = v
+	}
+	return m
+}
@@ -2,8 +2,36 @@ package handlers
 
 import (
 	"azurecopy/azurecopy/models"
+	"io"
+	"time"
 )
 
+// defaultPresignedURLExpiry how long presigned URLs are valid for unless configured otherwise.
+const defaultPresignedURLExpiry = 15 * time.Minute
+
+// defaults for ranged downloads (Azure and S3) unless configured otherwise.
+const (
+	defaultDownloadChunkSize   = 1024 * 1024 * 8
+	defaultDownloadParallelism = 4
+)
+
+// useRangedDownload determines if a blob is worth downloading as parallel ranges.
+// The size has to be known up front (ie from the listing) so blobs with an unknown size aren't.
+func useRangedDownload(size int64, chunkSize int64, parallelism uint) bool {
+	return parallelism > 1 && chunkSize > 0 && size > chunkSize
+}
+
+// ServerSideCopyHandler is implemented by handlers that can pull a blob straight from a (presigned) URL, so the
+// data never passes through us. Used for the CopyBlob flag.
+type ServerSideCopyHandler interface {
+
+	// copies sourceURL to destBlobName in destContainer, blocking until the copy has completed.
+	DoCopyBlobUsingAzureCopyBlobFlag(sourceURL string, destContainer *models.SimpleContainer, destBlobName string, metadata map[string]string) error
+
+	// aborts any copies that haven't completed yet.
+	AbortPendingCopies() error
+}
+
 // CloudHandlerInterface is the interface for all cloud based operations
 // each cloud handler will implement these.
 // list blobs/containers/read/write etc.
@@ -11,7 +39,7 @@ type CloudHandlerInterface interface {
 
 	// gets root container. This will get containers/blobs in this container
 	// NOT recursive.
-	GetRootContainer() models.SimpleContainer
+	GetRootContainer() (models.SimpleContainer, error)
 
 	// create container.
 	CreateContainer(containerName string) (models.SimpleContainer, error)
@@ -22,9 +50,9 @@ type CloudHandlerInterface interface {
 	// blobs and subcontainers during this call. THIS MAY BE REVISED!!
 	GetSpecificSimpleContainer(URL string) (*models.SimpleContainer, error)
 
-	// GetContainerContentsOverChannel given a URL (ending in /) returns all the contents of the container over a channel
 	// GetContainerContentsOverChannel given a URL (ending in /) returns all the contents of the container over a channel
 	// This returns a COPY of the original source container but has been populated with *some* of the blobs/subcontainers in it.
+	// The channel is ALWAYS closed when this returns, even on error.
 	GetContainerContentsOverChannel(sourceContainer models.SimpleContainer, blobChannel chan models.SimpleContainer) error
 
 	// GetSpecificSimpleBlob given a URL (NOT ending in /) then get the SIMPLE blob that represents it.
@@ -35,7 +63,7 @@ type CloudHandlerInterface interface {
 	GetSpecificSimpleBlob(URL string) (*models.SimpleBlob, error)
 
 	// Given a container and a blob name, read the blob.
-	ReadBlob(container models.SimpleContainer, blobName string) models.SimpleBlob
+	ReadBlob(container models.SimpleContainer, blobName string) (models.SimpleBlob, error)
 
 	// Does blob exist
 	BlobExists(container models.SimpleContainer, blobName string) (bool, error)
@@ -47,6 +75,23 @@ type CloudHandlerInterface interface {
 	// given a container and blob, write blob.
 	WriteBlob(container *models.SimpleContainer, blob *models.SimpleBlob) error
 
+	// DeleteBlob deletes the blob from the container. blobName is relative to the container
+	// and may include virtual directories (eg. vdir1/vdir2/myblob).
+	DeleteBlob(container *models.SimpleContainer, blobName string) error
+
+	// GetBlobReader opens a stream to the blob contents so it can be copied without being
+	// held in memory or cached to disk. Returns the stream and the size of the blob.
+	// Caller is responsible for closing the stream.
+	GetBlobReader(blob *models.SimpleBlob) (io.ReadCloser, int64, error)
+
+	// WriteBlobFromReader writes blob to container reading the contents from the reader.
+	// size is the total number of bytes that will be read.
+	WriteBlobFromReader(container *models.SimpleContainer, blob *models.SimpleBlob, reader io.Reader, size int64) error
+
+	// RequiresSeekableBody indicates the handler cannot write from a plain stream and needs
+	// the blob populated (in memory or cache) via PopulateBlob before WriteBlob is called.
+	RequiresSeekableBody() bool
+
 	// write a container (and subcontents) to the appropriate data store
 	WriteContainer(sourceContainer *models.SimpleContainer, destContainer *models.SimpleContainer) error
 
@@ -57,5 +102,6 @@ type CloudHandlerInterface interface {
 	GetContainerContents(container *models.SimpleContainer) error
 
 	// generates presigned URL so Azure can access blob for CopyBlob flag operation.
+	// URL is read only and expires (how long depends on handler configuration).
 	GeneratePresignedURL(blob *models.SimpleBlob) (string, error)
 }
@@ -40,7 +40,8 @@ func NewDropboxHandler(isSource bool, cacheToDisk bool) (*DropboxHandler, error)
 	dh.cacheToDisk = cacheToDisk
 	dir, err := ioutil.TempDir("", "azurecopy")
 	if err != nil {
-		log.Fatalf("Unable to create temp directory %s", err)
+		log.Errorf("Unable to create temp directory %s", err)
+		return nil, err
 	}
 
 	dh.cacheLocation = dir
@@ -48,25 +49,27 @@ func NewDropboxHandler(isSource bool, cacheToDisk bool) (*DropboxHandler, error)
 
 	config, err = helpers.SetupConnection()
 	if err != nil {
-		log.Fatalf("Unable to setup dropbox %s", err)
+		log.Errorf("Unable to setup dropbox %s", err)
+		return nil, err
 	}
 
 	return dh, nil
 }
 
 // GetRootContainer gets root container of S3. Gets the list of buckets and THOSE are the immediate child containers here.
-func (dh *DropboxHandler) GetRootContainer() models.SimpleContainer {
+func (dh *DropboxHandler) GetRootContainer() (models.SimpleContainer, error) {
 	container := models.SimpleContainer{}
 	dbx := files.New(*config)
 	arg := files.NewListFolderArg("")
 
 	res, err := dbx.ListFolder(arg)
 	if err != nil {
-		log.Fatalf("Dropbox::GetRootContainer error %s", err)
+		log.Errorf("Dropbox::GetRootContainer error %s", err)
+		return container, err
 	}
 
 	log.Debugf("results are %s", res)
-	return container
+	return container, nil
 }
 
 // BlobExists checks if blob exists
@@ -113,7 +116,8 @@ func (dh *DropboxHandler) GetSpecificSimpleContainer(URL string) (*models.Simple
 
 	res, err := dbx.ListFolder(arg)
 	if err != nil {
-		log.Fatalf("Dropbox::GetRootContainer error %s", err)
+		log.Errorf("Dropbox::GetSpecificSimpleContainer error %s", err)
+		return nil, err
 	}
 
 	container := models.SimpleContainer{}
@@ -246,6 +250,7 @@ func processEntries(results *files.ListFolderResult, dirArg string, rootContaine
 			//blob.URL = fmt.Sprintf("https://www.dropbox.com%s", f.PathDisplay) // NOT A REAL URL.... do we need it?
 			blob.URL = f.PathDisplay // NOT A REAL URL.... do we need it?
 			blob.Origin = models.DropBox
+			blob.Properties = dropboxProperties(f)
 
 			// adds to appropriate container. Will create intermediate containers if required.
 			addToContainer(&blob, f.PathDisplay, rootContainer)
@@ -360,10 +365,10 @@ func (dh *DropboxHandler) GetSpecificSimpleBlob(URL string) (*models.SimpleBlob,
 // ie we might have RootSimpleContainer -> SimpleContainer(myrealcontainer) -> SimpleContainer(vdir1) -> SimpleContainer(vdir2)
 // and if the blobName is "myblob" then the REAL underlying Azure structure would be container == "myrealcontainer"
 // and the blob name is vdir/vdir2/myblob
-func (dh *DropboxHandler) ReadBlob(container models.SimpleContainer, blobName string) models.SimpleBlob {
+func (dh *DropboxHandler) ReadBlob(container models.SimpleContainer, blobName string) (models.SimpleBlob, error) {
 	var blob models.SimpleBlob
 
-	return blob
+	return blob, nil
 }
 
 // PopulateBlob. Used to read a blob IFF we already have a reference to it.
@@ -374,14 +379,14 @@ func (dh *DropboxHandler) PopulateBlob(blob *models.SimpleBlob) error {
 	arg := files.NewDownloadArg(blob.URL)
 	log.Debugf("DB URL to download %s", blob.URL)
 	res, contents, err := dbx.Download(arg)
-
-	//if err != nil {
-	//		log.Errorf("DB Cannot download blob %s, %s", blob.URL, err)
-	//		return err
-	//	}
+	if err != nil {
+		log.Errorf("DB Cannot download blob %s, %s", blob.URL, err)
+		return err
+	}
+	defer contents.Close()
 
 	log.Debugf("res %s", res)
-	log.Debugf("contents %s", contents)
+	blob.Properties = dropboxProperties(res)
 
 	err = blobutils.ReadBlob(contents, blob, dh.cacheToDisk, dh.cacheLocation)
 	if err != nil {
@@ -434,10 +439,36 @@ func generateDestDir( destContainer *models.SimpleContainer, sourceBlob *models.
 func (dh *DropboxHandler) WriteBlob(destContainer *models.SimpleContainer, sourceBlob *models.SimpleBlob) error {
 	log.Debugf("DB: should be writing blobs!!")
 
+	// if cached to disk we should probably upload in chunked matter.
+	// will figure that out later. TODO(kpfaulkner)
+	// Where the blob is depends on how the source handler read it, not on our own cache setting.
+	if !sourceBlob.BlobInMemory {
+		cacheFile, err := os.OpenFile(sourceBlob.DataCachedAtPath, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer cacheFile.Close()
+		s, err := cacheFile.Stat()
+		if err != nil {
+			return err
+		}
+		return dh.WriteBlobFromReader(destContainer, sourceBlob, cacheFile, s.Size())
+	}
+
+	fileBytes := bytes.NewReader(sourceBlob.DataInMemory) // convert to io.ReadSeeker type
+	return dh.WriteBlobFromReader(destContainer, sourceBlob, fileBytes, int64(len(sourceBlob.DataInMemory)))
+}
+
+// WriteBlobFromReader uploads the stream to Dropbox using an upload session.
+// Dropbox needs to know the size up front to determine how to chunk.
+func (dh *DropboxHandler) WriteBlobFromReader(destContainer *models.SimpleContainer, sourceBlob *models.SimpleBlob, reader io.Reader, size int64) error {
+
 	log.Debugf("DB: dest container is %s", destContainer.Name)
-	log.Debugf("DB: destcontainer parent is %s", destContainer.ParentContainer.Name)
+	if size < 0 {
+		return errors.New("Dropbox requires blob size to be known")
+	}
 
-	destDir := generateDestDir( destContainer, sourceBlob)
+	destDir := generateDestDir(destContainer, sourceBlob)
 
 	log.Debugf("DEST DIR is %s", destDir)
 	dbx := files.New(*config)
@@ -446,32 +477,60 @@ func (dh *DropboxHandler) WriteBlob(destContainer *models.SimpleContainer, sourc
 	log.Debugf("db: full dest path %s", dst)
 	commitInfo := files.NewCommitInfo(dst)
 	commitInfo.Mode.Tag = "overwrite"
+	// Dropbox has nowhere to store other properties, but can keep the modified time.
 	commitInfo.ClientModified = time.Now().UTC().Round(time.Second)
+	if !sourceBlob.Properties.LastModified.IsZero() {
+		commitInfo.ClientModified = sourceBlob.Properties.LastModified.UTC().Round(time.Second)
+	}
 
+	return dh.uploadChunked(dbx, reader, commitInfo, size)
+}
 
-	// if cached to disk we should probably upload in chunked matter.
-	// will figure that out later. TODO(kpfaulkner)
-	if dh.cacheToDisk {
-		cacheFile, err := os.OpenFile(sourceBlob.DataCachedAtPath, os.O_RDONLY, 0)
-		if err != nil {
-			log.Fatal(err)
-			return  err
-		}
-		defer cacheFile.Close()
-		s, err  := cacheFile.Stat()
-		if err != nil {
-			log.Fatal(err)
-			return  err
-		}
-		dh.uploadChunked(dbx, cacheFile, commitInfo, s.Size())
-	} else {
-		fileBytes := bytes.NewReader(sourceBlob.DataInMemory) // convert to io.ReadSeeker type
-		dh.uploadChunked(dbx, fileBytes, commitInfo, int64(len(sourceBlob.DataInMemory)))
+// DeleteBlob deletes the file from Dropbox.
+func (dh *DropboxHandler) DeleteBlob(container *models.SimpleContainer, blobName string) error {
+	dbx := files.New(*config)
+	dst := generateDestDir(container, nil) + blobName
+
+	log.Debugf("DB: deleting %s", dst)
+	_, err := dbx.DeleteV2(files.NewDeleteArg(dst))
+	if err != nil {
+		log.Errorf("DB: unable to delete %s %s", dst, err)
+		return err
 	}
 
 	return nil
 }
 
+// GetBlobReader opens a stream to the Dropbox file.
+func (dh *DropboxHandler) GetBlobReader(blob *models.SimpleBlob) (io.ReadCloser, int64, error) {
+	dbx := files.New(*config)
+	arg := files.NewDownloadArg(blob.URL)
+	log.Debugf("DB URL to stream %s", blob.URL)
+
+	res, contents, err := dbx.Download(arg)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	blob.Properties = dropboxProperties(res)
+	return contents, int64(res.Size), nil
+}
+
+// dropboxProperties converts the Dropbox file metadata. Dropbox has no user metadata or HTTP properties.
+// Rev is used as the ETag since it changes whenever the file does.
+func dropboxProperties(f *files.FileMetadata) models.BlobProperties {
+	p := models.BlobProperties{}
+	p.Size = int64(f.Size)
+	p.LastModified = f.ServerModified
+	p.ETag = f.Rev
+	return p
+}
+
+// RequiresSeekableBody Dropbox upload sessions read sequentially so a plain stream is fine.
+func (dh *DropboxHandler) RequiresSeekableBody() bool {
+	return false
+}
+
 // uploadChunked upload to dropbox in a chunked manner (for >150M files).
 // Heavily inspired by the Dropbox code in dbxcli demo program.
 func (dh *DropboxHandler) uploadChunked(dbx files.Client, r io.Reader, commitInfo *files.CommitInfo,  sizeTotal int64) (err error) {
@@ -535,10 +594,18 @@ func (dh *DropboxHandler) GetContainerContents(container *models.SimpleContainer
 	return nil
 }
 
-/* presign URL code.....  use it eventually.
- */
-
+// GeneratePresignedURL uses Dropbox temporary links. Dropbox decides the expiry of these (currently 4 hours)
+// so any configured expiry is ignored.
 func (dh *DropboxHandler) GeneratePresignedURL(blob *models.SimpleBlob) (string, error) {
 
-	return "", nil
+	dbx := files.New(*config)
+	arg := files.NewGetTemporaryLinkArg(blob.URL)
+
+	res, err := dbx.GetTemporaryLink(arg)
+	if err != nil {
+		log.Errorf("Unable to get temporary link for %s %s", blob.URL, err)
+		return "", err
+	}
+
+	return res.Link, nil
 }
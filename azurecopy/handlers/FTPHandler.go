@@ -2,21 +2,49 @@ package handlers
 
 import (
 	"azurecopy/azurecopy/models"
-	"azurecopy/azurecopy/utils/containerutils"
+	"azurecopy/azurecopy/utils/blobutils"
+	"azurecopy/azurecopy/utils/helpers"
 	"azurecopy/azurecopy/utils/misc"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"path/filepath"
-	"strings"
-	"errors"
+	"mime"
+	"net"
+	"net/textproto"
+	"net/url"
 	"os"
-	"bytes"
+	"path"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/jlaffaye/ftp"
 )
 
+// FTP TLS modes.
+const (
+	FTPTLSNone     = iota
+	FTPTLSExplicit // AUTH TLS on the normal control connection (usually port 21).
+	FTPTLSImplicit // TLS from the start, ftps:// (usually port 990).
+)
+
+// FTP data connection modes.
+const (
+	FTPModePassive = "passive" // EPSV, falling back to PASV.
+	FTPModePASV    = "pasv"    // PASV only, for servers (or NAT/firewalls) that mishandle EPSV.
+	FTPModeActive  = "active"  // PORT/EPRT, the server connects back to us. For servers that only allow active mode.
+)
+
+// defaultFTPMaxConnections how many connections are opened to the server unless configured otherwise.
+const defaultFTPMaxConnections = 5
+
+// ftpDialTimeout how long to wait when connecting to the server.
+const ftpDialTimeout = 30 * time.Second
+
 // FTPHandler basic data structure for FTP handling.
 type FTPHandler struct {
 
@@ -34,37 +62,108 @@ type FTPHandler struct {
 	// is this source or dest handler?
 	IsSource bool
 
-	// client connection
-	client *ftp.ServerConn
+	// logged in connections. Each operation takes its own, so concurrent workers don't share one.
+	pool *helpers.FTPConnectionPool
+
+	// list only the immediate children (files and directories) of a directory.
+	HierarchicalListing bool
+
+	// directories already created (or known to exist) when writing.
+	createdDirectories     map[string]bool
+	createdDirectoriesLock sync.Mutex
 
 	// determine if we're caching the blob to disk during copy operations.
 	// or if we're keeping it in memory
 	cacheToDisk   bool
 	cacheLocation string
-
 }
 
 // NewFTPHandler factory to create new one. Evil?
-func NewFTPHandler(address string, username string, password string, isSource bool, cacheToDisk bool) (*FTPHandler, error) {
+// address is host:port. Up to maxConnections connections are opened to the server.
+// A connection is made (and logged in) straight away so bad addresses/credentials are found early.
+func NewFTPHandler(address string, username string, password string, tlsMode int, mode string, maxConnections uint, isSource bool, cacheToDisk bool) (*FTPHandler, error) {
 
 	fh := new(FTPHandler)
 	fh.IsSource = isSource
+	fh.basePath = "/"
+	fh.createdDirectories = make(map[string]bool)
 
-	client, err := ftp.Dial(address)
+	options := []ftp.DialOption{ftp.DialWithTimeout(ftpDialTimeout)}
+
+	host, _, err := net.SplitHostPort(address)
 	if err != nil {
 		return nil, err
 	}
+	tlsConfig := &tls.Config{ServerName: host}
+
+	// the FTP client only makes passive data connections. For active mode it's given connections made by
+	// helpers.FTPActiveMode, which also does the TLS.
+	activeMode := false
+
+	switch mode {
+	case "", FTPModePassive:
+	case FTPModePASV:
+		options = append(options, ftp.DialWithDisabledEPSV(true))
+	case FTPModeActive:
+		activeMode = true
+		options = append(options, ftp.DialWithDisabledEPSV(true))
+	default:
+		return nil, fmt.Errorf("Unknown FTP mode %s", mode)
+	}
+
+	if !activeMode {
+		switch tlsMode {
+		case FTPTLSExplicit:
+			options = append(options, ftp.DialWithExplicitTLS(tlsConfig))
+		case FTPTLSImplicit:
+			options = append(options, ftp.DialWithTLS(tlsConfig))
+		}
+	}
+
+	if maxConnections == 0 {
+		maxConnections = defaultFTPMaxConnections
+	}
+
+	// servers often insist data connections resume the control connection's TLS session.
+	var activeTLSConfig *tls.Config
+	if tlsMode != FTPTLSNone {
+		activeTLSConfig = &tls.Config{ServerName: host, ClientSessionCache: tls.NewLRUClientSessionCache(0)}
+	}
+
+	fh.pool = helpers.NewFTPConnectionPool(maxConnections, func() (*ftp.ServerConn, error) {
+		dialOptions := options
+		if activeMode {
+			am := helpers.NewFTPActiveMode(activeTLSConfig, tlsMode == FTPTLSExplicit, ftpDialTimeout)
+			dialOptions = append([]ftp.DialOption{ftp.DialWithDialFunc(am.Dial)}, options...)
+		}
+
+		client, err := ftp.Dial(address, dialOptions...)
+		if err != nil {
+			log.Errorf("Unable to connect to FTP server %s %s", address, err)
+			return nil, err
+		}
 
-	if err := client.Login(username, password); err != nil {
+		if err := client.Login(username, password); err != nil {
+			log.Errorf("Unable to login to FTP server %s %s", address, err)
+			client.Quit()
+			return nil, err
+		}
+
+		return client, nil
+	})
+
+	client, err := fh.pool.Get()
+	if err != nil {
 		return nil, err
 	}
+	fh.pool.Put(client, nil)
 
-	fh.client = client
 	fh.cacheToDisk = cacheToDisk
 
 	dir, err := ioutil.TempDir("", "azurecopy")
 	if err != nil {
-		log.Fatalf("Unable to create temp directory %s", err)
+		log.Errorf("Unable to create temp directory %s", err)
+		return nil, err
 	}
 
 	fh.cacheLocation = dir
@@ -72,17 +171,84 @@ func NewFTPHandler(address string, username string, password string, isSource bo
 	return fh, nil
 }
 
-// gets root container. This will get containers/blobs in this container
+// Close logs out (QUIT) of the idle connections.
+func (fh *FTPHandler) Close() error {
+	fh.pool.Close()
+	return nil
+}
+
+// release returns the connection to the pool. Errors replied by the server (eg. file not found) leave the
+// connection usable, anything else (eg. network errors) means it's discarded.
+func (fh *FTPHandler) release(client *ftp.ServerConn, err error) {
+	if _, ok := err.(*textproto.Error); ok {
+		err = nil
+	}
+	fh.pool.Put(client, err)
+}
+
+// ftpReader is a file being downloaded. The connection goes back to the pool once the download is closed.
+type ftpReader struct {
+	*ftp.Response
+	release   func(err error)
+	closeOnce sync.Once
+}
+
+func (r *ftpReader) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		err = r.Response.Close()
+		r.release(err)
+	})
+	return err
+}
+
+// GetRootContainer gets root container. This will get containers/blobs in this container
 // NOT recursive.
-func (fh *FTPHandler)  GetRootContainer() models.SimpleContainer {
-	//entries, _ := fh.client.List("")
+func (fh *FTPHandler) GetRootContainer() (models.SimpleContainer, error) {
+	rootContainer := models.NewSimpleContainer()
+	rootContainer.Origin = models.FTP
+	rootContainer.IsRootContainer = true
+
+	client, err := fh.pool.Get()
+	if err != nil {
+		return models.SimpleContainer{}, err
+	}
+
+	err = fh.listDirectory(client, rootContainer, false)
+	fh.release(client, err)
+	if err != nil {
+		return models.SimpleContainer{}, err
+	}
 
-	return models.SimpleContainer{}
+	return *rootContainer, nil
 }
 
-// create container.
+// CreateContainer creates the directory (and any above it).
 func (fh *FTPHandler) CreateContainer(containerName string) (models.SimpleContainer, error) {
-  return models.SimpleContainer{}, nil
+	fullPath := path.Join("/", containerName)
+
+	client, err := fh.pool.Get()
+	if err != nil {
+		return models.SimpleContainer{}, err
+	}
+
+	err = fh.createDirectories(client, fullPath)
+	fh.release(client, err)
+	if err != nil {
+		return models.SimpleContainer{}, err
+	}
+
+	rootContainer := models.NewSimpleContainer()
+	rootContainer.Origin = models.FTP
+	rootContainer.IsRootContainer = true
+
+	container := models.NewSimpleContainer()
+	container.Name = strings.Trim(containerName, "/")
+	container.Origin = models.FTP
+	container.ParentContainer = rootContainer
+	rootContainer.ContainerSlice = append(rootContainer.ContainerSlice, container)
+
+	return *container, nil
 }
 
 // get base path and container name
@@ -108,81 +274,131 @@ func getFTPContainerNameFromURL(url string) (string, string) {
 
 // GetSpecificSimpleContainer given a URL (ending in /) then get the SIMPLE container that represents it.
 // does not have to have all blobs populated in it. Those can be retrieved later via GetContainerContentsOverChannel
-// This is up to specific handlers. Currently (for example). For FTP if the url is myftpsite.com/dir1/dir2/dir3/ then it
-// will return a SimpleContainer representing dir3 with all its contents.6
+// For FTP if the url is ftp://myftpsite.com/dir1/dir2/dir3/ then it will return a SimpleContainer representing dir3.
+// Paths are from the root of the server, not the login directory.
 func (fh *FTPHandler) GetSpecificSimpleContainer(URL string) (*models.SimpleContainer, error) {
-	if URL != "" {
-
-		// check if its a container.
-		if isContainer(URL) {
-
-			var sp= strings.Split(URL, "/")
-			parentContainer := models.NewSimpleContainer()
-			parentContainer.IsRootContainer = true
-			parentContainer.Origin = models.FTP
-			currentContainer := parentContainer
-			for _, segment := range sp[1:] {
-				container := models.NewSimpleContainer()
-				container.URL = URL
-				container.Origin = models.FTP
-				container.Name = segment
-				container.IsRootContainer = false
-				container.ParentContainer = currentContainer
-				currentContainer.ContainerSlice = append(currentContainer.ContainerSlice, container)
-
-				currentContainer = container
-				log.Debugf("segment is %s\n", segment)
-			}
+	if URL == "" {
+		return nil, errors.New("URL cannot be empty")
+	}
+
+	dirPath, err := ftpPathFromURL(URL)
+	if err != nil {
+		return nil, err
+	}
 
-			return currentContainer, nil
+	parentContainer := models.NewSimpleContainer()
+	parentContainer.IsRootContainer = true
+	parentContainer.Origin = models.FTP
+	currentContainer := parentContainer
+	for _, segment := range strings.Split(strings.Trim(dirPath, "/"), "/") {
+		if segment == "" {
+			continue
 		}
+
+		container := models.NewSimpleContainer()
+		container.URL = URL
+		container.Origin = models.FTP
+		container.Name = segment
+		container.IsRootContainer = false
+		container.ParentContainer = currentContainer
+		currentContainer.ContainerSlice = append(currentContainer.ContainerSlice, container)
+
+		currentContainer = container
+		log.Debugf("segment is %s\n", segment)
 	}
 
-	return nil, errors.New("URL cannot be empty")
+	return currentContainer, nil
 }
 
-// GetContainerContents populates the container (directory) with the next level contents
-// currently wont do recursive.
-func (fh *FTPHandler) GetContainerContents(sourceContainer *models.SimpleContainer) error {
+// ftpPathFromURL gets the (unescaped) path from an ftp:// or ftps:// URL.
+func ftpPathFromURL(URL string) (string, error) {
+	u, err := url.Parse(URL)
+	if err != nil {
+		return "", err
+	}
 
-	/*  WIP!!!
-	fullPath := fh.generateFullPath(sourceContainer)
+	if u.Path == "" {
+		return "/", nil
+	}
+	return u.Path, nil
+}
 
-	entryList, err := fh.client.List( fullPath)
+// GetContainerContents populates the container (directory) with its files and directories.
+// Recursive unless HierarchicalListing is set.
+func (fh *FTPHandler) GetContainerContents(container *models.SimpleContainer) error {
+	client, err := fh.pool.Get()
+	if err != nil {
+		return err
+	}
 
-	// loop through until all directories done....
-	done := false
-	for done == false {
-		// copy of container, dont want to send back ever growing container via the channel.
-		containerClone := sourceContainer
+	err = fh.listDirectory(client, container, !fh.HierarchicalListing)
+	fh.release(client, err)
+	return err
+}
 
-		//azureContainer := ah.blobStorageClient.GetContainerReference(azureContainer.Name)
-		blobListResponse, err := containerURL.ListBlobs( ctx, marker, storage.ListBlobsOptions{ Prefix: blobPrefix})
-		if err != nil {
-			log.Fatal("Error")
-		}
+// listDirectory adds the files and directories in the container's directory to the container.
+// The FTP client lists with MLSD when the server supports it (exact sizes and UTC modified times), falling back
+// to parsing LIST output (unix and DOS formats) when it doesn't.
+// Symlinks are skipped since LIST doesn't say whether they point to a file or directory.
+func (fh *FTPHandler) listDirectory(client *ftp.ServerConn, container *models.SimpleContainer, recursive bool) error {
 
-		ah.populateSimpleContainer(blobListResponse, &containerClone, blobPrefix)
+	fullPath := fh.generateFullPath(container)
+	entries, err := client.List(fullPath)
+	if err != nil {
+		log.Errorf("Unable to list directory %s %s", fullPath, err)
+		return err
+	}
 
-		// return entire container via channel.
-		blobChannel <- containerClone
+	for _, entry := range entries {
+		if entry.Name == "." || entry.Name == ".." {
+			continue
+		}
 
-		// if marker, then keep going.
-		if blobListResponse.NextMarker.NotDone() {
-			marker = blobListResponse.NextMarker
-		} else {
-			done = true
+		switch entry.Type {
+		case ftp.EntryTypeFolder:
+			sc := models.NewSimpleContainer()
+			sc.Name = entry.Name
+			sc.Origin = models.FTP
+			sc.ParentContainer = container
+			sc.Populated = false
+			sc.IsRootContainer = false
+
+			if recursive {
+				err = fh.listDirectory(client, sc, recursive)
+				if err != nil {
+					return err
+				}
+			}
+			container.ContainerSlice = append(container.ContainerSlice, sc)
+
+		case ftp.EntryTypeFile:
+			b := models.SimpleBlob{}
+			b.Name = entry.Name
+			b.ParentContainer = container
+			b.Origin = models.FTP
+			b.URL = fullPath + b.Name
+			b.BlobCloudName = b.URL
+			b.Properties = ftpProperties(entry.Name, int64(entry.Size), entry.Time)
+			container.BlobSlice = append(container.BlobSlice, &b)
+
+		default:
+			log.Debugf("skipping %s%s", fullPath, entry.Name)
 		}
 	}
+	container.Populated = true
 
-	close(blobChannel)
-
-	*/
 	return nil
+}
 
+// ftpProperties FTP only has the size and modified time. The content type is guessed from the extension.
+func ftpProperties(name string, size int64, modified time.Time) models.BlobProperties {
+	p := models.BlobProperties{}
+	p.Size = size
+	p.LastModified = modified
+	p.ContentType = mime.TypeByExtension(path.Ext(name))
+	return p
 }
 
-// GetContainerContentsOverChannel given a URL (ending in /) returns all the contents of the container over a channel
 // GetContainerContentsOverChannel given a URL (ending in /) returns all the contents of the container over a channel
 // This returns a COPY of the original source container but has been populated with *some* of the blobs/subcontainers in it.
 // This is going to be inefficient from a memory allocation pov.
@@ -192,7 +408,10 @@ func (fh *FTPHandler) GetContainerContentsOverChannel(sourceContainer models.Sim
 
 	defer close(blobChannel)
 	// just do it in bulk for FS. Figure out later if its an issue.
-	fh.GetContainerContents(&sourceContainer)
+	err := fh.GetContainerContents(&sourceContainer)
+	if err != nil {
+		return err
+	}
 	blobChannel <- sourceContainer
 
 	return nil
@@ -204,170 +423,178 @@ func (fh *FTPHandler) GetContainerContentsOverChannel(sourceContainer models.Sim
 // speaking the true blobname is "vdir1/vdir2/blobname".
 // Will revisit this if it causes a problem.
 func (fh *FTPHandler) GetSpecificSimpleBlob(URL string) (*models.SimpleBlob, error) {
+	if misc.GetLastChar(URL) == "/" {
+		return nil, errors.New("Cannot end with a /")
+	}
 
-}
-
-// dupe of filesystem. Need to check if can just use single method instance.
-func (fh *FTPHandler) generateFullPath(container *models.SimpleContainer) string {
-
-	path := container.Name
-	currentContainer := container.ParentContainer
-	for currentContainer != nil {
-		if currentContainer.Name != "" {
-			path = filepath.Join(currentContainer.Name, path)
-		}
+	filePath, err := ftpPathFromURL(URL)
+	if err != nil {
+		return nil, err
+	}
 
-		currentContainer = currentContainer.ParentContainer
+	dirURL := URL[:strings.LastIndex(URL, "/")+1]
+	container, err := fh.GetSpecificSimpleContainer(dirURL)
+	if err != nil {
+		return nil, err
 	}
 
-	fullPath := fh.basePath + path + "/"
-	// if full path is rootContainerPath then we need to actually generate
-	return fullPath
-}
+	client, err := fh.pool.Get()
+	if err != nil {
+		return nil, err
+	}
 
-func reverseStringSlice( s []string ) []string{
-	for i := len(s)/2-1; i >= 0; i-- {
-		opp := len(s)-1-i
-		s[i], s[opp] = s[opp], s[i]
+	size, err := client.FileSize(filePath)
+	if err != nil {
+		fh.release(client, err)
+		log.Errorf("Unable to get size of %s %s", filePath, err)
+		return nil, err
 	}
 
-	return s
+	// MDTM isn't supported by every server, the time is only used for filtering/sync.
+	modified, err := client.GetTime(filePath)
+	if err != nil {
+		log.Debugf("Unable to get modified time of %s %s", filePath, err)
+		modified = time.Time{}
+	}
+	fh.release(client, err)
+
+	b := models.SimpleBlob{}
+	b.Name = path.Base(filePath)
+	b.Origin = models.FTP
+	b.ParentContainer = container
+	b.BlobCloudName = filePath
+	b.URL = URL
+	b.Properties = ftpProperties(b.Name, size, modified)
+	return &b, nil
 }
-// generate complete path of blob
-func (fh *FTPHandler) generateBlobFullPath(blob *models.SimpleBlob) string {
 
-	nameElements := []string{}
-	nameElements = append(nameElements, blob.DestName)
+// generateFullPath generates the absolute path (ending in /) of the directory.
+func (fh *FTPHandler) generateFullPath(container *models.SimpleContainer) string {
 
-	currentContainer := blob.ParentContainer
+	dirPath := container.Name
+	currentContainer := container.ParentContainer
 	for currentContainer != nil {
 		if currentContainer.Name != "" {
-			nameElements = append(nameElements, currentContainer.Name)
+			dirPath = path.Join(currentContainer.Name, dirPath)
 		}
+
 		currentContainer = currentContainer.ParentContainer
 	}
 
-	nameElements = reverseStringSlice( nameElements)
-	fullPath := strings.Join(nameElements, "/")
-	return fullPath
+	if dirPath == "" {
+		return fh.basePath
+	}
+	return fh.basePath + dirPath + "/"
 }
 
+// generate complete path of blob
+func (fh *FTPHandler) generateBlobFullPath(blob *models.SimpleBlob) string {
+	return fh.generateFullPath(blob.ParentContainer) + blob.Name
+}
 
 // Given a container and a blob name, read the blob.
-func (fh *FTPHandler) ReadBlob(container models.SimpleContainer, blobName string) models.SimpleBlob {
+func (fh *FTPHandler) ReadBlob(container models.SimpleContainer, blobName string) (models.SimpleBlob, error) {
 	var blob models.SimpleBlob
 
-	dirPath := fh.generateFullPath(&container)
-	fullPath := filepath.Join(dirPath, blobName)
+	fullPath := fh.generateFullPath(&container) + blobName
 
-	// populate this to disk.
-	if fh.cacheToDisk {
+	blob.Name = blobName
+	blob.BlobCloudName = fullPath
+	blob.ParentContainer = &container
+	blob.Origin = container.Origin
+	blob.URL = fullPath
 
-		cacheName := misc.GenerateCacheName(blob.BlobCloudName)
-		blob.DataCachedAtPath = fh.cacheLocation + "/" + cacheName
-		log.Debugf("azure blob %s cached at location %s", blob.BlobCloudName, blob.DataCachedAtPath)
-	}
+	err := fh.retrieveBlob(&blob, fullPath)
+	return blob, err
+}
 
-	r, err := fh.client.Retr(fullPath)
+// retrieveBlob reads the FTP file into memory or the cache, depending on how the handler is configured.
+func (fh *FTPHandler) retrieveBlob(blob *models.SimpleBlob, fullPath string) error {
+	client, err := fh.pool.Get()
 	if err != nil {
-		log.Fatal(err)
-	} else {
-
-		if fh.cacheToDisk {
-			// read directly into cached file
-			cacheFile, err := os.OpenFile(blob.DataCachedAtPath, os.O_WRONLY|os.O_CREATE, 0666)
-			defer cacheFile.Close()
-			if err != nil {
-				log.Fatalf("Populate blob %s", err)
-			}
-			_, err = io.Copy(cacheFile, r)
-			blob.BlobInMemory = false
-
-		} else {
-			buf, err := ioutil.ReadAll(r)
-			if err != nil {
-				log.Fatal(err)
-			}
-			r.Close() // test we can close two times
+		return err
+	}
 
-			blob.DataInMemory = buf
-			blob.BlobInMemory = true
-		}
+	r, err := client.Retr(fullPath)
+	if err != nil {
+		fh.release(client, err)
+		return err
 	}
 
-	blob.DataCachedAtPath = fullPath
-	blob.Name = blobName
-	blob.ParentContainer = &container
-	blob.Origin = container.Origin
-	blob.URL = fullPath
-	return blob
+	reader := &ftpReader{Response: r, release: func(err error) { fh.release(client, err) }}
+	defer reader.Close()
+
+	return blobutils.ReadBlob(reader, blob, fh.cacheToDisk, fh.cacheLocation)
 }
 
 // Does blob exist
 // question if error should be returned?
 func (fh *FTPHandler) BlobExists(container models.SimpleContainer, blobName string) (bool, error) {
-	dirPath := fh.generateFullPath(&container)
-	fullPath := filepath.Join(dirPath, blobName)
+	fullPath := fh.generateFullPath(&container) + blobName
+
+	client, err := fh.pool.Get()
+	if err != nil {
+		return false, err
+	}
 
-	_, err := fh.client.FileSize( fullPath)
+	_, err = client.FileSize(fullPath)
+	fh.release(client, err)
 	if err != nil {
 		return false, nil
 	}
 
 	return true, nil
-
 }
 
 // if we already have a reference to a SimpleBlob, then read it and populate it.
 // ie we're populating our in process copy of the blob (ie reading it from the provider).
 func (fh *FTPHandler) PopulateBlob(blob *models.SimpleBlob) error {
-	fullPath := fh.generateBlobFullPath( blob)
-
-	// populate this to disk.
-	if fh.cacheToDisk {
+	fullPath := fh.generateBlobFullPath(blob)
 
-		cacheName := misc.GenerateCacheName(blob.BlobCloudName)
-		blob.DataCachedAtPath = fh.cacheLocation + "/" + cacheName
-		log.Debugf("azure blob %s cached at location %s", blob.BlobCloudName, blob.DataCachedAtPath)
+	err := fh.retrieveBlob(blob, fullPath)
+	if err != nil {
+		return err
 	}
 
-	r, err := fh.client.Retr(fullPath)
-	if err != nil {
-		log.Fatal(err)
-	} else {
+	blob.URL = fullPath
+	return nil
+}
 
-		if fh.cacheToDisk {
-			// read directly into cached file
-			cacheFile, err := os.OpenFile(blob.DataCachedAtPath, os.O_WRONLY|os.O_CREATE, 0666)
-			defer cacheFile.Close()
-			if err != nil {
-				log.Fatalf("Populate blob %s", err)
-			}
-			_, err = io.Copy(cacheFile, r)
-			blob.BlobInMemory = false
+// createSubDirectories creates the directory the file is in, and every directory above it (mkdir -p).
+func (fh *FTPHandler) createSubDirectories(client *ftp.ServerConn, fullPath string) error {
+	return fh.createDirectories(client, path.Dir(fullPath))
+}
 
-		} else {
-			buf, err := ioutil.ReadAll(r)
-			if err != nil {
-				log.Fatal(err)
-			}
-			r.Close() // test we can close two times
+// createDirectories creates the directory and every missing directory above it.
+// Directories that already exist are fine.
+func (fh *FTPHandler) createDirectories(client *ftp.ServerConn, dirPath string) error {
 
-			blob.DataInMemory = buf
-			blob.BlobInMemory = true
+	currentPath := "/"
+	for _, segment := range strings.Split(strings.Trim(dirPath, "/"), "/") {
+		if segment == "" {
+			continue
 		}
-	}
+		currentPath = path.Join(currentPath, segment)
 
-	blob.DataCachedAtPath = fullPath
-	blob.URL = fullPath
+		fh.createdDirectoriesLock.Lock()
+		created := fh.createdDirectories[currentPath]
+		fh.createdDirectoriesLock.Unlock()
+		if created {
+			continue
+		}
 
-	return nil
-}
+		// MakeDir fails if the directory exists, so only care if it's still not there.
+		err := client.MakeDir(currentPath)
+		if err != nil {
+			if _, err := client.List(currentPath); err != nil {
+				log.Errorf("Unable to create directory %s %s", currentPath, err)
+				return err
+			}
+		}
 
-func (fh *FTPHandler) createSubDirectories(fullPath string) error {
-	err := fh.client.MakeDir(fullPath)
-	if err != nil {
-		return err
+		fh.createdDirectoriesLock.Lock()
+		fh.createdDirectories[currentPath] = true
+		fh.createdDirectoriesLock.Unlock()
 	}
 
 	return nil
@@ -375,55 +602,144 @@ func (fh *FTPHandler) createSubDirectories(fullPath string) error {
 
 // given a container and blob, write blob.
 func (fh *FTPHandler) WriteBlob(destContainer *models.SimpleContainer, sourceBlob *models.SimpleBlob) error {
-	blobName := sourceBlob.Name
-	if blobName[0] == os.PathSeparator {
-		blobName = blobName[1:]
+
+	if !sourceBlob.BlobInMemory {
+		// cached on disk.
+		cacheFile, err := os.OpenFile(sourceBlob.DataCachedAtPath, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer cacheFile.Close()
+
+		return fh.WriteBlobFromReader(destContainer, sourceBlob, cacheFile, -1)
 	}
 
-	fullPath := fh.generateFullPath(destContainer) + blobName
+	// in memory.
+	return fh.WriteBlobFromReader(destContainer, sourceBlob, bytes.NewReader(sourceBlob.DataInMemory), int64(len(sourceBlob.DataInMemory)))
+}
+
+// GetBlobReader opens a stream to the file on the FTP server.
+// The size is retrieved first since the connection can't be used for anything else while
+// the transfer is in progress. The connection is returned to the pool when the stream is closed.
+func (fh *FTPHandler) GetBlobReader(blob *models.SimpleBlob) (io.ReadCloser, int64, error) {
+	fullPath := fh.generateBlobFullPath(blob)
+
+	client, err := fh.pool.Get()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size, err := client.FileSize(fullPath)
+	if err != nil {
+		fh.release(client, err)
+		return nil, 0, err
+	}
+
+	r, err := client.Retr(fullPath)
+	if err != nil {
+		fh.release(client, err)
+		return nil, 0, err
+	}
+
+	blob.Properties.Size = size
+	return &ftpReader{Response: r, release: func(err error) { fh.release(client, err) }}, size, nil
+}
+
+// WriteBlobFromReader stores the stream directly on the FTP server.
+func (fh *FTPHandler) WriteBlobFromReader(destContainer *models.SimpleContainer, sourceBlob *models.SimpleBlob, reader io.Reader, size int64) error {
+	fullPath := fh.generateFullPath(destContainer) + strings.TrimPrefix(sourceBlob.Name, "/")
+
+	client, err := fh.pool.Get()
+	if err != nil {
+		return err
+	}
 
 	// make sure subdirs are created.
-	err := fh.createSubDirectories(fullPath)
+	err = fh.createSubDirectories(client, fullPath)
 	if err != nil {
-		log.Fatal(err)
+		fh.release(client, err)
 		return err
 	}
 
-	if !sourceBlob.BlobInMemory {
-		// cached on disk.
-		newFile, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE, 0)
-		if err != nil {
-			return err
-		}
-		err = fh.client.Stor(fullPath, newFile )
-		if err != nil {
-			return err
-		}
-	} else {
-		// in memory.
-		err = fh.client.Stor( fullPath,bytes.NewReader( sourceBlob.DataInMemory) )
-		if err != nil {
-			log.Fatal("Unable to upload file " + fullPath, err)
-		}
+	err = client.Stor(fullPath, reader)
+	fh.release(client, err)
+	if err != nil {
+		log.Errorf("Unable to upload file %s %s", fullPath, err)
+		return err
 	}
 
 	return nil
 }
 
-// write a container (and subcontents) to the appropriate data store
-func (fh *FTPHandler) WriteContainer(sourceContainer *models.SimpleContainer, destContainer *models.SimpleContainer) error {
-return nil
+// DeleteBlob deletes the file from the FTP server.
+func (fh *FTPHandler) DeleteBlob(container *models.SimpleContainer, blobName string) error {
+	fullPath := fh.generateFullPath(container) + strings.TrimPrefix(blobName, "/")
+
+	client, err := fh.pool.Get()
+	if err != nil {
+		return err
+	}
+
+	err = client.Delete(fullPath)
+	fh.release(client, err)
+	if err != nil {
+		log.Errorf("FTP unable to delete %s %s", fullPath, err)
+		return err
+	}
+
+	return nil
+}
+
+// RequiresSeekableBody FTP STOR reads sequentially so a plain stream is fine.
+func (fh *FTPHandler) RequiresSeekableBody() bool {
+	return false
 }
 
-// Gets a container. Populating the subtree? OR NOT? hmmmm
-func (fh *FTPHandler)  GetContainer(containerName string) models.SimpleContainer {
-	var container models.SimpleContainer
+// WriteContainer creates the directory for the source container in the destination.
+func (fh *FTPHandler) WriteContainer(sourceContainer *models.SimpleContainer, destContainer *models.SimpleContainer) error {
+	fullPath := fh.generateFullPath(destContainer) + sourceContainer.Name
 
-	return container
+	client, err := fh.pool.Get()
+	if err != nil {
+		return err
+	}
+
+	err = fh.createDirectories(client, fullPath)
+	fh.release(client, err)
+	return err
 }
 
-// generates presigned URL so Azure can access blob for CopyBlob flag operation.
-func (fh *FTPHandler)  GeneratePresignedURL(blob *models.SimpleBlob) (string, error) {
-	return "", nil
+// GetContainer gets the directory (path from the root of the server), populated with its contents.
+// An empty container is returned if it can't be listed.
+func (fh *FTPHandler) GetContainer(containerName string) models.SimpleContainer {
+	rootContainer := models.NewSimpleContainer()
+	rootContainer.Origin = models.FTP
+	rootContainer.IsRootContainer = true
+
+	container := rootContainer
+	for _, segment := range strings.Split(strings.Trim(containerName, "/"), "/") {
+		if segment == "" {
+			continue
+		}
+
+		sc := models.NewSimpleContainer()
+		sc.Name = segment
+		sc.Origin = models.FTP
+		sc.ParentContainer = container
+		container.ContainerSlice = append(container.ContainerSlice, sc)
+		container = sc
+	}
+
+	err := fh.GetContainerContents(container)
+	if err != nil {
+		log.Errorf("Unable to get container %s %s", containerName, err)
+		return models.SimpleContainer{}
+	}
+
+	return *container
+}
 
+// GeneratePresignedURL FTP has no equivalent, so the CopyBlob flag can't be used with an FTP source.
+func (fh *FTPHandler) GeneratePresignedURL(blob *models.SimpleBlob) (string, error) {
+	return "", errors.New("FTP does not support presigned URLs")
 }
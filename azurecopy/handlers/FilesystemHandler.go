@@ -2,118 +2,160 @@ package handlers
 
 import (
 	"azurecopy/azurecopy/models"
+	"azurecopy/azurecopy/utils/blobutils"
+	"azurecopy/azurecopy/utils/helpers"
+	"bytes"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/url"
 	"os"
-	"path"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
 
+// Filesystem symlink policies.
+const (
+	FilesystemSymlinkFollow   = "follow"   // copy what the link points to.
+	FilesystemSymlinkSkip     = "skip"     // ignore links.
+	FilesystemSymlinkPreserve = "preserve" // copy the link itself, as a blob holding the target. Restored as a link.
+)
+
 // FilesystemHandler basic data structure for FS handling.
 type FilesystemHandler struct {
 
-	// root directory we're dealing with.
-	// This is the prefix for any containers. For example, if we're after c:\temp\data\s3\  then the rootContainerPath is really c:\temp\data\
-	// and the container used later will be s3. Need to revisit this structure later if gets too confusing.
+	// absolute path of the source/dest URL.
 	rootContainerPath string
 
-	// basePath used for prefix.
+	// basePath used for prefix. The root of the volume (eg. / or c:\), containers are every directory below it.
 	basePath string
 
-	// container in URL
-	container string
-
 	// is this source or dest handler?
 	IsSource bool
+
+	// URL (reachable by the destination) local files are served from when generating presigned URLs.
+	// eg. http://myhost:8080
+	ServeURL string
+
+	// address the file server listens on, if not every interface on the port of ServeURL.
+	// eg. 0.0.0.0:8080 when ServeURL is the address of a NAT/proxy in front of this machine.
+	ServeListenAddress string
+
+	// how long presigned URLs are valid for.
+	PresignedURLExpiry time.Duration
+
+	// only started if a presigned URL is requested.
+	fileServer     *helpers.FileServer
+	fileServerOnce sync.Once
+
+	// reading: keep the modified time in the blob metadata (clouds set their own last modified).
+	// writing: set the modified time of the file to the source's.
+	PreserveModifiedTime bool
+
+	// reading: keep the permissions and owner (uid/gid) in the blob metadata.
+	// writing: restore them from the metadata. Changing the owner generally needs root.
+	PreservePermissions bool
+
+	// what to do with symlinks. One of the FilesystemSymlink* policies.
+	SymlinkPolicy string
 }
 
-// get base path and container name
-// assumes using WRONG format. Hmmm will this be cross platform?
-func generateBasePath(rootContainerPath string) (string, string) {
+// FilesystemPathFromURL converts the URL (a relative or absolute path, or a file:// URL) to an absolute path.
+// A trailing separator (ie a directory) is kept.
+// eg. file:///tmp/data/ gives /tmp/data/  and file:///c:/temp/data.txt gives c:\temp\data.txt
+func FilesystemPathFromURL(URL string) (string, error) {
+	if URL == "" {
+		return "", errors.New("URL cannot be empty")
+	}
 
-	log.Debugf("rootContainerPath %s", rootContainerPath)
-	if rootContainerPath != "" {
-		var sp = strings.Split(rootContainerPath, string(os.PathSeparator))
-		l := len(sp)
+	p := URL
+	if strings.HasPrefix(strings.ToLower(URL), "file://") {
+		u, err := url.Parse(URL)
+		if err != nil {
+			return "", err
+		}
+
+		if u.Host != "" && u.Host != "localhost" {
+			return "", fmt.Errorf("Unsupported file URL %s, expected file:///path", URL)
+		}
 
-		log.Debugf("sp is %s", sp)
-		genPath := strings.Join(sp[:l-2], string(os.PathSeparator)) + string(os.PathSeparator)
-		container := sp[l-2]
+		p = u.Path
+		if runtime.GOOS == "windows" && len(p) > 2 && p[0] == '/' && p[2] == ':' {
+			p = p[1:]
+		}
+		p = filepath.FromSlash(p)
+	}
+
+	isDir := strings.HasSuffix(p, "/") || strings.HasSuffix(p, string(os.PathSeparator))
+
+	absPath, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
 
-		return genPath, container
+	if isDir && !strings.HasSuffix(absPath, string(os.PathSeparator)) {
+		absPath += string(os.PathSeparator)
 	}
 
-	// wasn't passed, so return nada
-	return "", ""
+	return absPath, nil
 }
 
 // NewFilesystemHandler factory to create new one. Evil?
+// rootContainerPath is the source/dest URL, see FilesystemPathFromURL.
 func NewFilesystemHandler(rootContainerPath string, isSource bool) (*FilesystemHandler, error) {
 
 	fh := new(FilesystemHandler)
-	fh.basePath, fh.container = generateBasePath(rootContainerPath)
 
-	fh.rootContainerPath = rootContainerPath
+	if rootContainerPath != "" {
+		absPath, err := FilesystemPathFromURL(rootContainerPath)
+		if err != nil {
+			return nil, err
+		}
+		fh.rootContainerPath = absPath
+		fh.basePath = filepath.VolumeName(absPath) + string(os.PathSeparator)
+	} else {
+		fh.basePath = string(os.PathSeparator)
+	}
+
 	fh.IsSource = isSource
+	fh.PresignedURLExpiry = defaultPresignedURLExpiry
+	fh.SymlinkPolicy = FilesystemSymlinkFollow
 
 	return fh, nil
 }
 
-// GetRootContainer gets root container of Azure. In reality there isn't a root container, but this would basically be a SimpleContainer
-// that has the containerSlice populated with the real Azure containers.
-func (fh *FilesystemHandler) GetRootContainer() models.SimpleContainer {
+// GetRootContainer gets the directory of the URL, with the files and directories directly in it.
+// NOT recursive.
+func (fh *FilesystemHandler) GetRootContainer() (models.SimpleContainer, error) {
 
-	dir, err := os.OpenFile(fh.rootContainerPath, os.O_RDONLY, 0)
+	rootContainer, err := fh.GetSpecificSimpleContainer(fh.rootContainerPath)
 	if err != nil {
-		log.Fatal("ERR OpenFile ", err)
+		return models.SimpleContainer{}, err
 	}
 
-	fileInfos, err := dir.Readdir(0)
+	err = fh.listDirectory(rootContainer, false, map[string]bool{})
 	if err != nil {
-		log.Fatal("ERR ReadDir", err)
+		return models.SimpleContainer{}, err
 	}
 
-	rootContainer := models.NewSimpleContainer()
-	rootContainer.URL = fh.rootContainerPath
-	rootContainer.Origin = models.Filesystem
-	rootContainer.Name = fh.container
-	rootContainer.IsRootContainer = true
-
-	for _, f := range fileInfos {
-
-		// determine if file or directory.
-		// do we go recursive?
-		if f.IsDir() {
-			sc := models.NewSimpleContainer()
-			sc.Name = f.Name()
-			sc.Origin = models.Filesystem
-			sc.ParentContainer = rootContainer
-			sc.Populated = false
-			rootContainer.ContainerSlice = append(rootContainer.ContainerSlice, sc)
-		} else {
-			b := models.SimpleBlob{}
-			b.Name = f.Name()
-			b.ParentContainer = rootContainer
-			b.Origin = models.Filesystem
-			rootContainer.BlobSlice = append(rootContainer.BlobSlice, &b)
-
-		}
-	}
-	rootContainer.Populated = true
-
-	return *rootContainer
+	return *rootContainer, nil
 }
 
 // ReadBlob in theory reads the blob. Given we're already dealing with a local filesystem DO we need to read it at all?
 // No point keeping it in memory, local disk is good enough. Also any point making a copy to the cache directory?
 // for now, just mark the blob as cached and point to original file dir.
-func (fh *FilesystemHandler) ReadBlob(container models.SimpleContainer, blobName string) models.SimpleBlob {
+func (fh *FilesystemHandler) ReadBlob(container models.SimpleContainer, blobName string) (models.SimpleBlob, error) {
 	var blob models.SimpleBlob
 
-	dirPath := fh.generateFullPath(&container)
-	fullPath := filepath.Join(dirPath, blobName)
+	fullPath := fh.generateBlobFullPath(&container, blobName)
 
 	blob.DataCachedAtPath = fullPath
 	blob.BlobInMemory = false
@@ -121,12 +163,19 @@ func (fh *FilesystemHandler) ReadBlob(container models.SimpleContainer, blobName
 	blob.ParentContainer = &container
 	blob.Origin = container.Origin
 	blob.URL = fullPath
-	return blob
+	return blob, nil
 }
 
 // PopulateBlob. Used to read a blob IFF we already have a reference to it.
 func (fh *FilesystemHandler) PopulateBlob(blob *models.SimpleBlob) error {
 
+	// symlink record, the content is the target.
+	if target, ok := blob.Properties.Metadata[blobutils.SymlinkMetadataKey]; ok {
+		blob.DataInMemory = []byte(target)
+		blob.BlobInMemory = true
+		return nil
+	}
+
 	blob.DataCachedAtPath = blob.URL
 	blob.BlobInMemory = false
 
@@ -146,89 +195,353 @@ func (fh *FilesystemHandler) generateAzureContainerName(blob *models.SimpleBlob)
 // and the blob name is vdir/vdir2/myblob
 func (fh *FilesystemHandler) WriteBlob(destContainer *models.SimpleContainer, sourceBlob *models.SimpleBlob) error {
 
-	blobName := sourceBlob.Name
-	if blobName[0] == os.PathSeparator {
-		blobName = blobName[1:]
+	if !sourceBlob.BlobInMemory {
+		// cached on disk (or the source is a local file).
+		cacheFile, err := os.OpenFile(sourceBlob.DataCachedAtPath, os.O_RDONLY, 0)
+		if err != nil {
+			log.Errorf("FilesystemHandler::WriteBlob err %s", err)
+			return err
+		}
+		defer cacheFile.Close()
+
+		return fh.WriteBlobFromReader(destContainer, sourceBlob, cacheFile, -1)
+	}
+
+	// from memory.
+	return fh.WriteBlobFromReader(destContainer, sourceBlob, bytes.NewReader(sourceBlob.DataInMemory), int64(len(sourceBlob.DataInMemory)))
+}
+
+// GetBlobReader opens the file directly. No need to cache anything since it's already local.
+func (fh *FilesystemHandler) GetBlobReader(blob *models.SimpleBlob) (io.ReadCloser, int64, error) {
+
+	// symlink record, the content is the target.
+	if target, ok := blob.Properties.Metadata[blobutils.SymlinkMetadataKey]; ok {
+		return ioutil.NopCloser(strings.NewReader(target)), int64(len(target)), nil
+	}
+
+	f, err := os.Open(blob.URL)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	blob.Properties = fh.fileProperties(fi)
+	return f, fi.Size(), nil
+}
+
+// filesystemProperties gets the size and modified time of the file.
+// Content type is guessed from the extension so it isn't lost when copying to a cloud.
+func filesystemProperties(fi os.FileInfo) models.BlobProperties {
+	p := models.BlobProperties{}
+	p.Size = fi.Size()
+	p.LastModified = fi.ModTime()
+	p.ContentType = mime.TypeByExtension(filepath.Ext(fi.Name()))
+	return p
+}
+
+// fileProperties gets the properties of the file, with the attributes being preserved in the metadata.
+func (fh *FilesystemHandler) fileProperties(fi os.FileInfo) models.BlobProperties {
+	p := filesystemProperties(fi)
+	if !fh.PreserveModifiedTime && !fh.PreservePermissions {
+		return p
+	}
+
+	p.Metadata = make(map[string]string)
+	if fh.PreserveModifiedTime {
+		p.Metadata[blobutils.FileModifiedMetadataKey] = fi.ModTime().UTC().Format(time.RFC3339Nano)
+	}
+
+	if fh.PreservePermissions {
+		p.Metadata[blobutils.FileModeMetadataKey] = strconv.FormatUint(uint64(fi.Mode().Perm()), 8)
+		if uid, gid, ok := fileOwner(fi); ok {
+			p.Metadata[blobutils.FileUIDMetadataKey] = strconv.Itoa(uid)
+			p.Metadata[blobutils.FileGIDMetadataKey] = strconv.Itoa(gid)
+		}
+	}
+
+	return p
+}
+
+// symlinkBlob makes the record for a symlink being preserved. The content of the blob is the link target.
+func (fh *FilesystemHandler) symlinkBlob(linkPath string, fi os.FileInfo) (*models.SimpleBlob, error) {
+	target, err := os.Readlink(linkPath)
+	if err != nil {
+		log.Errorf("FilesystemHandler unable to read symlink %s %s", linkPath, err)
+		return nil, err
+	}
+
+	b := models.SimpleBlob{}
+	b.Name = fi.Name()
+	b.Origin = models.Filesystem
+	b.URL = linkPath
+	b.BlobCloudName = filepath.ToSlash(linkPath)
+	b.Properties = fh.fileProperties(fi)
+	b.Properties.Size = int64(len(target))
+	b.Properties.ContentType = ""
+
+	// permissions of a link mean nothing.
+	if b.Properties.Metadata == nil {
+		b.Properties.Metadata = make(map[string]string)
+	}
+	delete(b.Properties.Metadata, blobutils.FileModeMetadataKey)
+	b.Properties.Metadata[blobutils.SymlinkMetadataKey] = target
+
+	return &b, nil
+}
+
+// followSymlink gets the file/directory the link points to. Broken links, and links to a directory
+// that's already being listed (which would be listed forever), are skipped.
+func followSymlink(linkPath string, listing map[string]bool) (os.FileInfo, bool) {
+	target, err := os.Stat(linkPath)
+	if err != nil {
+		log.Warnf("skipping broken symlink %s %s", linkPath, err)
+		return nil, false
+	}
+
+	if !target.IsDir() {
+		return target, true
+	}
+
+	realTarget, err := filepath.EvalSymlinks(linkPath)
+	if err != nil {
+		log.Warnf("skipping symlink %s %s", linkPath, err)
+		return nil, false
 	}
 
-	fullPath := fh.generateFullPath(destContainer) + blobName
+	if listing[realTarget] {
+		log.Warnf("skipping symlink %s, it loops back to %s", linkPath, realTarget)
+		return nil, false
+	}
+
+	return target, true
+}
+
+// symlinkFileInfo is the target of a symlink, under the name of the link.
+type symlinkFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi symlinkFileInfo) Name() string {
+	return fi.name
+}
+
+// WriteBlobFromReader writes the stream to the destination file.
+// Symlink records are restored as links if symlinks are being preserved.
+func (fh *FilesystemHandler) WriteBlobFromReader(destContainer *models.SimpleContainer, sourceBlob *models.SimpleBlob, reader io.Reader, size int64) error {
+
+	fullPath := fh.generateBlobFullPath(destContainer, sourceBlob.Name)
+	target, isSymlink := sourceBlob.Properties.Metadata[blobutils.SymlinkMetadataKey]
+
+	// links restored earlier in the copy could point anywhere, so nothing is written through them.
+	// A symlink record replaces whatever is at its own path, so only the directories above it are checked.
+	if fh.SymlinkPolicy == FilesystemSymlinkPreserve {
+		checkPath := fullPath
+		if isSymlink {
+			checkPath = filepath.Dir(fullPath)
+		}
+
+		err := checkNoSymlinks(fh.generateFullPath(destContainer), checkPath)
+		if err != nil {
+			log.Errorf("FilesystemHandler refusing to write %s %s", fullPath, err)
+			return err
+		}
+	}
 
 	// make sure subdirs are created.
 	err := fh.createSubDirectories(fullPath)
 	if err != nil {
-		log.Fatal(err)
 		return err
 	}
 
-	if !sourceBlob.BlobInMemory {
-		err := fh.copyFile(sourceBlob.DataCachedAtPath, fullPath)
+	if isSymlink && fh.SymlinkPolicy == FilesystemSymlinkPreserve {
+		return fh.writeSymlink(fullPath, target, sourceBlob.Properties)
+	}
 
-		if err != nil {
-			log.Fatal("FilesystemHandler::WriteBlob err ", err)
+	newFile, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		log.Errorf("FilesystemHandler unable to open destination file %s %s", fullPath, err)
+		return err
+	}
+
+	_, err = io.Copy(newFile, reader)
+	closeErr := newFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Errorf("FilesystemHandler unable to write destination file %s %s", fullPath, err)
+		return err
+	}
+
+	return fh.restoreAttributes(fullPath, sourceBlob.Properties)
+}
+
+// checkNoSymlinks returns an error if fullPath, or any directory between rootPath and it, is a symlink.
+// Also rejects paths outside rootPath. Checking stops at the first part that doesn't exist yet.
+func checkNoSymlinks(rootPath string, fullPath string) error {
+	rel, err := filepath.Rel(rootPath, fullPath)
+	if err != nil {
+		return err
+	}
+
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return fmt.Errorf("%s is outside %s", fullPath, rootPath)
+	}
+
+	if rel == "." {
+		return nil
+	}
+
+	currentPath := filepath.Clean(rootPath)
+	for _, segment := range strings.Split(rel, string(os.PathSeparator)) {
+		currentPath = filepath.Join(currentPath, segment)
+
+		fi, err := os.Lstat(currentPath)
+		if os.IsNotExist(err) {
+			return nil
 		}
-	} else {
-		// from memory.
-		newFile, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE, 0)
 		if err != nil {
-			log.Fatal("FilesystemHandler::WriteBlob unable to open destination file", err)
+			return err
 		}
 
-		var totalBytesWritten int = 0
-		fileSize := len(sourceBlob.DataInMemory)
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink", currentPath)
+		}
+	}
+
+	return nil
+}
+
+// writeSymlink restores a symlink record as a link. Anything already at fullPath is replaced.
+func (fh *FilesystemHandler) writeSymlink(fullPath string, target string, properties models.BlobProperties) error {
+	err := os.Remove(fullPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("FilesystemHandler unable to replace %s %s", fullPath, err)
+		return err
+	}
+
+	err = os.Symlink(target, fullPath)
+	if err != nil {
+		log.Errorf("FilesystemHandler unable to create symlink %s %s", fullPath, err)
+		return err
+	}
+
+	if fh.PreservePermissions {
+		restoreFileOwner(fullPath, properties)
+	}
+
+	return nil
+}
 
-		for totalBytesWritten < fileSize {
-			bytesWritten, err := newFile.Write(sourceBlob.DataInMemory[totalBytesWritten:])
+// restoreAttributes sets the permissions, owner and modified time of the written file, for whichever are being preserved.
+func (fh *FilesystemHandler) restoreAttributes(fullPath string, properties models.BlobProperties) error {
 
+	if fh.PreservePermissions {
+		if mode, ok := properties.Metadata[blobutils.FileModeMetadataKey]; ok {
+			perm, err := strconv.ParseUint(mode, 8, 32)
 			if err != nil {
-				log.Fatal("FilesystemHandler::WriteBlob unable to open destination file", err)
+				log.Warnf("ignoring invalid mode %s for %s", mode, fullPath)
+			} else if err := os.Chmod(fullPath, os.FileMode(perm).Perm()); err != nil {
+				log.Errorf("FilesystemHandler unable to set mode of %s %s", fullPath, err)
+				return err
+			}
+		}
+
+		restoreFileOwner(fullPath, properties)
+	}
+
+	if fh.PreserveModifiedTime {
+		modified := properties.LastModified
+		if value, ok := properties.Metadata[blobutils.FileModifiedMetadataKey]; ok {
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				log.Warnf("ignoring invalid modified time %s for %s", value, fullPath)
+			} else {
+				modified = t
+			}
+		}
+
+		if !modified.IsZero() {
+			err := os.Chtimes(fullPath, modified, modified)
+			if err != nil {
+				log.Errorf("FilesystemHandler unable to set modified time of %s %s", fullPath, err)
+				return err
 			}
-			totalBytesWritten += bytesWritten
 		}
 	}
 
 	return nil
 }
 
-func (fh *FilesystemHandler) createSubDirectories(fullPath string) error {
-	var dirPath = path.Dir(fullPath)
-	os.MkdirAll(dirPath, 0777)
+// restoreFileOwner sets the uid/gid of the file from the metadata.
+// Only root (or equivalent) can give files away, so failing to is only a warning.
+func restoreFileOwner(fullPath string, properties models.BlobProperties) {
+	uid, hasUID := metadataInt(properties.Metadata, blobutils.FileUIDMetadataKey)
+	gid, hasGID := metadataInt(properties.Metadata, blobutils.FileGIDMetadataKey)
+	if !hasUID && !hasGID {
+		return
+	}
 
-	return nil
+	// -1 leaves it unchanged.
+	if !hasUID {
+		uid = -1
+	}
+	if !hasGID {
+		gid = -1
+	}
+
+	err := setFileOwner(fullPath, uid, gid)
+	if err != nil {
+		log.Warnf("Unable to set owner of %s %s", fullPath, err)
+	}
 }
 
-func (fh *FilesystemHandler) copyFile(sourceFile string, destFile string) error {
-	cacheFile, err := os.OpenFile(sourceFile, os.O_RDONLY, 0)
+// metadataInt gets an integer from the metadata. ok is false if it's missing or invalid.
+func metadataInt(metadata map[string]string, key string) (int, bool) {
+	value, ok := metadata[key]
+	if !ok {
+		return 0, false
+	}
+
+	i, err := strconv.Atoi(value)
 	if err != nil {
-		log.Fatal("FilesystemHandler::WriteBlob err ", err)
+		log.Warnf("ignoring invalid %s %s", key, value)
+		return 0, false
 	}
+	return i, true
+}
 
-	// location of destination blob.
-	fullPath := destFile
-	newFile, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE, 0)
+// DeleteBlob deletes the file. Any directories left empty are kept.
+func (fh *FilesystemHandler) DeleteBlob(container *models.SimpleContainer, blobName string) error {
+	fullPath := fh.generateBlobFullPath(container, blobName)
+	err := os.Remove(fullPath)
 	if err != nil {
-		log.Fatal("FilesystemHandler::WriteBlob unable to open destination file", err)
+		log.Errorf("FilesystemHandler::DeleteBlob unable to delete %s %s", fullPath, err)
+		return err
 	}
 
-	buffer := make([]byte, 1024*100)
-	numBytesRead := 0
+	return nil
+}
 
-	finishedProcessing := false
-	for finishedProcessing == false {
-		numBytesRead, err = cacheFile.Read(buffer)
-		if err != nil {
-			finishedProcessing = true
-		}
+// RequiresSeekableBody files are written sequentially so a plain stream is fine.
+func (fh *FilesystemHandler) RequiresSeekableBody() bool {
+	return false
+}
 
-		if numBytesRead <= 0 {
-			finishedProcessing = true
-			continue
-		}
+// createSubDirectories creates the directory the file is in, and every directory above it.
+func (fh *FilesystemHandler) createSubDirectories(fullPath string) error {
+	dirPath := filepath.Dir(fullPath)
 
-		_, err = newFile.Write(buffer[:numBytesRead])
-		if err != nil {
-			log.Fatal(err)
-			return err
-		}
+	err := os.MkdirAll(dirPath, 0777)
+	if err != nil {
+		log.Errorf("FilesystemHandler unable to create directory %s %s", dirPath, err)
+		return err
 	}
 
 	return nil
@@ -252,39 +565,91 @@ func (fh *FilesystemHandler) GetContainer(containerName string) models.SimpleCon
 	return container
 }
 
+// generateFullPath generates the absolute path (ending in a separator) of the directory.
 func (fh *FilesystemHandler) generateFullPath(container *models.SimpleContainer) string {
 
-	path := container.Name
+	dirPath := container.Name
 	currentContainer := container.ParentContainer
 	for currentContainer != nil {
 		if currentContainer.Name != "" {
-			path = filepath.Join(currentContainer.Name, path)
+			dirPath = filepath.Join(currentContainer.Name, dirPath)
 		}
 
 		currentContainer = currentContainer.ParentContainer
 	}
 
-	fullPath := fh.basePath + path + string(os.PathSeparator)
-	// if full path is rootContainerPath then we need to actually generate
-	return fullPath
+	if dirPath == "" {
+		return fh.basePath
+	}
+	return filepath.Join(fh.basePath, dirPath) + string(os.PathSeparator)
+}
+
+// generateBlobFullPath generates the absolute path of the file. blobName is relative to the container and
+// may include virtual directories (eg. vdir1/vdir2/myblob) which become real directories.
+func (fh *FilesystemHandler) generateBlobFullPath(container *models.SimpleContainer, blobName string) string {
+	blobName = strings.TrimLeft(filepath.FromSlash(blobName), string(os.PathSeparator))
+	return fh.generateFullPath(container) + blobName
 }
 
-// GetContainerContents populates the container (directory) with the next level contents
-// currently wont do recursive.
+// GetContainerContents populates the container (directory) with its files and directories, recursively.
 func (fh *FilesystemHandler) GetContainerContents(container *models.SimpleContainer) error {
+	return fh.listDirectory(container, true, map[string]bool{})
+}
+
+// listDirectory adds the files and directories in the container's directory to the container.
+// listing holds the real paths of the directories being listed further up the recursion, so symlinks back to
+// any of them (directly, or via other links) aren't followed.
+func (fh *FilesystemHandler) listDirectory(container *models.SimpleContainer, recursive bool, listing map[string]bool) error {
 
 	fullPath := fh.generateFullPath(container)
+
+	realPath, err := filepath.EvalSymlinks(fullPath)
+	if err != nil {
+		log.Errorf("ERR EvalSymlinks %s", err)
+		return err
+	}
+	listing[realPath] = true
+	defer delete(listing, realPath)
+
 	dir, err := os.OpenFile(fullPath, os.O_RDONLY, 0)
 	if err != nil {
-		log.Fatal("ERR OpenFile ", err)
+		log.Errorf("ERR OpenFile %s", err)
+		return err
 	}
+	defer dir.Close()
 
 	fileInfos, err := dir.Readdir(0)
 	if err != nil {
-		log.Fatal("ERR ReadDir", err)
+		log.Errorf("ERR ReadDir %s", err)
+		return err
 	}
 
 	for _, f := range fileInfos {
+		entryPath := filepath.Join(fullPath, f.Name())
+
+		if f.Mode()&os.ModeSymlink != 0 {
+			switch fh.SymlinkPolicy {
+			case FilesystemSymlinkSkip:
+				log.Debugf("skipping symlink %s", entryPath)
+				continue
+
+			case FilesystemSymlinkPreserve:
+				b, err := fh.symlinkBlob(entryPath, f)
+				if err != nil {
+					return err
+				}
+				b.ParentContainer = container
+				container.BlobSlice = append(container.BlobSlice, b)
+				continue
+
+			default:
+				target, ok := followSymlink(entryPath, listing)
+				if !ok {
+					continue
+				}
+				f = symlinkFileInfo{FileInfo: target, name: f.Name()}
+			}
+		}
 
 		// determine if file or directory.
 		// do we go recursive?
@@ -295,7 +660,13 @@ func (fh *FilesystemHandler) GetContainerContents(container *models.SimpleContai
 			sc.ParentContainer = container
 			sc.Populated = false
 			sc.IsRootContainer = false
-			fh.GetContainerContents(sc)
+
+			if recursive {
+				err = fh.listDirectory(sc, recursive, listing)
+				if err != nil {
+					return err
+				}
+			}
 			container.ContainerSlice = append(container.ContainerSlice, sc)
 
 		} else {
@@ -303,7 +674,9 @@ func (fh *FilesystemHandler) GetContainerContents(container *models.SimpleContai
 			b.Name = f.Name()
 			b.ParentContainer = container
 			b.Origin = models.Filesystem
-			b.URL = filepath.Join(fh.generateFullPath(container), b.Name)
+			b.URL = entryPath
+			b.BlobCloudName = filepath.ToSlash(b.URL)
+			b.Properties = fh.fileProperties(f)
 			container.BlobSlice = append(container.BlobSlice, &b)
 
 		}
@@ -316,15 +689,25 @@ func (fh *FilesystemHandler) GetContainerContents(container *models.SimpleContai
 // BlobExists checks if blob already exists
 func (fh *FilesystemHandler) BlobExists(container models.SimpleContainer, blobName string) (bool, error) {
 
-	if blobName[0] == os.PathSeparator {
-		blobName = blobName[1:]
-	}
+	fullPath := fh.generateBlobFullPath(&container, blobName)
 
-	fullPath := fh.generateFullPath(&container) + blobName
+	// a link being preserved exists even if what it points to doesn't.
+	stat := os.Stat
+	if fh.SymlinkPolicy == FilesystemSymlinkPreserve {
+		stat = os.Lstat
+	}
 
-	log.Printf("FH %s", fullPath)
+	fi, err := stat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		log.Errorf("FilesystemHandler::BlobExists unable to stat %s %s", fullPath, err)
+		return false, err
+	}
 
-	return false, nil
+	// a directory of the same name isn't the blob.
+	return !fi.IsDir(), nil
 }
 
 // getSubContainer gets an existing subcontainer with parent of container and name of segment.
@@ -343,61 +726,154 @@ func (fh *FilesystemHandler) GetContainerContentsOverChannel(sourceContainer mod
 
 	defer close(blobChannel)
 	// just do it in bulk for FS. Figure out later if its an issue.
-	fh.GetContainerContents(&sourceContainer)
+	err := fh.GetContainerContents(&sourceContainer)
+	if err != nil {
+		return err
+	}
 	blobChannel <- sourceContainer
 
 	return nil
 }
 
-func isContainer(url string) bool {
+func isContainer(url string) (bool, error) {
 	fi, err := os.Stat(url)
 	if err != nil {
-		log.Fatalf("Unable to handle path %s\n", url)
-	}
-	return fi.Mode().IsDir()
+		log.Debugf("Unable to handle path %s %s", url, err)
+		return false, err
 	}
+	return fi.Mode().IsDir(), nil
+}
 
 // GetSpecificSimpleContainer given a URL (ending in /) then get the SIMPLE container that represents it.
-// eg. c:\temp\mydir1\mydir2\
+// eg. c:\temp\mydir1\mydir2\  ./mydir1/  or file:///tmp/mydir1/
+// The directory must exist for a source. For a destination it's created when the first file is written.
 func (fh *FilesystemHandler) GetSpecificSimpleContainer(URL string) (*models.SimpleContainer, error) {
 
-	if URL != "" {
-
-		// check if its a container.
-		if isContainer(URL) {
-
-			var sp= strings.Split(URL, "/")
-			parentContainer := models.NewSimpleContainer()
-			parentContainer.IsRootContainer = true
-			parentContainer.Origin = models.Filesystem
-			currentContainer := parentContainer
-			for _, segment := range sp[1:] {
-				container := models.NewSimpleContainer()
-				container.URL = URL
-				container.Origin = models.Filesystem
-				container.Name = segment
-				container.IsRootContainer = false
-				container.ParentContainer = currentContainer
-				currentContainer.ContainerSlice = append(currentContainer.ContainerSlice, container)
-
-				currentContainer = container
-				log.Debugf("segment is %s\n", segment)
-			}
+	dirPath, err := FilesystemPathFromURL(URL)
+	if err != nil {
+		return nil, err
+	}
 
-			return currentContainer, nil
+	// check if its a container.
+	isDir, err := isContainer(dirPath)
+	if err != nil {
+		if fh.IsSource || !os.IsNotExist(err) {
+			return nil, err
 		}
+	} else if !isDir {
+		return nil, fmt.Errorf("%s is not a directory", dirPath)
 	}
 
-	return nil, errors.New("URL cannot be empty")
+	// path below the volume (eg. c:) using / as the separator.
+	relativePath := filepath.ToSlash(strings.TrimPrefix(dirPath, filepath.VolumeName(dirPath)))
+
+	parentContainer := models.NewSimpleContainer()
+	parentContainer.IsRootContainer = true
+	parentContainer.Origin = models.Filesystem
+	currentContainer := parentContainer
+	for _, segment := range strings.Split(strings.Trim(relativePath, "/"), "/") {
+		if segment == "" {
+			continue
+		}
 
+		container := models.NewSimpleContainer()
+		container.URL = URL
+		container.Origin = models.Filesystem
+		container.Name = segment
+		container.IsRootContainer = false
+		container.ParentContainer = currentContainer
+		currentContainer.ContainerSlice = append(currentContainer.ContainerSlice, container)
+
+		currentContainer = container
+		log.Debugf("segment is %s\n", segment)
+	}
+
+	return currentContainer, nil
+}
+
+// Close stops the file server, if presigned URLs were generated.
+func (fh *FilesystemHandler) Close() error {
+
+	// stops the file server being started after it's closed.
+	fh.fileServerOnce.Do(func() {})
+
+	if fh.fileServer == nil {
+		return nil
+	}
+	return fh.fileServer.Close()
 }
 
+// GeneratePresignedURL generates a URL the blob can be read from.
+// There is no such thing for a filesystem, so the file is served over HTTP (at ServeURL) for the
+// lifetime of the URL.
 func (fh *FilesystemHandler) GeneratePresignedURL(blob *models.SimpleBlob) (string, error) {
-	return "", nil
+	if fh.ServeURL == "" {
+		return "", errors.New("Filesystem presigned URLs require a URL to serve files from (FilesystemServeURL)")
+	}
+
+	fh.fileServerOnce.Do(func() {
+		fh.fileServer = helpers.NewFileServer(fh.ServeURL, fh.ServeListenAddress)
+	})
+
+	if fh.fileServer == nil {
+		return "", errors.New("Filesystem handler is closed")
+	}
+
+	url, err := fh.fileServer.AddFile(blob.URL, fh.PresignedURLExpiry)
+	if err != nil {
+		log.Errorf("Unable to serve %s : %s", blob.URL, err)
+		return "", err
+	}
+
+	return url, nil
 }
 
 // GetSpecificSimpleBlob given a URL (NOT ending in /) then get the SIMPLE blob that represents it.
+// eg. c:\temp\mydir1\myfile.txt  ./myfile.txt  or file:///tmp/myfile.txt
 func (fh *FilesystemHandler) GetSpecificSimpleBlob(URL string) (*models.SimpleBlob, error) {
-	return nil, nil
 
+	fullPath, err := FilesystemPathFromURL(URL)
+	if err != nil {
+		return nil, err
+	}
+
+	stat := os.Stat
+	if fh.SymlinkPolicy == FilesystemSymlinkPreserve {
+		stat = os.Lstat
+	}
+
+	fi, err := stat(fullPath)
+	if err != nil {
+		log.Errorf("Unable to handle path %s %s", fullPath, err)
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		return nil, fmt.Errorf("%s is a directory, end the URL with a %c to copy its contents", fullPath, os.PathSeparator)
+	}
+
+	container, err := fh.GetSpecificSimpleContainer(filepath.Dir(fullPath) + string(os.PathSeparator))
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		b, err := fh.symlinkBlob(fullPath, fi)
+		if err != nil {
+			return nil, err
+		}
+		b.ParentContainer = container
+		return b, nil
+	}
+
+	b := models.SimpleBlob{}
+	b.Name = fi.Name()
+	b.Origin = models.Filesystem
+	b.ParentContainer = container
+	b.URL = fullPath
+	b.BlobCloudName = filepath.ToSlash(fullPath)
+	b.DataCachedAtPath = fullPath
+	b.BlobInMemory = false
+	b.Properties = fh.fileProperties(fi)
+	return &b, nil
 }
@@ -0,0 +1,274 @@
+package handlers
+
+import (
+	"azurecopy/azurecopy/models"
+	"azurecopy/azurecopy/utils/blobutils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFilesystemTestDir creates a temp directory, with symlinks resolved so paths compare equal.
+func newFilesystemTestDir(t *testing.T) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symlinks needs extra privileges on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "azurecopyfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeFilesystemTestFile(t *testing.T, fullPath string, contents string) {
+	err := os.MkdirAll(filepath.Dir(fullPath), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(fullPath, []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// listFilesystemBlobs lists the directory recursively, returning the (sorted) paths of the blobs below it.
+func listFilesystemBlobs(t *testing.T, fh *FilesystemHandler, dir string) []string {
+	container, err := fh.GetSpecificSimpleContainer(dir + string(os.PathSeparator))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fh.GetContainerContents(container)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	var walk func(c *models.SimpleContainer, prefix string)
+	walk = func(c *models.SimpleContainer, prefix string) {
+		for _, b := range c.BlobSlice {
+			paths = append(paths, prefix+b.Name)
+		}
+		for _, sc := range c.ContainerSlice {
+			walk(sc, prefix+sc.Name+"/")
+		}
+	}
+	walk(container, "")
+
+	sort.Strings(paths)
+	return paths
+}
+
+func TestFilesystemSymlinkLoops(t *testing.T) {
+	dir := newFilesystemTestDir(t)
+	defer os.RemoveAll(dir)
+
+	writeFilesystemTestFile(t, filepath.Join(dir, "a", "a.txt"), "a")
+	writeFilesystemTestFile(t, filepath.Join(dir, "b", "b.txt"), "b")
+
+	// a/toB -> b and b/toA -> a. Neither points at a directory the link is in.
+	links := map[string]string{
+		filepath.Join(dir, "a", "toB"):    filepath.Join(dir, "b"),
+		filepath.Join(dir, "b", "toA"):    filepath.Join(dir, "a"),
+		filepath.Join(dir, "a", "toSelf"): ".",
+	}
+	for link, target := range links {
+		err := os.Symlink(target, link)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fh, err := NewFilesystemHandler(dir+string(os.PathSeparator), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		dir      string
+		expected []string
+	}{
+		{"a", []string{"a.txt", "toB/b.txt"}},
+		{"b", []string{"b.txt", "toA/a.txt"}},
+		{"", []string{"a/a.txt", "a/toB/b.txt", "b/b.txt", "b/toA/a.txt"}},
+	}
+
+	for _, tc := range testCases {
+		paths := listFilesystemBlobs(t, fh, filepath.Join(dir, tc.dir))
+		if strings.Join(paths, ",") != strings.Join(tc.expected, ",") {
+			t.Errorf("%s: expected %v, got %v", tc.dir, tc.expected, paths)
+		}
+	}
+}
+
+func TestFilesystemPreserveDoesNotWriteThroughSymlinks(t *testing.T) {
+	dir := newFilesystemTestDir(t)
+	defer os.RemoveAll(dir)
+
+	outside := filepath.Join(dir, "outside")
+	writeFilesystemTestFile(t, filepath.Join(outside, "existing.txt"), "untouched")
+
+	dest := filepath.Join(dir, "dest") + string(os.PathSeparator)
+	fh, err := NewFilesystemHandler(dest, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.SymlinkPolicy = FilesystemSymlinkPreserve
+
+	destContainer, err := fh.GetSpecificSimpleContainer(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	symlinkRecord := func(name string, target string) *models.SimpleBlob {
+		b := &models.SimpleBlob{Name: name}
+		b.Properties.Metadata = map[string]string{blobutils.SymlinkMetadataKey: target}
+		return b
+	}
+
+	testCases := []struct {
+		name string
+		blob *models.SimpleBlob
+		ok   bool
+	}{
+		{"link to a directory", symlinkRecord("lnk", outside), true},
+		{"link to a file", symlinkRecord("sub/filelnk", filepath.Join(outside, "existing.txt")), true},
+		{"file through the directory link", &models.SimpleBlob{Name: "lnk/passwd"}, false},
+		{"link through the directory link", symlinkRecord("lnk/other", "/"), false},
+		{"file over the file link", &models.SimpleBlob{Name: "sub/filelnk"}, false},
+		{"file outside the destination", &models.SimpleBlob{Name: "../escaped.txt"}, false},
+		{"replace a link with a link", symlinkRecord("sub/filelnk", "elsewhere"), true},
+		{"nested file", &models.SimpleBlob{Name: "sub/deeper/file.txt"}, true},
+	}
+
+	for _, tc := range testCases {
+		err := fh.WriteBlobFromReader(destContainer, tc.blob, strings.NewReader("written"), 7)
+		if tc.ok != (err == nil) {
+			t.Errorf("%s: expected ok %t, got error %v", tc.name, tc.ok, err)
+		}
+	}
+
+	fileInfos, err := ioutil.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fileInfos) != 1 {
+		t.Errorf("expected only existing.txt outside the destination, got %d files", len(fileInfos))
+	}
+
+	existing, err := ioutil.ReadFile(filepath.Join(outside, "existing.txt"))
+	if err != nil || string(existing) != "untouched" {
+		t.Errorf("file outside the destination was changed: %q %v", existing, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "escaped.txt")); !os.IsNotExist(err) {
+		t.Errorf("file written outside the destination: %v", err)
+	}
+}
+
+func TestFilesystemPreserveAttributes(t *testing.T) {
+	dir := newFilesystemTestDir(t)
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source")
+	modified := time.Date(2015, 3, 4, 5, 6, 7, 0, time.UTC)
+	modes := map[string]os.FileMode{"a.txt": 0600, "b.sh": 0750}
+
+	// only root can give files away, so otherwise the owner stays the same.
+	uid, gid := os.Getuid(), os.Getgid()
+	if uid == 0 {
+		uid, gid = 1234, 5678
+	}
+
+	for name, mode := range modes {
+		fullPath := filepath.Join(source, name)
+		writeFilesystemTestFile(t, fullPath, name)
+		for _, err := range []error{os.Chmod(fullPath, mode), os.Chtimes(fullPath, modified, modified), os.Chown(fullPath, uid, gid)} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	sourceHandler, err := NewFilesystemHandler(source+string(os.PathSeparator), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceHandler.PreserveModifiedTime = true
+	sourceHandler.PreservePermissions = true
+
+	sourceContainer, err := sourceHandler.GetSpecificSimpleContainer(source + string(os.PathSeparator))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sourceHandler.GetContainerContents(sourceContainer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(dir, "dest") + string(os.PathSeparator)
+	destHandler, err := NewFilesystemHandler(dest, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	destHandler.PreserveModifiedTime = true
+	destHandler.PreservePermissions = true
+
+	destContainer, err := destHandler.GetSpecificSimpleContainer(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sourceContainer.BlobSlice) != len(modes) {
+		t.Fatalf("expected %d files to be listed, got %d", len(modes), len(sourceContainer.BlobSlice))
+	}
+
+	// written both ways a copy can go, from the file (as if cached) and streamed.
+	for _, blob := range sourceContainer.BlobSlice {
+		if blob.Name == "a.txt" {
+			err = sourceHandler.PopulateBlob(blob)
+			if err == nil {
+				err = destHandler.WriteBlob(destContainer, blob)
+			}
+		} else {
+			reader, size, readErr := sourceHandler.GetBlobReader(blob)
+			if readErr != nil {
+				t.Fatal(readErr)
+			}
+			err = destHandler.WriteBlobFromReader(destContainer, blob, reader, size)
+			reader.Close()
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", blob.Name, err)
+		}
+	}
+
+	for name, mode := range modes {
+		fi, err := os.Stat(filepath.Join(dest, name))
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+
+		if fi.Mode().Perm() != mode {
+			t.Errorf("%s: expected mode %o, got %o", name, mode, fi.Mode().Perm())
+		}
+		if !fi.ModTime().Equal(modified) {
+			t.Errorf("%s: expected modified time %s, got %s", name, modified, fi.ModTime())
+		}
+
+		if fileUID, fileGID, _ := fileOwner(fi); fileUID != uid || fileGID != gid {
+			t.Errorf("%s: expected owner %d:%d, got %d:%d", name, uid, gid, fileUID, fileGID)
+		}
+	}
+}
@@ -2,27 +2,59 @@ package handlers
 
 import (
 	"azurecopy/azurecopy/models"
+	"azurecopy/azurecopy/utils/blobutils"
 	"azurecopy/azurecopy/utils/containerutils"
+	"azurecopy/azurecopy/utils/helpers"
 	"azurecopy/azurecopy/utils/misc"
 	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
-	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
+const (
+	// defaults for multipart uploads, unless configured otherwise.
+	defaultS3MultipartThreshold   = 1024 * 1024 * 100
+	defaultS3MultipartPartSize    = 1024 * 1024 * 16
+	defaultS3MultipartConcurrency = 5
+	defaultS3MultipartRetries     = 3
+
+	// region used for S3 compatible endpoints if none is given. Most of them ignore it but the SDK requires one.
+	defaultS3CompatibleRegion = "us-east-1"
+
+	// S3 limits. Every part except the last must be at least 5MB and there can be at most 10000 parts.
+	s3MinPartSize  = 1024 * 1024 * 5
+	s3MaxPartCount = 10000
+)
+
 type S3Handler struct {
 	s3Client *s3.S3
 
+	// S3 compatible endpoint (eg. http://localhost:9000 for MinIO). Empty for AWS.
+	endpoint string
+
+	// bucket is part of the path (https://host/bucket/key) rather than the host (https://bucket.host/key).
+	pathStyle bool
+
+	// region new buckets are created in.
+	region string
+
 	// determine if we're caching the blob to disk during copy operations.
 	// or if we're keeping it in memory
 	cacheToDisk   bool
@@ -30,29 +62,78 @@ type S3Handler struct {
 
 	// is this handler for the source or dest?
 	IsSource bool
+
+	// how long presigned URLs are valid for.
+	PresignedURLExpiry time.Duration
+
+	// objects larger than this (bytes) are uploaded in parts.
+	MultipartThreshold int64
+
+	// size (bytes) of each part. Increased if the object would need more than 10000 parts.
+	MultipartPartSize int64
+
+	// how many parts of a single object are uploaded at once.
+	MultipartConcurrency uint
+
+	// how many times a failed part is retried before the upload is aborted.
+	MultipartRetries uint
+
+	// objects larger than DownloadChunkSize are downloaded as byte ranges, DownloadParallelism at a time.
+	DownloadChunkSize   int64
+	DownloadParallelism uint
 }
 
 // NewS3Handler factory to create new one. Evil?
-func NewS3Handler(accessID string, accessSecret string, region string, isSource bool, cacheToDisk bool) (*S3Handler, error) {
+// endpoint is only required for S3 compatible services (MinIO, Ceph, Wasabi etc), leave empty for AWS.
+// insecureSkipVerify skips TLS certificate verification, for endpoints using self signed certificates.
+func NewS3Handler(accessID string, accessSecret string, region string, endpoint string, pathStyle bool, insecureSkipVerify bool, isSource bool, cacheToDisk bool) (*S3Handler, error) {
 
 	sh := new(S3Handler)
+	sh.endpoint = strings.TrimSuffix(endpoint, "/")
+	sh.pathStyle = pathStyle
 
 	sh.cacheToDisk = cacheToDisk
 	dir, err := ioutil.TempDir("", "azurecopy")
 	if err != nil {
-		log.Fatalf("Unable to create temp directory %s", err)
+		log.Errorf("Unable to create temp directory %s", err)
+		return nil, err
 	}
 
 	sh.cacheLocation = dir
 	sh.IsSource = isSource
+	sh.PresignedURLExpiry = defaultPresignedURLExpiry
+	sh.MultipartThreshold = defaultS3MultipartThreshold
+	sh.MultipartPartSize = defaultS3MultipartPartSize
+	sh.MultipartConcurrency = defaultS3MultipartConcurrency
+	sh.MultipartRetries = defaultS3MultipartRetries
+	sh.DownloadChunkSize = defaultDownloadChunkSize
+	sh.DownloadParallelism = defaultDownloadParallelism
 
 	creds := credentials.NewStaticCredentials(accessID, accessSecret, "")
 	_, err = creds.Get()
 	if err != nil {
-		log.Fatalf("Bad S3 credentials: %s", err)
+		log.Errorf("Bad S3 credentials: %s", err)
+		return nil, err
+	}
+
+	if sh.endpoint != "" && region == "" {
+		region = defaultS3CompatibleRegion
 	}
 
-	cfg := aws.NewConfig().WithRegion(region).WithCredentials(creds)
+	sh.region = region
+	cfg := aws.NewConfig().WithRegion(region).WithCredentials(creds).WithS3ForcePathStyle(pathStyle)
+	if sh.endpoint != "" {
+		cfg = cfg.WithEndpoint(sh.endpoint)
+	}
+
+	if insecureSkipVerify {
+		cfg = cfg.WithHTTPClient(&http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		})
+	}
 
 	log.Print(cfg)
 	sh.s3Client = s3.New(session.New(), cfg)
@@ -61,10 +142,11 @@ func NewS3Handler(accessID string, accessSecret string, region string, isSource
 }
 
 // GetRootContainer gets root container of S3. Gets the list of buckets and THOSE are the immediate child containers here.
-func (sh *S3Handler) GetRootContainer() models.SimpleContainer {
+func (sh *S3Handler) GetRootContainer() (models.SimpleContainer, error) {
 	result, err := sh.s3Client.ListBuckets(&s3.ListBucketsInput{})
 	if err != nil {
-		log.Fatalf("Unable to get S3 buckets", err)
+		log.Errorf("Unable to get S3 buckets %s", err)
+		return models.SimpleContainer{}, err
 	}
 
 	rootContainer := models.NewSimpleContainer()
@@ -76,24 +158,95 @@ func (sh *S3Handler) GetRootContainer() models.SimpleContainer {
 		rootContainer.ContainerSlice = append(rootContainer.ContainerSlice, sc)
 	}
 
-	return *rootContainer
+	return *rootContainer, nil
 }
 
 // BlobExists checks if blob exists
 func (sh *S3Handler) BlobExists(container models.SimpleContainer, blobName string) (bool, error) {
-	// TODO(kpfaulkner) implement me!!!
-	return false, nil
+	containerName, s3BlobName := sh.getContainerAndBlobNames(&container, blobName)
+
+	_, err := sh.s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(containerName),
+		Key:    aws.String(s3BlobName),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return false, nil
+		}
+		log.Errorf("Unable to check if %s exists %s", s3BlobName, err)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// isS3NotFound checks if the error is S3 saying the bucket/object doesn't exist.
+// HEAD requests have no body, so all we get is the status code.
+func isS3NotFound(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() == http.StatusNotFound
+	}
+	return false
 }
 
 // convertURL converts from https://bucketname.s3.amazonaws.com/myblob to https://s3.amazonaws.com/bucketname/myblob format
+// Regional hosts (bucketname.s3.eu-west-1.amazonaws.com or bucketname.s3-eu-west-1.amazonaws.com) and S3 compatible
+// endpoints (bucketname.myendpoint) are converted too. Path style URLs are returned as is.
 func (sh *S3Handler) convertURL(URL string) string {
-	// TODO(kpfaulkner) implement me!!!
-	return URL
+	u, err := url.Parse(URL)
+	if err != nil {
+		return URL
+	}
+
+	host := strings.ToLower(u.Host)
+	bucketName := ""
+
+	if sh.endpoint != "" {
+		endpointURL, err := url.Parse(sh.endpoint)
+		if err == nil && strings.HasSuffix(host, "."+strings.ToLower(endpointURL.Host)) {
+			bucketName = u.Host[:len(host)-len(endpointURL.Host)-1]
+		}
+	}
+
+	if bucketName == "" && strings.HasSuffix(host, ".amazonaws.com") {
+		// bucket names can contain . so look for the last s3 segment.
+		i := strings.LastIndex(host, ".s3.")
+		if j := strings.LastIndex(host, ".s3-"); j > i {
+			i = j
+		}
+		if i > 0 {
+			bucketName = u.Host[:i]
+		}
+	}
+
+	if bucketName == "" {
+		return URL
+	}
+
+	u.Host = u.Host[len(bucketName)+1:]
+	u.Path = "/" + bucketName + u.Path
+	u.RawPath = ""
+	return u.String()
 }
 
-// need a more solid way to generate this.
-func generateS3URL(key string, containerName string) string {
-	return fmt.Sprintf("https://%s.s3.amazonaws.com/%s", containerName, key)
+// generateS3URL generates the URL of the object, for the endpoint and addressing style in use.
+func (sh *S3Handler) generateS3URL(key string, containerName string) string {
+	if sh.endpoint == "" {
+		if sh.pathStyle {
+			return fmt.Sprintf("https://s3.amazonaws.com/%s/%s", containerName, key)
+		}
+		return fmt.Sprintf("https://%s.s3.amazonaws.com/%s", containerName, key)
+	}
+
+	if sh.pathStyle {
+		return fmt.Sprintf("%s/%s/%s", sh.endpoint, containerName, key)
+	}
+
+	u, err := url.Parse(sh.endpoint)
+	if err != nil {
+		return fmt.Sprintf("%s/%s/%s", sh.endpoint, containerName, key)
+	}
+	return fmt.Sprintf("%s://%s.%s/%s", u.Scheme, containerName, u.Host, key)
 }
 
 
@@ -129,16 +282,23 @@ func (sh *S3Handler) GetContainerContentsOverChannel(sourceContainer models.Simp
 	return nil
 }
 
+// getS3Bucket gets the bucket as a SimpleContainer. HeadBucket checks it exists (and we have access)
+// without listing every bucket.
 func (sh *S3Handler) getS3Bucket(containerName string) (*models.SimpleContainer, error) {
 
-	rootContainer := sh.GetRootContainer()
-	for _, container := range rootContainer.ContainerSlice {
-		if container.Name == containerName {
-			return container, nil
+	_, err := sh.s3Client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(containerName)})
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, fmt.Errorf("Unable to find bucket %s", containerName)
 		}
+		log.Errorf("Unable to get bucket %s %s", containerName, err)
+		return nil, err
 	}
 
-	return nil, errors.New("Unable to find container")
+	container := models.NewSimpleContainer()
+	container.Name = containerName
+	container.Origin = models.S3
+	return container, nil
 }
 
 func (sh *S3Handler) generateSubContainers(s3Container *models.SimpleContainer, blobPrefix string) (*models.SimpleContainer, *models.SimpleContainer) {
@@ -190,13 +350,13 @@ func (sh *S3Handler) GetSpecificSimpleContainer(URL string) (*models.SimpleConta
 
 	containerName, blobPrefix, err := sh.validateURL(URL)
 	if err != nil {
-		log.Fatal("GetSpecificSimpleContainer err", err)
+		return nil, err
 	}
 
 	log.Debugf("S3 blobprefix %s", blobPrefix)
 	container, err := sh.getS3Bucket(containerName)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	subContainer, lastContainer := sh.generateSubContainers(container, blobPrefix)
@@ -212,28 +372,24 @@ func (sh *S3Handler) GetSpecificSimpleContainer(URL string) (*models.SimpleConta
 
 // validateURL returns container (bucket) Name, blob Name and error
 // passes real URL such as https://s3.amazonaws.com/mybucket/myfileprefix/
+// Object keys are case sensitive so only the host is case insensitive.
 func (sh *S3Handler) validateURL(URL string) (string, string, error) {
 
-	lowerURL := strings.ToLower(URL)
-
-	// ugly, do this properly!!! TODO(kpfaulkner)
-	pruneCount := 0
-	match, _ := regexp.MatchString("http://", lowerURL)
-	if match {
-		pruneCount = 7
+	u, err := url.Parse(URL)
+	if err != nil {
+		return "", "", err
 	}
 
-	match, _ = regexp.MatchString("https://", lowerURL)
-	if match {
-		pruneCount = 8
+	sp := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+	if sp[0] == "" {
+		return "", "", fmt.Errorf("No bucket in URL %s", URL)
 	}
 
-	// trim protocol
-	lowerURL = lowerURL[pruneCount:]
-	sp := strings.Split(lowerURL, "/")
-
-	containerName := sp[1]
-	blobName := strings.Join(sp[2:], "/")
+	containerName := sp[0]
+	blobName := ""
+	if len(sp) > 1 {
+		blobName = sp[1]
+	}
 
 	return containerName, blobName, nil
 }
@@ -249,9 +405,10 @@ func (sh *S3Handler) GetSpecificSimpleBlob(URL string) (*models.SimpleBlob, erro
 		return nil, errors.New("Cannot end with a /")
 	}
 
+	URL = sh.convertURL(URL)
 	containerName, blobName, err := sh.validateURL(URL)
 	if err != nil {
-		log.Fatal("GetSpecificSimpleContainer err", err)
+		return nil, err
 	}
 
 	// get parent container (ie this will be the real S3 bucket)
@@ -273,10 +430,22 @@ func (sh *S3Handler) GetSpecificSimpleBlob(URL string) (*models.SimpleBlob, erro
 // ie we might have RootSimpleContainer -> SimpleContainer(myrealcontainer) -> SimpleContainer(vdir1) -> SimpleContainer(vdir2)
 // and if the blobName is "myblob" then the REAL underlying Azure structure would be container == "myrealcontainer"
 // and the blob name is vdir/vdir2/myblob
-func (sh *S3Handler) ReadBlob(container models.SimpleContainer, blobName string) models.SimpleBlob {
-	var blob models.SimpleBlob
+func (sh *S3Handler) ReadBlob(container models.SimpleContainer, blobName string) (models.SimpleBlob, error) {
+	containerName, s3BlobName := sh.getContainerAndBlobNames(&container, blobName)
+
+	blob := models.SimpleBlob{}
+	blob.Name = blobName
+	blob.Origin = models.S3
+	blob.ParentContainer = &container
+	blob.BlobCloudName = s3BlobName
+	blob.URL = sh.generateS3URL(s3BlobName, containerName)
+
+	err := sh.PopulateBlob(&blob)
+	if err != nil {
+		return blob, err
+	}
 
-	return blob
+	return blob, nil
 }
 
 // generateS3ContainerName gets the REAL Azure container name for the simpleBlob
@@ -294,18 +463,13 @@ func (sh *S3Handler) PopulateBlob(blob *models.SimpleBlob) error {
 
 	containerName := sh.generateS3ContainerName(*blob)
 
-	req := &s3.GetObjectInput{
-		Bucket: &containerName,
-		Key:    aws.String(blob.BlobCloudName),
-	}
-
-	objectData, err := sh.s3Client.GetObject(req)
+	// large objects are downloaded in parallel ranges.
+	reader, _, err := sh.GetBlobReader(blob)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
-
-	defer objectData.Body.Close()
+	defer reader.Close()
 
 	// file stream for cache.
 	var cacheFile *os.File
@@ -316,16 +480,15 @@ func (sh *S3Handler) PopulateBlob(blob *models.SimpleBlob) error {
 		cacheName := misc.GenerateCacheName(containerName + blob.BlobCloudName)
 		blob.DataCachedAtPath = sh.cacheLocation + "/" + cacheName
 
-		cacheFile, err = os.OpenFile(blob.DataCachedAtPath, os.O_WRONLY|os.O_CREATE, 0666)
-		defer cacheFile.Close()
-
+		cacheFile, err = os.OpenFile(blob.DataCachedAtPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 		if err != nil {
-			log.Fatal(err)
 			return err
 		}
+		defer cacheFile.Close()
 	} else {
 		blob.DataInMemory = []byte{}
 	}
+	blob.BlobInMemory = !sh.cacheToDisk
 
 	// 100k buffer... way too small?
 	buffer := make([]byte, 1024*100)
@@ -333,8 +496,11 @@ func (sh *S3Handler) PopulateBlob(blob *models.SimpleBlob) error {
 
 	finishedProcessing := false
 	for finishedProcessing == false {
-		numBytesRead, err = objectData.Body.Read(buffer)
+		numBytesRead, err = reader.Read(buffer)
 		if err != nil {
+			if err != io.EOF {
+				return err
+			}
 			finishedProcessing = true
 		}
 
@@ -347,7 +513,6 @@ func (sh *S3Handler) PopulateBlob(blob *models.SimpleBlob) error {
 		if sh.cacheToDisk {
 			_, err = cacheFile.Write(buffer[:numBytesRead])
 			if err != nil {
-				log.Fatal(err)
 				return err
 			}
 		} else {
@@ -367,7 +532,26 @@ func (sh *S3Handler) PopulateBlob(blob *models.SimpleBlob) error {
 	return nil
 }
 
+// WriteContainer writes the (already populated) blobs of the source container, and all its subcontainers, to the destination.
+// Subcontainers become virtual directories under the destination.
 func (sh *S3Handler) WriteContainer(sourceContainer *models.SimpleContainer, destContainer *models.SimpleContainer) error {
+
+	for _, blob := range sourceContainer.BlobSlice {
+		err := sh.WriteBlob(destContainer, blob)
+		if err != nil {
+			log.Errorf("Unable to write %s %s", blob.Name, err)
+			return err
+		}
+	}
+
+	for _, subContainer := range sourceContainer.ContainerSlice {
+		destSubContainer := containerutils.GetContainerByName(destContainer, subContainer.Name)
+		err := sh.WriteContainer(subContainer, destSubContainer)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -386,13 +570,116 @@ func (sh *S3Handler) WriteBlob(destContainer *models.SimpleContainer, sourceBlob
 	}
 
 	if err != nil {
-		log.Fatal(err)
 		return err
 	}
 
 	return nil
 }
 
+// GetBlobReader opens a stream to the S3 object.
+func (sh *S3Handler) GetBlobReader(blob *models.SimpleBlob) (io.ReadCloser, int64, error) {
+	containerName := sh.generateS3ContainerName(*blob)
+
+	req := &s3.GetObjectInput{
+		Bucket: &containerName,
+		Key:    aws.String(blob.BlobCloudName),
+	}
+
+	if !useRangedDownload(blob.Properties.Size, sh.DownloadChunkSize, sh.DownloadParallelism) {
+		objectData, err := sh.s3Client.GetObject(req)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		blob.Properties = s3PropertiesFromObject(objectData)
+		return objectData.Body, aws.Int64Value(objectData.ContentLength), nil
+	}
+
+	// first range gives us the properties. The size comes from the listing.
+	size := blob.Properties.Size
+	req.Range = aws.String(s3Range(0, sh.DownloadChunkSize))
+	objectData, err := sh.s3Client.GetObject(req)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	blob.Properties = s3PropertiesFromObject(objectData)
+	blob.Properties.Size = size
+
+	// the rest of the ranges must come from the same version of the object.
+	etag := objectData.ETag
+	fetch := func(offset int64, count int64) (io.ReadCloser, error) {
+		r, err := sh.s3Client.GetObject(&s3.GetObjectInput{
+			Bucket:  aws.String(containerName),
+			Key:     aws.String(blob.BlobCloudName),
+			Range:   aws.String(s3Range(offset, count)),
+			IfMatch: etag,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return r.Body, nil
+	}
+
+	log.Debugf("downloading %s in ranges of %d", blob.BlobCloudName, sh.DownloadChunkSize)
+	reader := helpers.NewRangedReader(objectData.Body, aws.Int64Value(objectData.ContentLength), size, sh.DownloadChunkSize, sh.DownloadParallelism, fetch)
+	return reader, size, nil
+}
+
+// s3Range generates the Range header for count bytes starting at offset.
+func s3Range(offset int64, count int64) string {
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+count-1)
+}
+
+// WriteBlobFromReader writes the stream to S3. Large objects are uploaded in parts, each part buffered in memory.
+// PutObject needs to be able to seek the body (for signing) so small streams are read into memory first.
+// At most one part is buffered, streams bigger than that are uploaded in parts too.
+func (sh *S3Handler) WriteBlobFromReader(destContainer *models.SimpleContainer, sourceBlob *models.SimpleBlob, reader io.Reader, size int64) error {
+	containerName, blobName := sh.getContainerAndBlobNames(destContainer, sourceBlob.Name)
+
+	if size < 0 || size > sh.MultipartThreshold {
+		return sh.multipartUpload(containerName, blobName, sourceBlob.Properties, reader, size)
+	}
+
+	if body, ok := reader.(io.ReadSeeker); ok {
+		return sh.putObject(destContainer, sourceBlob, body)
+	}
+
+	buffer := make([]byte, sh.multipartPartSize(size))
+	numBytesRead, err := io.ReadFull(reader, buffer)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return sh.putObject(destContainer, sourceBlob, bytes.NewReader(buffer[:numBytesRead]))
+	}
+	if err != nil {
+		log.Errorf("Unable to read %s %s", blobName, err)
+		return err
+	}
+
+	// filled a whole part, so there could be more. The part already read goes first.
+	return sh.multipartUpload(containerName, blobName, sourceBlob.Properties, io.MultiReader(bytes.NewReader(buffer), reader), size)
+}
+
+// DeleteBlob deletes the object from the bucket.
+func (sh *S3Handler) DeleteBlob(container *models.SimpleContainer, blobName string) error {
+	containerName, s3BlobName := sh.getContainerAndBlobNames(container, blobName)
+
+	_, err := sh.s3Client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(containerName),
+		Key:    aws.String(s3BlobName),
+	})
+	if err != nil {
+		log.Errorf("Unable to delete %s %s", s3BlobName, err)
+		return err
+	}
+
+	return nil
+}
+
+// RequiresSeekableBody large objects are streamed in parts and small ones buffered, so a plain stream is fine.
+func (sh *S3Handler) RequiresSeekableBody() bool {
+	return false
+}
+
 func (sh *S3Handler) getContainerAndBlobNames(destContainer *models.SimpleContainer, sourceBlobName string) (string, string) {
 
 	container, blobPrefix := containerutils.GetContainerAndBlobPrefix(destContainer)
@@ -401,7 +688,11 @@ func (sh *S3Handler) getContainerAndBlobNames(destContainer *models.SimpleContai
 	var blobName string
 
 	if blobPrefix != "" {
-		blobName = blobPrefix + "/" + sourceBlobName
+		if misc.GetLastChar(blobPrefix) == "/" {
+			blobName = blobPrefix + sourceBlobName
+		} else {
+			blobName = blobPrefix + "/" + sourceBlobName
+		}
 	} else {
 		blobName = sourceBlobName
 	}
@@ -411,10 +702,6 @@ func (sh *S3Handler) getContainerAndBlobNames(destContainer *models.SimpleContai
 
 // writeBlobFromCache.. read the cache file and pass the byte slice onto the real writer.
 func (sh *S3Handler) writeBlobFromCache(destContainer *models.SimpleContainer, sourceBlob *models.SimpleBlob) error {
-	containerName, blobName := sh.getContainerAndBlobNames(destContainer, sourceBlob.Name)
-
-	// file stream for cache.
-	var cacheFile *os.File
 
 	// need to get cache dir from somewhere!
 	cacheFile, err := os.OpenFile(sourceBlob.DataCachedAtPath, os.O_RDONLY, 0)
@@ -424,31 +711,39 @@ func (sh *S3Handler) writeBlobFromCache(destContainer *models.SimpleContainer, s
 	}
 	defer cacheFile.Close()
 
-	params := &s3.PutObjectInput{
-		Bucket: aws.String(containerName),
-		Key:    aws.String(blobName),
-		Body:   cacheFile,
-	}
-	_, err = sh.s3Client.PutObject(params)
-	if err != nil {
-		log.Errorf("Unable to upload %s", blobName)
-		return err
-	}
-
-	return nil
+	return sh.putObject(destContainer, sourceBlob, cacheFile)
 }
 
 func (sh *S3Handler) writeBlobFromMemory(destContainer *models.SimpleContainer, sourceBlob *models.SimpleBlob) error {
+	fileBytes := bytes.NewReader(sourceBlob.DataInMemory) // convert to io.ReadSeeker type
+	return sh.putObject(destContainer, sourceBlob, fileBytes)
+}
+
+// putObject uploads the body as a single S3 object, or in parts if it's larger than the multipart threshold.
+func (sh *S3Handler) putObject(destContainer *models.SimpleContainer, sourceBlob *models.SimpleBlob, body io.ReadSeeker) error {
 	containerName, blobName := sh.getContainerAndBlobNames(destContainer, sourceBlob.Name)
 
-	fileBytes := bytes.NewReader(sourceBlob.DataInMemory) // convert to io.ReadSeeker type
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	_, err = body.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	if size > sh.MultipartThreshold {
+		return sh.multipartUpload(containerName, blobName, sourceBlob.Properties, body, size)
+	}
 
 	params := &s3.PutObjectInput{
 		Bucket: aws.String(containerName),
 		Key:    aws.String(blobName),
-		Body:   fileBytes,
+		Body:   body,
 	}
-	_, err := sh.s3Client.PutObject(params)
+	setS3PutProperties(params, sourceBlob.Properties)
+	_, err = sh.s3Client.PutObject(params)
 	if err != nil {
 		log.Errorf("Unable to upload %s", blobName)
 		return err
@@ -457,17 +752,40 @@ func (sh *S3Handler) writeBlobFromMemory(destContainer *models.SimpleContainer,
 	return nil
 }
 
+// CreateContainer creates the bucket in the region of the handler. A bucket we already own isn't an error.
 func (sh *S3Handler) CreateContainer(containerName string) (models.SimpleContainer, error) {
 	var container models.SimpleContainer
 
+	params := &s3.CreateBucketInput{Bucket: aws.String(containerName)}
+
+	// us-east-1 is the default, and S3 rejects it as a location constraint.
+	if sh.region != "" && sh.region != "us-east-1" {
+		params.CreateBucketConfiguration = &s3.CreateBucketConfiguration{LocationConstraint: aws.String(sh.region)}
+	}
+
+	_, err := sh.s3Client.CreateBucket(params)
+	if err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != s3.ErrCodeBucketAlreadyOwnedByYou {
+			log.Errorf("Unable to create bucket %s %s", containerName, err)
+			return container, err
+		}
+	}
+
+	container.Name = containerName
+	container.Origin = models.S3
 	return container, nil
 }
 
 // GetContainer gets a container. Populating the subtree? OR NOT? hmmmm
-func (ah *S3Handler) GetContainer(containerName string) models.SimpleContainer {
-	var container models.SimpleContainer
+// Returns an empty container if the bucket doesn't exist.
+func (sh *S3Handler) GetContainer(containerName string) models.SimpleContainer {
+	container, err := sh.getS3Bucket(containerName)
+	if err != nil {
+		return models.SimpleContainer{}
+	}
 
-	return container
+	return *container
 }
 
 // GetContainerContents populates the passed container with the real contents.
@@ -509,9 +827,7 @@ func (sh *S3Handler) GetContainerContents(container *models.SimpleContainer) err
 	return nil
 }
 
-/* presign URL code.....  use it eventually.
- */
-
+// GeneratePresignedURL generates a presigned GET URL for the object, valid for PresignedURLExpiry.
 func (sh *S3Handler) GeneratePresignedURL(blob *models.SimpleBlob) (string, error) {
 
 	log.Debugf("S3:GeneratePresignedURL")
@@ -524,7 +840,7 @@ func (sh *S3Handler) GeneratePresignedURL(blob *models.SimpleBlob) (string, erro
 
 	//r.HTTPRequest.Header.Set("content-type", "application/octet-stream")
 	// r.HTTPRequest.Header.Set("Content-MD5", checksum)
-	url, err := r.Presign(15 * time.Minute)
+	url, err := r.Presign(sh.PresignedURLExpiry)
 	if err != nil {
 		log.Error("error presigning request", err)
 		return "", err
@@ -546,6 +862,7 @@ func (sh *S3Handler) GeneratePresignedURL(blob *models.SimpleBlob) (string, erro
 func (sh *S3Handler) populateSimpleContainer(s3Objects []*s3.Object, container *models.SimpleContainer, blobPrefix string) {
 
 	log.Debugf("populateSimpleContainer original container %s", container.Name)
+	s3Container, _ := containerutils.GetContainerAndBlobPrefix(container)
 	for _, blob := range s3Objects {
 		log.Debugf("populateSimpleContainer %s", *blob.Key)
 
@@ -577,7 +894,8 @@ func (sh *S3Handler) populateSimpleContainer(s3Objects []*s3.Object, container *
 			b.Origin = container.Origin
 			b.ParentContainer = container
 			b.BlobCloudName = *blob.Key
-			b.URL = generateS3URL(*blob.Key, container.Name)
+			b.URL = sh.generateS3URL(*blob.Key, s3Container.Name)
+			b.Properties = s3PropertiesFromListing(blob)
 			// add to the blob slice within the container
 			container.BlobSlice = append(container.BlobSlice, &b)
 			log.Debugf("1 S3 blob %v", b)
@@ -602,7 +920,8 @@ func (sh *S3Handler) populateSimpleContainer(s3Objects []*s3.Object, container *
 			b.Origin = container.Origin
 			b.ParentContainer = container
 			b.BlobCloudName = *blob.Key // cloud specific name... ie the REAL name.
-			b.URL = generateS3URL(*blob.Key, container.Name)
+			b.URL = sh.generateS3URL(*blob.Key, s3Container.Name)
+			b.Properties = s3PropertiesFromListing(blob)
 			currentContainer.BlobSlice = append(currentContainer.BlobSlice, &b)
 			currentContainer.Populated = true
 
@@ -632,3 +951,257 @@ func (sh *S3Handler) getSubContainer(container *models.SimpleContainer, segment
 	container.ContainerSlice = append(container.ContainerSlice, &newContainer)
 	return &newContainer
 }
+
+// s3PropertiesFromListing converts what S3 returns when listing objects. Anything else
+// (content type, metadata etc) is only available when the object is read.
+func s3PropertiesFromListing(object *s3.Object) models.BlobProperties {
+	p := models.BlobProperties{}
+	p.Size = aws.Int64Value(object.Size)
+	p.LastModified = aws.TimeValue(object.LastModified)
+	p.ETag = strings.Trim(aws.StringValue(object.ETag), "\"")
+	return p
+}
+
+// s3PropertiesFromObject converts the headers returned when reading an object.
+// The SDK has already stripped the x-amz-meta- prefix from the metadata keys.
+// S3 doesn't store an MD5 (the ETag isn't one for multipart uploads) so ContentMD5 is left empty.
+func s3PropertiesFromObject(object *s3.GetObjectOutput) models.BlobProperties {
+	p := models.BlobProperties{}
+	p.Size = aws.Int64Value(object.ContentLength)
+	p.LastModified = aws.TimeValue(object.LastModified)
+	p.ETag = strings.Trim(aws.StringValue(object.ETag), "\"")
+	p.ContentType = aws.StringValue(object.ContentType)
+	p.ContentEncoding = aws.StringValue(object.ContentEncoding)
+	p.ContentLanguage = aws.StringValue(object.ContentLanguage)
+	p.ContentDisposition = aws.StringValue(object.ContentDisposition)
+	p.CacheControl = aws.StringValue(object.CacheControl)
+	p.Metadata = blobutils.NormaliseMetadata(aws.StringValueMap(object.Metadata))
+	return p
+}
+
+// setS3PutProperties sets the headers and metadata on the upload. Empty values are left unset so S3 uses its defaults.
+func setS3PutProperties(params *s3.PutObjectInput, properties models.BlobProperties) {
+	if properties.ContentType != "" {
+		params.ContentType = aws.String(properties.ContentType)
+	}
+	if properties.ContentEncoding != "" {
+		params.ContentEncoding = aws.String(properties.ContentEncoding)
+	}
+	if properties.ContentLanguage != "" {
+		params.ContentLanguage = aws.String(properties.ContentLanguage)
+	}
+	if properties.ContentDisposition != "" {
+		params.ContentDisposition = aws.String(properties.ContentDisposition)
+	}
+	if properties.CacheControl != "" {
+		params.CacheControl = aws.String(properties.CacheControl)
+	}
+	if len(properties.Metadata) > 0 {
+		params.Metadata = aws.StringMap(properties.Metadata)
+	}
+}
+
+
+// multipartPartSize returns the part size to use for an object of the given size (-1 if unknown).
+// Parts are made bigger if the object would otherwise need more than 10000 of them.
+func (sh *S3Handler) multipartPartSize(size int64) int64 {
+	partSize := sh.MultipartPartSize
+	if partSize < s3MinPartSize {
+		partSize = s3MinPartSize
+	}
+
+	if size > partSize*s3MaxPartCount {
+		// round up to the next MB.
+		partSize = (size/s3MaxPartCount/(1024*1024) + 1) * 1024 * 1024
+	}
+
+	return partSize
+}
+
+// multipartUpload uploads the reader as a multipart upload. Parts are read sequentially from the reader
+// but up to MultipartConcurrency of them are uploaded at once. Each failed part is retried individually,
+// and if a part still fails the whole upload is aborted so S3 doesn't keep (and charge for) the parts.
+func (sh *S3Handler) multipartUpload(containerName string, blobName string, properties models.BlobProperties, reader io.Reader, size int64) error {
+
+	partSize := sh.multipartPartSize(size)
+	log.Debugf("S3 multipart upload %s size %d part size %d", blobName, size, partSize)
+
+	params := &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(containerName),
+		Key:    aws.String(blobName),
+	}
+	setS3CreateMultipartProperties(params, properties)
+
+	upload, err := sh.s3Client.CreateMultipartUpload(params)
+	if err != nil {
+		log.Errorf("Unable to start multipart upload %s %s", blobName, err)
+		return err
+	}
+
+	completedParts, err := sh.uploadParts(containerName, blobName, upload.UploadId, reader, partSize)
+	if err != nil {
+		sh.abortMultipartUpload(containerName, blobName, upload.UploadId)
+		return err
+	}
+
+	_, err = sh.s3Client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(containerName),
+		Key:             aws.String(blobName),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completedParts},
+	})
+	if err != nil {
+		log.Errorf("Unable to complete multipart upload %s %s", blobName, err)
+		sh.abortMultipartUpload(containerName, blobName, upload.UploadId)
+		return err
+	}
+
+	return nil
+}
+
+// uploadParts reads the parts from the reader and uploads them concurrently.
+// Returns the completed parts in order, or the first error encountered.
+func (sh *S3Handler) uploadParts(containerName string, blobName string, uploadID *string, reader io.Reader, partSize int64) ([]*s3.CompletedPart, error) {
+
+	concurrency := int(sh.MultipartConcurrency)
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	// buffers are reused between parts, so at most concurrency parts are held in memory.
+	// Allocated on demand so small objects don't allocate every buffer.
+	buffers := make(chan []byte, concurrency)
+	for i := 0; i < concurrency; i++ {
+		buffers <- nil
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var uploadErr error
+	completedParts := []*s3.CompletedPart{}
+
+	failed := func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return uploadErr != nil
+	}
+
+	var partNumber int64
+	finishedProcessing := false
+	for !finishedProcessing && !failed() {
+		buffer := <-buffers
+		if buffer == nil {
+			buffer = make([]byte, partSize)
+		}
+
+		numBytesRead, err := io.ReadFull(reader, buffer)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			finishedProcessing = true
+		} else if err != nil {
+			buffers <- buffer
+			lock.Lock()
+			uploadErr = err
+			lock.Unlock()
+			break
+		}
+
+		// an empty object still needs a single (empty) part.
+		if numBytesRead <= 0 && partNumber > 0 {
+			buffers <- buffer
+			continue
+		}
+
+		partNumber++
+		if partNumber > s3MaxPartCount {
+			buffers <- buffer
+			lock.Lock()
+			uploadErr = fmt.Errorf("%s needs more than %d parts", blobName, s3MaxPartCount)
+			lock.Unlock()
+			break
+		}
+
+		wg.Add(1)
+		go func(partNumber int64, buffer []byte, data []byte) {
+			defer wg.Done()
+			defer func() { buffers <- buffer }()
+
+			etag, err := sh.uploadPart(containerName, blobName, uploadID, partNumber, data)
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				if uploadErr == nil {
+					uploadErr = err
+				}
+				return
+			}
+			completedParts = append(completedParts, &s3.CompletedPart{ETag: etag, PartNumber: aws.Int64(partNumber)})
+		}(partNumber, buffer, buffer[:numBytesRead])
+	}
+
+	wg.Wait()
+
+	if uploadErr != nil {
+		return nil, uploadErr
+	}
+
+	// parts finish in any order, S3 needs them sorted.
+	sort.Slice(completedParts, func(i, j int) bool {
+		return *completedParts[i].PartNumber < *completedParts[j].PartNumber
+	})
+
+	return completedParts, nil
+}
+
+// uploadPart uploads a single part, retrying up to MultipartRetries times. Returns the ETag of the part.
+func (sh *S3Handler) uploadPart(containerName string, blobName string, uploadID *string, partNumber int64, data []byte) (*string, error) {
+
+	var err error
+	for attempt := uint(0); attempt <= sh.MultipartRetries; attempt++ {
+		if attempt > 0 {
+			log.Debugf("retrying part %d of %s (attempt %d) %s", partNumber, blobName, attempt, err)
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+
+		var resp *s3.UploadPartOutput
+		resp, err = sh.s3Client.UploadPart(&s3.UploadPartInput{
+			Bucket:        aws.String(containerName),
+			Key:           aws.String(blobName),
+			UploadId:      uploadID,
+			PartNumber:    aws.Int64(partNumber),
+			Body:          bytes.NewReader(data),
+			ContentLength: aws.Int64(int64(len(data))),
+		})
+		if err == nil {
+			return resp.ETag, nil
+		}
+	}
+
+	log.Errorf("Unable to upload part %d of %s %s", partNumber, blobName, err)
+	return nil, err
+}
+
+// abortMultipartUpload discards the parts uploaded so far. Failure is only logged, the original error is what matters.
+func (sh *S3Handler) abortMultipartUpload(containerName string, blobName string, uploadID *string) {
+	_, err := sh.s3Client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(containerName),
+		Key:      aws.String(blobName),
+		UploadId: uploadID,
+	})
+	if err != nil {
+		log.Errorf("Unable to abort multipart upload %s %s", blobName, err)
+	}
+}
+
+// setS3CreateMultipartProperties sets the headers and metadata for a multipart upload. Same as setS3PutProperties.
+func setS3CreateMultipartProperties(params *s3.CreateMultipartUploadInput, properties models.BlobProperties) {
+	putParams := &s3.PutObjectInput{}
+	setS3PutProperties(putParams, properties)
+
+	params.ContentType = putParams.ContentType
+	params.ContentEncoding = putParams.ContentEncoding
+	params.ContentLanguage = putParams.ContentLanguage
+	params.ContentDisposition = putParams.ContentDisposition
+	params.CacheControl = putParams.CacheControl
+	params.Metadata = putParams.Metadata
+}
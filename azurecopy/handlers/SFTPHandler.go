@@ -0,0 +1,678 @@
+package handlers
+
+import (
+	"azurecopy/azurecopy/models"
+	"azurecopy/azurecopy/utils/blobutils"
+	"azurecopy/azurecopy/utils/misc"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpDialTimeout how long to wait when connecting to the server.
+const sftpDialTimeout = 30 * time.Second
+
+// SFTPCredentials everything configured for authenticating with an SFTP server.
+// Every method configured is offered to the server: private key, then ssh-agent, then password.
+type SFTPCredentials struct {
+	Username string
+	Password string
+
+	// path of the (PEM/OpenSSH format) private key and its passphrase, if encrypted.
+	PrivateKeyFile       string
+	PrivateKeyPassphrase string
+
+	// use the keys held by the ssh-agent at SSH_AUTH_SOCK.
+	UseAgent bool
+
+	// known_hosts file the server's host key is verified against.
+	KnownHostsFile string
+
+	// skip host key verification. Only for testing!
+	InsecureIgnoreHostKey bool
+}
+
+// SFTPHandler basic data structure for SFTP handling.
+// Containers are directories, blobs are files. Paths are absolute, except URLs starting with /~/ which are
+// relative to the login directory.
+type SFTPHandler struct {
+
+	// is this source or dest handler?
+	IsSource bool
+
+	// list only the immediate children (files and directories) of a directory.
+	HierarchicalListing bool
+
+	// ssh connection and the sftp session running over it.
+	// The sftp client is safe for concurrent use, requests are pipelined over the one connection.
+	sshClient *ssh.Client
+	client    *sftp.Client
+
+	// determine if we're caching the blob to disk during copy operations.
+	// or if we're keeping it in memory
+	cacheToDisk   bool
+	cacheLocation string
+}
+
+// NewSFTPHandler factory to create new one. Evil?
+// address is host:port. The connection is made straight away so bad addresses/credentials/host keys are found early.
+func NewSFTPHandler(address string, credentials SFTPCredentials, isSource bool, cacheToDisk bool) (*SFTPHandler, error) {
+
+	config, closeAgent, err := sftpClientConfig(credentials)
+	if err != nil {
+		return nil, err
+	}
+	defer closeAgent()
+
+	sshClient, err := ssh.Dial("tcp", address, config)
+	if err != nil {
+		log.Errorf("Unable to connect to SFTP server %s %s", address, err)
+		return nil, err
+	}
+
+	sh, err := NewSFTPHandlerFromClient(sshClient, isSource, cacheToDisk)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+
+	return sh, nil
+}
+
+// NewSFTPHandlerFromClient creates the handler over an existing (authenticated) ssh connection.
+// Useful when the connection needs to be made differently (eg. through a proxy, or to an in process server).
+// The handler owns the connection from now on, Close closes it.
+func NewSFTPHandlerFromClient(sshClient *ssh.Client, isSource bool, cacheToDisk bool) (*SFTPHandler, error) {
+
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		log.Errorf("Unable to start SFTP session %s", err)
+		return nil, err
+	}
+
+	sh := new(SFTPHandler)
+	sh.IsSource = isSource
+	sh.sshClient = sshClient
+	sh.client = client
+	sh.cacheToDisk = cacheToDisk
+
+	dir, err := ioutil.TempDir("", "azurecopy")
+	if err != nil {
+		log.Errorf("Unable to create temp directory %s", err)
+		client.Close()
+		return nil, err
+	}
+
+	sh.cacheLocation = dir
+
+	return sh, nil
+}
+
+// sftpClientConfig builds the ssh configuration from the credentials.
+// The returned func closes the connection to the ssh-agent (if used) and must be called once connected.
+// The agent is connected to last, so nothing can fail once it's open.
+func sftpClientConfig(credentials SFTPCredentials) (*ssh.ClientConfig, func(), error) {
+	closeAgent := func() {}
+
+	if credentials.Username == "" {
+		return nil, closeAgent, errors.New("SFTP requires a username")
+	}
+
+	var hostKeyCallback ssh.HostKeyCallback
+	if credentials.InsecureIgnoreHostKey {
+		log.Warnf("SFTP host key verification is disabled")
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	} else {
+		if credentials.KnownHostsFile == "" {
+			return nil, closeAgent, errors.New("SFTP requires a known_hosts file to verify the server")
+		}
+
+		var err error
+		hostKeyCallback, err = knownhosts.New(credentials.KnownHostsFile)
+		if err != nil {
+			log.Errorf("Unable to read known_hosts %s %s", credentials.KnownHostsFile, err)
+			return nil, closeAgent, err
+		}
+	}
+
+	var authMethods []ssh.AuthMethod
+
+	if credentials.PrivateKeyFile != "" {
+		keyBytes, err := ioutil.ReadFile(credentials.PrivateKeyFile)
+		if err != nil {
+			log.Errorf("Unable to read private key %s %s", credentials.PrivateKeyFile, err)
+			return nil, closeAgent, err
+		}
+
+		var signer ssh.Signer
+		if credentials.PrivateKeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(keyBytes, []byte(credentials.PrivateKeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(keyBytes)
+		}
+		if err != nil {
+			log.Errorf("Unable to parse private key %s %s", credentials.PrivateKeyFile, err)
+			return nil, closeAgent, err
+		}
+
+		authMethods = append(authMethods, ssh.PublicKeys(signer))
+	}
+
+	if credentials.UseAgent {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return nil, closeAgent, errors.New("ssh-agent requested but SSH_AUTH_SOCK is not set")
+		}
+
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			log.Errorf("Unable to connect to ssh-agent %s", err)
+			return nil, closeAgent, err
+		}
+		closeAgent = func() { conn.Close() }
+
+		authMethods = append(authMethods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+
+	if credentials.Password != "" {
+		password := credentials.Password
+		authMethods = append(authMethods, ssh.Password(password))
+
+		// plenty of servers only allow passwords via keyboard-interactive.
+		authMethods = append(authMethods, ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i := range answers {
+				answers[i] = password
+			}
+			return answers, nil
+		}))
+	}
+
+	if len(authMethods) == 0 {
+		return nil, closeAgent, errors.New("SFTP requires a password, private key or ssh-agent")
+	}
+
+	config := &ssh.ClientConfig{
+		User:            credentials.Username,
+		Auth:            authMethods,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sftpDialTimeout,
+	}
+
+	return config, closeAgent, nil
+}
+
+// Close ends the SFTP session and the ssh connection.
+func (sh *SFTPHandler) Close() error {
+	sh.client.Close()
+	return sh.sshClient.Close()
+}
+
+// GetRootContainer gets root container. This will get containers/blobs in this container
+// NOT recursive.
+func (sh *SFTPHandler) GetRootContainer() (models.SimpleContainer, error) {
+
+	rootContainer := models.NewSimpleContainer()
+	rootContainer.Origin = models.SFTP
+	rootContainer.IsRootContainer = true
+
+	err := sh.listDirectory(rootContainer, false)
+	if err != nil {
+		return models.SimpleContainer{}, err
+	}
+
+	return *rootContainer, nil
+}
+
+// CreateContainer creates the directory (and any above it).
+func (sh *SFTPHandler) CreateContainer(containerName string) (models.SimpleContainer, error) {
+
+	fullPath := path.Join("/", containerName)
+	err := sh.client.MkdirAll(fullPath)
+	if err != nil {
+		log.Errorf("Unable to create directory %s %s", fullPath, err)
+		return models.SimpleContainer{}, err
+	}
+
+	rootContainer := models.NewSimpleContainer()
+	rootContainer.Origin = models.SFTP
+	rootContainer.IsRootContainer = true
+
+	container := models.NewSimpleContainer()
+	container.Name = strings.Trim(containerName, "/")
+	container.Origin = models.SFTP
+	container.ParentContainer = rootContainer
+	rootContainer.ContainerSlice = append(rootContainer.ContainerSlice, container)
+
+	return *container, nil
+}
+
+// sftpPathFromURL gets the (unescaped) path from an sftp:// URL.
+func sftpPathFromURL(URL string) (string, error) {
+	u, err := url.Parse(URL)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Path == "" {
+		return "/", nil
+	}
+	return u.Path, nil
+}
+
+// resolvePath converts a path from a URL into an absolute path on the server.
+// /~/dir is relative to the login directory (same as scp/curl).
+func (sh *SFTPHandler) resolvePath(urlPath string) (string, error) {
+	if urlPath != "/~" && !strings.HasPrefix(urlPath, "/~/") {
+		return urlPath, nil
+	}
+
+	home, err := sh.client.Getwd()
+	if err != nil {
+		log.Errorf("Unable to get SFTP login directory %s", err)
+		return "", err
+	}
+
+	resolved := path.Join(home, strings.TrimPrefix(urlPath, "/~"))
+	if strings.HasSuffix(urlPath, "/") && resolved != "/" {
+		resolved += "/"
+	}
+	return resolved, nil
+}
+
+// GetSpecificSimpleContainer given a URL (ending in /) then get the SIMPLE container that represents it.
+// does not have to have all blobs populated in it. Those can be retrieved later via GetContainerContentsOverChannel
+// For SFTP if the url is sftp://myhost/dir1/dir2/dir3/ then it will return a SimpleContainer representing dir3.
+func (sh *SFTPHandler) GetSpecificSimpleContainer(URL string) (*models.SimpleContainer, error) {
+	if URL == "" {
+		return nil, errors.New("URL cannot be empty")
+	}
+
+	urlPath, err := sftpPathFromURL(URL)
+	if err != nil {
+		return nil, err
+	}
+
+	dirPath, err := sh.resolvePath(urlPath)
+	if err != nil {
+		return nil, err
+	}
+
+	parentContainer := models.NewSimpleContainer()
+	parentContainer.IsRootContainer = true
+	parentContainer.Origin = models.SFTP
+	currentContainer := parentContainer
+	for _, segment := range strings.Split(strings.Trim(dirPath, "/"), "/") {
+		if segment == "" {
+			continue
+		}
+
+		container := models.NewSimpleContainer()
+		container.URL = URL
+		container.Origin = models.SFTP
+		container.Name = segment
+		container.IsRootContainer = false
+		container.ParentContainer = currentContainer
+		currentContainer.ContainerSlice = append(currentContainer.ContainerSlice, container)
+
+		currentContainer = container
+		log.Debugf("segment is %s\n", segment)
+	}
+
+	return currentContainer, nil
+}
+
+// GetContainerContents populates the container (directory) with its files and directories.
+// Recursive unless HierarchicalListing is set.
+func (sh *SFTPHandler) GetContainerContents(container *models.SimpleContainer) error {
+	return sh.listDirectory(container, !sh.HierarchicalListing)
+}
+
+// listDirectory adds the files and directories in the container's directory to the container.
+// Symlinks to files are followed (the file is copied), symlinks to directories are skipped so loops can't happen.
+func (sh *SFTPHandler) listDirectory(container *models.SimpleContainer, recursive bool) error {
+
+	fullPath := sh.generateFullPath(container)
+	fileInfos, err := sh.client.ReadDir(fullPath)
+	if err != nil {
+		log.Errorf("Unable to list directory %s %s", fullPath, err)
+		return err
+	}
+
+	for _, f := range fileInfos {
+
+		if f.Mode()&os.ModeSymlink != 0 {
+			target, err := sh.client.Stat(fullPath + f.Name())
+			if err != nil {
+				log.Debugf("skipping broken symlink %s%s %s", fullPath, f.Name(), err)
+				continue
+			}
+			if target.IsDir() {
+				log.Debugf("skipping symlink to directory %s%s", fullPath, f.Name())
+				continue
+			}
+			f = symlinkFileInfo{FileInfo: target, name: f.Name()}
+		}
+
+		if f.IsDir() {
+			sc := models.NewSimpleContainer()
+			sc.Name = f.Name()
+			sc.Origin = models.SFTP
+			sc.ParentContainer = container
+			sc.Populated = false
+			sc.IsRootContainer = false
+
+			if recursive {
+				err = sh.listDirectory(sc, recursive)
+				if err != nil {
+					return err
+				}
+			}
+			container.ContainerSlice = append(container.ContainerSlice, sc)
+
+		} else if f.Mode().IsRegular() {
+			b := models.SimpleBlob{}
+			b.Name = f.Name()
+			b.ParentContainer = container
+			b.Origin = models.SFTP
+			b.URL = fullPath + b.Name
+			b.BlobCloudName = b.URL
+			b.Properties = filesystemProperties(f)
+			container.BlobSlice = append(container.BlobSlice, &b)
+		}
+	}
+	container.Populated = true
+
+	return nil
+}
+
+// GetContainerContentsOverChannel given a URL (ending in /) returns all the contents of the container over a channel
+// This returns a COPY of the original source container but has been populated with *some* of the blobs/subcontainers in it.
+func (sh *SFTPHandler) GetContainerContentsOverChannel(sourceContainer models.SimpleContainer, blobChannel chan models.SimpleContainer) error {
+
+	defer close(blobChannel)
+	// just do it in bulk, same as FS.
+	err := sh.GetContainerContents(&sourceContainer)
+	if err != nil {
+		return err
+	}
+	blobChannel <- sourceContainer
+
+	return nil
+}
+
+// GetSpecificSimpleBlob given a URL (NOT ending in /) then get the SIMPLE blob that represents it.
+// The DestName will be the last element of the URL, whether it's a real blobname or not.
+func (sh *SFTPHandler) GetSpecificSimpleBlob(URL string) (*models.SimpleBlob, error) {
+	if misc.GetLastChar(URL) == "/" {
+		return nil, errors.New("Cannot end with a /")
+	}
+
+	urlPath, err := sftpPathFromURL(URL)
+	if err != nil {
+		return nil, err
+	}
+
+	filePath, err := sh.resolvePath(urlPath)
+	if err != nil {
+		return nil, err
+	}
+
+	dirURL := URL[:strings.LastIndex(URL, "/")+1]
+	container, err := sh.GetSpecificSimpleContainer(dirURL)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := sh.client.Stat(filePath)
+	if err != nil {
+		log.Errorf("Unable to stat %s %s", filePath, err)
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", filePath)
+	}
+
+	b := models.SimpleBlob{}
+	b.Name = path.Base(filePath)
+	b.Origin = models.SFTP
+	b.ParentContainer = container
+	b.BlobCloudName = filePath
+	b.URL = URL
+	b.Properties = filesystemProperties(fi)
+	return &b, nil
+}
+
+// generateFullPath generates the absolute path (ending in /) of the directory.
+func (sh *SFTPHandler) generateFullPath(container *models.SimpleContainer) string {
+
+	dirPath := container.Name
+	currentContainer := container.ParentContainer
+	for currentContainer != nil {
+		if currentContainer.Name != "" {
+			dirPath = path.Join(currentContainer.Name, dirPath)
+		}
+
+		currentContainer = currentContainer.ParentContainer
+	}
+
+	if dirPath == "" {
+		return "/"
+	}
+	return "/" + dirPath + "/"
+}
+
+// generate complete path of blob
+func (sh *SFTPHandler) generateBlobFullPath(blob *models.SimpleBlob) string {
+	return sh.generateFullPath(blob.ParentContainer) + blob.Name
+}
+
+// ReadBlob given a container and a blob name, read the blob.
+func (sh *SFTPHandler) ReadBlob(container models.SimpleContainer, blobName string) (models.SimpleBlob, error) {
+	var blob models.SimpleBlob
+
+	fullPath := sh.generateFullPath(&container) + strings.TrimPrefix(blobName, "/")
+
+	blob.Name = blobName
+	blob.BlobCloudName = fullPath
+	blob.ParentContainer = &container
+	blob.Origin = container.Origin
+	blob.URL = fullPath
+
+	err := sh.retrieveBlob(&blob, fullPath)
+	return blob, err
+}
+
+// retrieveBlob reads the file into memory or the cache, depending on how the handler is configured.
+func (sh *SFTPHandler) retrieveBlob(blob *models.SimpleBlob, fullPath string) error {
+	f, err := sh.client.Open(fullPath)
+	if err != nil {
+		log.Errorf("Unable to open %s %s", fullPath, err)
+		return err
+	}
+	defer f.Close()
+
+	return blobutils.ReadBlob(f, blob, sh.cacheToDisk, sh.cacheLocation)
+}
+
+// BlobExists checks if the file exists. Directories of the same name don't count.
+func (sh *SFTPHandler) BlobExists(container models.SimpleContainer, blobName string) (bool, error) {
+	fullPath := sh.generateFullPath(&container) + strings.TrimPrefix(blobName, "/")
+
+	fi, err := sh.client.Stat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		log.Errorf("Unable to stat %s %s", fullPath, err)
+		return false, err
+	}
+
+	return !fi.IsDir(), nil
+}
+
+// PopulateBlob if we already have a reference to a SimpleBlob, then read it and populate it.
+// ie we're populating our in process copy of the blob (ie reading it from the provider).
+func (sh *SFTPHandler) PopulateBlob(blob *models.SimpleBlob) error {
+	fullPath := sh.generateBlobFullPath(blob)
+
+	err := sh.retrieveBlob(blob, fullPath)
+	if err != nil {
+		return err
+	}
+
+	blob.URL = fullPath
+	return nil
+}
+
+// WriteBlob given a container and blob, write blob.
+func (sh *SFTPHandler) WriteBlob(destContainer *models.SimpleContainer, sourceBlob *models.SimpleBlob) error {
+
+	if !sourceBlob.BlobInMemory {
+		// cached on disk.
+		cacheFile, err := os.OpenFile(sourceBlob.DataCachedAtPath, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer cacheFile.Close()
+
+		return sh.WriteBlobFromReader(destContainer, sourceBlob, cacheFile, -1)
+	}
+
+	// in memory.
+	return sh.WriteBlobFromReader(destContainer, sourceBlob, bytes.NewReader(sourceBlob.DataInMemory), int64(len(sourceBlob.DataInMemory)))
+}
+
+// GetBlobReader opens a stream to the file on the server.
+func (sh *SFTPHandler) GetBlobReader(blob *models.SimpleBlob) (io.ReadCloser, int64, error) {
+	fullPath := sh.generateBlobFullPath(blob)
+
+	f, err := sh.client.Open(fullPath)
+	if err != nil {
+		log.Errorf("Unable to open %s %s", fullPath, err)
+		return nil, 0, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	blob.Properties.Size = fi.Size()
+	return f, fi.Size(), nil
+}
+
+// WriteBlobFromReader streams to the file, creating the directories it's in (mkdir -p) first.
+func (sh *SFTPHandler) WriteBlobFromReader(destContainer *models.SimpleContainer, sourceBlob *models.SimpleBlob, reader io.Reader, size int64) error {
+	fullPath := sh.generateFullPath(destContainer) + strings.TrimPrefix(sourceBlob.Name, "/")
+
+	err := sh.client.MkdirAll(path.Dir(fullPath))
+	if err != nil {
+		log.Errorf("Unable to create directory %s %s", path.Dir(fullPath), err)
+		return err
+	}
+
+	f, err := sh.client.Create(fullPath)
+	if err != nil {
+		log.Errorf("Unable to create %s %s", fullPath, err)
+		return err
+	}
+
+	_, err = io.Copy(f, reader)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Errorf("Unable to upload file %s %s", fullPath, err)
+		return err
+	}
+
+	return nil
+}
+
+// DeleteBlob deletes the file from the server.
+func (sh *SFTPHandler) DeleteBlob(container *models.SimpleContainer, blobName string) error {
+	fullPath := sh.generateFullPath(container) + strings.TrimPrefix(blobName, "/")
+
+	err := sh.client.Remove(fullPath)
+	if err != nil {
+		log.Errorf("SFTP unable to delete %s %s", fullPath, err)
+		return err
+	}
+
+	return nil
+}
+
+// RequiresSeekableBody SFTP writes sequentially so a plain stream is fine.
+func (sh *SFTPHandler) RequiresSeekableBody() bool {
+	return false
+}
+
+// WriteContainer creates the directory for the source container in the destination.
+func (sh *SFTPHandler) WriteContainer(sourceContainer *models.SimpleContainer, destContainer *models.SimpleContainer) error {
+	fullPath := sh.generateFullPath(destContainer) + sourceContainer.Name
+
+	err := sh.client.MkdirAll(fullPath)
+	if err != nil {
+		log.Errorf("Unable to create directory %s %s", fullPath, err)
+		return err
+	}
+
+	return nil
+}
+
+// GetContainer gets the directory (path from the root of the server, or ~/ for the login directory), populated with its contents.
+// An empty container is returned if it can't be listed.
+func (sh *SFTPHandler) GetContainer(containerName string) models.SimpleContainer {
+	dirPath, err := sh.resolvePath("/" + strings.TrimPrefix(containerName, "/"))
+	if err != nil {
+		return models.SimpleContainer{}
+	}
+
+	rootContainer := models.NewSimpleContainer()
+	rootContainer.Origin = models.SFTP
+	rootContainer.IsRootContainer = true
+
+	container := rootContainer
+	for _, segment := range strings.Split(strings.Trim(dirPath, "/"), "/") {
+		if segment == "" {
+			continue
+		}
+
+		sc := models.NewSimpleContainer()
+		sc.Name = segment
+		sc.Origin = models.SFTP
+		sc.ParentContainer = container
+		container.ContainerSlice = append(container.ContainerSlice, sc)
+		container = sc
+	}
+
+	err = sh.GetContainerContents(container)
+	if err != nil {
+		log.Errorf("Unable to get container %s %s", containerName, err)
+		return models.SimpleContainer{}
+	}
+
+	return *container
+}
+
+// GeneratePresignedURL SFTP has no equivalent, so the CopyBlob flag can't be used with an SFTP source.
+func (sh *SFTPHandler) GeneratePresignedURL(blob *models.SimpleBlob) (string, error) {
+	return "", errors.New("SFTP does not support presigned URLs")
+}
@@ -0,0 +1,403 @@
+package handlers
+
+import (
+	"azurecopy/azurecopy/models"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	sftpTestUsername = "azurecopy"
+	sftpTestPassword = "secret"
+)
+
+// sftpTestServer an in process ssh server running the sftp subsystem over the local filesystem.
+type sftpTestServer struct {
+	address  string
+	listener net.Listener
+
+	// the server's host key.
+	hostKey ssh.PublicKey
+
+	// key accepted for public key auth, and the file the private half is written to.
+	clientKeyFile string
+
+	// directory the tests work in. Absolute, with symlinks resolved.
+	dir string
+}
+
+func newTestSigner(t *testing.T) (ssh.Signer, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, key
+}
+
+func startSFTPTestServer(t *testing.T) *sftpTestServer {
+	if runtime.GOOS == "windows" {
+		t.Skip("sftp server paths are unix style")
+	}
+
+	dir, err := ioutil.TempDir("", "azurecopysftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostSigner, _ := newTestSigner(t)
+	clientSigner, clientKey := newTestSigner(t)
+
+	keyBytes, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ecdsa")
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == sftpTestUsername && string(password) == sftpTestPassword {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == sftpTestUsername && bytes.Equal(key.Marshal(), clientSigner.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTPConn(conn, config)
+		}
+	}()
+
+	return &sftpTestServer{
+		address:       listener.Addr().String(),
+		listener:      listener,
+		hostKey:       hostSigner.PublicKey(),
+		clientKeyFile: keyFile,
+		dir:           dir,
+	}
+}
+
+func serveSFTPConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "session only")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		go func() {
+			for req := range requests {
+				// payload is the length prefixed subsystem name.
+				req.Reply(req.Type == "subsystem" && string(req.Payload[4:]) == "sftp", nil)
+			}
+		}()
+
+		go func() {
+			defer channel.Close()
+			server, err := sftp.NewServer(channel)
+			if err != nil {
+				return
+			}
+			server.Serve()
+		}()
+	}
+}
+
+func (s *sftpTestServer) close() {
+	s.listener.Close()
+	os.RemoveAll(s.dir)
+}
+
+// knownHosts writes a known_hosts file for the server containing the given key.
+func (s *sftpTestServer) knownHosts(t *testing.T, key ssh.PublicKey) string {
+	knownHostsFile := filepath.Join(s.dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.address)}, key)
+	err := ioutil.WriteFile(knownHostsFile, []byte(line+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return knownHostsFile
+}
+
+func (s *sftpTestServer) newHandler(t *testing.T) *SFTPHandler {
+	credentials := SFTPCredentials{
+		Username:       sftpTestUsername,
+		Password:       sftpTestPassword,
+		KnownHostsFile: s.knownHosts(t, s.hostKey),
+	}
+
+	sh, err := NewSFTPHandler(s.address, credentials, true, false)
+	if err != nil {
+		t.Fatalf("unable to connect %s", err)
+	}
+	return sh
+}
+
+// writeTestFile creates the file (and its directory) under the server's directory.
+func (s *sftpTestServer) writeTestFile(t *testing.T, name string, contents string) {
+	fullPath := filepath.Join(s.dir, name)
+	err := os.MkdirAll(filepath.Dir(fullPath), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(fullPath, []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSFTPAuthentication(t *testing.T) {
+	s := startSFTPTestServer(t)
+	defer s.close()
+
+	knownHostsFile := s.knownHosts(t, s.hostKey)
+
+	testCases := []struct {
+		name        string
+		credentials SFTPCredentials
+		ok          bool
+	}{
+		{"password", SFTPCredentials{Username: sftpTestUsername, Password: sftpTestPassword}, true},
+		{"wrong password", SFTPCredentials{Username: sftpTestUsername, Password: "wrong"}, false},
+		{"private key", SFTPCredentials{Username: sftpTestUsername, PrivateKeyFile: s.clientKeyFile}, true},
+		{"wrong user", SFTPCredentials{Username: "someoneelse", PrivateKeyFile: s.clientKeyFile}, false},
+	}
+
+	for _, tc := range testCases {
+		tc.credentials.KnownHostsFile = knownHostsFile
+
+		sh, err := NewSFTPHandler(s.address, tc.credentials, true, false)
+		if tc.ok != (err == nil) {
+			t.Errorf("%s: expected ok %t, got error %v", tc.name, tc.ok, err)
+		}
+		if sh != nil {
+			sh.Close()
+		}
+	}
+}
+
+func TestSFTPKnownHostsRejectsWrongHostKey(t *testing.T) {
+	s := startSFTPTestServer(t)
+	defer s.close()
+
+	otherSigner, _ := newTestSigner(t)
+
+	credentials := SFTPCredentials{
+		Username:       sftpTestUsername,
+		Password:       sftpTestPassword,
+		KnownHostsFile: s.knownHosts(t, otherSigner.PublicKey()),
+	}
+
+	sh, err := NewSFTPHandler(s.address, credentials, true, false)
+	if err == nil {
+		sh.Close()
+		t.Fatal("connected to a server whose host key doesn't match known_hosts")
+	}
+}
+
+// blobPaths the paths (relative to the container) of every blob under the container.
+func blobPaths(container *models.SimpleContainer, prefix string) []string {
+	var paths []string
+	for _, b := range container.BlobSlice {
+		paths = append(paths, prefix+b.Name)
+	}
+	for _, c := range container.ContainerSlice {
+		paths = append(paths, blobPaths(c, prefix+c.Name+"/")...)
+	}
+	return paths
+}
+
+func TestSFTPRecursiveListing(t *testing.T) {
+	s := startSFTPTestServer(t)
+	defer s.close()
+
+	s.writeTestFile(t, "src/a.txt", "a")
+	s.writeTestFile(t, "src/sub/b.txt", "bb")
+	s.writeTestFile(t, "src/sub/deeper/c.txt", "ccc")
+
+	// symlinks to files are copied as the file, symlinks to directories are skipped.
+	err := os.Symlink(filepath.Join(s.dir, "src", "a.txt"), filepath.Join(s.dir, "src", "link.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(filepath.Join(s.dir, "src", "sub"), filepath.Join(s.dir, "src", "linkdir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sh := s.newHandler(t)
+	defer sh.Close()
+
+	container, err := sh.GetSpecificSimpleContainer("sftp://" + s.address + s.dir + "/src/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sh.GetContainerContents(container)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := blobPaths(container, "")
+	sort.Strings(paths)
+
+	expected := []string{"a.txt", "link.txt", "sub/b.txt", "sub/deeper/c.txt"}
+	if strings.Join(paths, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected %v, got %v", expected, paths)
+	}
+
+	for _, b := range container.BlobSlice {
+		if b.Name == "link.txt" && b.Properties.Size != 1 {
+			t.Errorf("expected symlink to have the size of its target, got %d", b.Properties.Size)
+		}
+	}
+}
+
+func TestSFTPWriteBlobFromReaderCreatesDirectories(t *testing.T) {
+	s := startSFTPTestServer(t)
+	defer s.close()
+
+	sh := s.newHandler(t)
+	defer sh.Close()
+
+	container, err := sh.GetSpecificSimpleContainer("sftp://" + s.address + s.dir + "/dest/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob := models.SimpleBlob{Name: "one/two/file.txt"}
+	contents := "written over sftp"
+	err = sh.WriteBlobFromReader(container, &blob, strings.NewReader(contents), int64(len(contents)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := ioutil.ReadFile(filepath.Join(s.dir, "dest", "one", "two", "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(written) != contents {
+		t.Errorf("expected %q, got %q", contents, written)
+	}
+}
+
+func TestSFTPBlobExists(t *testing.T) {
+	s := startSFTPTestServer(t)
+	defer s.close()
+
+	s.writeTestFile(t, "exists/file.txt", "x")
+	s.writeTestFile(t, "exists/dir/other.txt", "y")
+
+	sh := s.newHandler(t)
+	defer sh.Close()
+
+	container, err := sh.GetSpecificSimpleContainer("sftp://" + s.address + s.dir + "/exists/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		blobName string
+		exists   bool
+	}{
+		{"file.txt", true},
+		{"dir", false},
+		{"missing.txt", false},
+		{"dir/other.txt", true},
+	}
+
+	for _, tc := range testCases {
+		exists, err := sh.BlobExists(*container, tc.blobName)
+		if err != nil {
+			t.Errorf("%s: %s", tc.blobName, err)
+			continue
+		}
+		if exists != tc.exists {
+			t.Errorf("%s: expected exists %t, got %t", tc.blobName, tc.exists, exists)
+		}
+	}
+}
+
+func TestSFTPGetContainer(t *testing.T) {
+	s := startSFTPTestServer(t)
+	defer s.close()
+
+	s.writeTestFile(t, "getc/a.txt", "a")
+	s.writeTestFile(t, "getc/sub/b.txt", "b")
+
+	sh := s.newHandler(t)
+	defer sh.Close()
+
+	container := sh.GetContainer(s.dir + "/getc")
+	if container.Name != "getc" {
+		t.Errorf("expected container getc, got %q", container.Name)
+	}
+
+	paths := blobPaths(&container, "")
+	sort.Strings(paths)
+	expected := []string{"a.txt", "sub/b.txt"}
+	if strings.Join(paths, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, paths)
+	}
+
+	missing := sh.GetContainer(s.dir + "/missing")
+	if missing.Name != "" || len(missing.BlobSlice) != 0 {
+		t.Errorf("expected an empty container for a missing directory, got %q", missing.Name)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package handlers
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner gets the uid and gid of the file. ok is false if the platform doesn't have them.
+func fileOwner(fi os.FileInfo) (uid int, gid int, ok bool) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
+
+// setFileOwner sets the uid and gid of the file (or link, not its target).
+func setFileOwner(fullPath string, uid int, gid int) error {
+	return os.Lchown(fullPath, uid, gid)
+}
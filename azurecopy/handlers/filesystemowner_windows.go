@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package handlers
+
+import (
+	"os"
+)
+
+// fileOwner Windows has no uid/gid.
+func fileOwner(fi os.FileInfo) (uid int, gid int, ok bool) {
+	return 0, 0, false
+}
+
+// setFileOwner Windows has no uid/gid, so there's nothing to restore.
+func setFileOwner(fullPath string, uid int, gid int) error {
+	return nil
+}
@@ -0,0 +1,211 @@
+package azurecopy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// BlobState is the state of a blob within a copy job.
+type BlobState string
+
+const (
+	// BlobPending queued for copying.
+	BlobPending BlobState = "pending"
+
+	// BlobInProgress being copied. If the job dies, blobs will be left in this state.
+	BlobInProgress BlobState = "in-progress"
+
+	// BlobDone copied successfully.
+	BlobDone BlobState = "done"
+
+	// BlobFailed copy failed.
+	BlobFailed BlobState = "failed"
+)
+
+// journalHeader is the first line of the journal, identifying the job.
+type journalHeader struct {
+	SourceURL string `json:"sourceURL"`
+	DestURL   string `json:"destURL"`
+}
+
+// journalEntry records a blob changing state.
+type journalEntry struct {
+	DestName  string    `json:"destName"`
+	SourceURL string    `json:"sourceURL,omitempty"`
+	State     BlobState `json:"state"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Journal records the state of each blob in a copy job on disk, so a job that dies part way can be resumed.
+// The journal is append only (one JSON entry per line) so whatever was written before a crash is still readable.
+// When read back the last entry for a blob wins.
+type Journal struct {
+	file *os.File
+
+	// current state of each blob, keyed on destination name.
+	states map[string]BlobState
+
+	lock sync.Mutex
+}
+
+// NewJournal creates a new journal for a job, replacing any existing journal at path.
+func NewJournal(path string, sourceURL string, destURL string) (*Journal, error) {
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		log.Errorf("Unable to create journal %s %s", path, err)
+		return nil, err
+	}
+
+	j := Journal{}
+	j.file = f
+	j.states = make(map[string]BlobState)
+
+	err = j.writeLine(journalHeader{SourceURL: sourceURL, DestURL: destURL})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &j, nil
+}
+
+// OpenJournal reads an existing journal so the job can be resumed. New entries are appended to it.
+// The journal must have been written by a job with the same source and destination.
+func OpenJournal(path string, sourceURL string, destURL string) (*Journal, error) {
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		log.Errorf("Unable to open journal %s %s", path, err)
+		return nil, err
+	}
+
+	j := Journal{}
+	j.file = f
+	j.states = make(map[string]BlobState)
+
+	err = j.load(sourceURL, destURL)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	err = j.terminateLastLine()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &j, nil
+}
+
+// terminateLastLine ends a partially written last line, so the next entry isn't appended to it.
+func (j *Journal) terminateLastLine() error {
+
+	info, err := j.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	last := make([]byte, 1)
+	_, err = j.file.ReadAt(last, info.Size()-1)
+	if err != nil {
+		return err
+	}
+
+	if last[0] != '\n' {
+		_, err = j.file.Write([]byte("\n"))
+	}
+	return err
+}
+
+// load reads the existing entries.
+func (j *Journal) load(sourceURL string, destURL string) error {
+
+	scanner := bufio.NewScanner(j.file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	if !scanner.Scan() {
+		if scanner.Err() != nil {
+			return scanner.Err()
+		}
+		return errors.New("Journal is empty")
+	}
+
+	header := journalHeader{}
+	err := json.Unmarshal(scanner.Bytes(), &header)
+	if err != nil {
+		return fmt.Errorf("Journal header is invalid: %s", err)
+	}
+
+	if header.SourceURL != sourceURL || header.DestURL != destURL {
+		return fmt.Errorf("Journal is for copying %s to %s", header.SourceURL, header.DestURL)
+	}
+
+	for scanner.Scan() {
+		entry := journalEntry{}
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			// last line may have been partially written when the job died.
+			log.Debugf("skipping invalid journal entry %s", err)
+			continue
+		}
+
+		j.states[entry.DestName] = entry.State
+	}
+
+	return scanner.Err()
+}
+
+// State returns the state of a blob. Blobs not in the journal are pending.
+func (j *Journal) State(destName string) BlobState {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	state, ok := j.states[destName]
+	if !ok {
+		return BlobPending
+	}
+	return state
+}
+
+// SetState records the new state of a blob. err is recorded for failures.
+func (j *Journal) SetState(destName string, sourceURL string, state BlobState, err error) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	entry := journalEntry{DestName: destName, SourceURL: sourceURL, State: state}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	j.states[destName] = state
+	return j.writeLine(entry)
+}
+
+// Close closes the journal file.
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
+
+// writeLine appends a single JSON line. Not buffered, so entries survive the process dying.
+func (j *Journal) writeLine(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = j.file.Write(append(b, '\n'))
+	if err != nil {
+		log.Errorf("Unable to write journal entry %s", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,226 @@
+package azurecopy
+
+import (
+	"azurecopy/azurecopy/models"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	journalTestSource = "https://myacct.blob.core.windows.net/source/"
+	journalTestDest   = "s3://mybucket/dest/"
+)
+
+// newTestJournalPath returns the path for a journal in a new temp directory, and a func to remove it.
+func newTestJournalPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "azurecopyjournal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "job.journal"), func() { os.RemoveAll(dir) }
+}
+
+// writeTestJournal records a blob in each state, as a job that died part way would have.
+func writeTestJournal(t *testing.T, path string) {
+	j, err := NewJournal(path, journalTestSource, journalTestDest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"pending.txt", "inprogress.txt", "done.txt", "failed.txt", "retried.txt"} {
+		j.SetState(name, journalTestSource+name, BlobPending, nil)
+	}
+
+	j.SetState("inprogress.txt", journalTestSource+"inprogress.txt", BlobInProgress, nil)
+	j.SetState("done.txt", journalTestSource+"done.txt", BlobInProgress, nil)
+	j.SetState("done.txt", journalTestSource+"done.txt", BlobDone, nil)
+	j.SetState("failed.txt", journalTestSource+"failed.txt", BlobFailed, errors.New("connection reset"))
+
+	// failed then succeeded on a retry, the last entry wins.
+	j.SetState("retried.txt", journalTestSource+"retried.txt", BlobFailed, errors.New("timeout"))
+	j.SetState("retried.txt", journalTestSource+"retried.txt", BlobDone, nil)
+
+	err = j.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJournalReopen(t *testing.T) {
+	path, cleanup := newTestJournalPath(t)
+	defer cleanup()
+
+	writeTestJournal(t, path)
+
+	// the job died part way through writing a line.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"destName":"partial.txt","sta`)
+	f.Close()
+
+	j, err := OpenJournal(path, journalTestSource, journalTestDest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		destName string
+		state    BlobState
+	}{
+		{"pending.txt", BlobPending},
+		{"inprogress.txt", BlobInProgress},
+		{"done.txt", BlobDone},
+		{"failed.txt", BlobFailed},
+		{"retried.txt", BlobDone},
+		{"partial.txt", BlobPending},
+		{"new.txt", BlobPending},
+	}
+
+	for _, tc := range testCases {
+		if state := j.State(tc.destName); state != tc.state {
+			t.Errorf("%s: expected %s, got %s", tc.destName, tc.state, state)
+		}
+	}
+
+	// entries written after the partial line survive the next resume.
+	j.SetState("pending.txt", journalTestSource+"pending.txt", BlobDone, nil)
+	err = j.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err = OpenJournal(path, journalTestSource, journalTestDest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	if state := j.State("pending.txt"); state != BlobDone {
+		t.Errorf("expected entry written after resuming to be done, got %s", state)
+	}
+	if state := j.State("done.txt"); state != BlobDone {
+		t.Errorf("expected earlier entries to be kept, got %s", state)
+	}
+}
+
+func TestJournalResumeSkipsDoneBlobs(t *testing.T) {
+	path, cleanup := newTestJournalPath(t)
+	defer cleanup()
+
+	writeTestJournal(t, path)
+
+	j, err := OpenJournal(path, journalTestSource, journalTestDest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ac := AzureCopy{journal: j, pool: newCopyPool(2)}
+	result := ac.newCopyResult()
+
+	var lock sync.Mutex
+	copied := []string{}
+	ac.pool.Start(func(blob models.SimpleBlob) {
+		lock.Lock()
+		defer lock.Unlock()
+		copied = append(copied, blob.DestName)
+	})
+
+	for _, name := range []string{"pending.txt", "inprogress.txt", "done.txt", "failed.txt", "retried.txt", "new.txt"} {
+		ac.submitBlob(models.SimpleBlob{DestName: name, URL: journalTestSource + name}, result)
+	}
+	ac.pool.Wait()
+
+	sort.Strings(copied)
+	expected := []string{"failed.txt", "inprogress.txt", "new.txt", "pending.txt"}
+	if strings.Join(copied, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v to be copied, got %v", expected, copied)
+	}
+
+	skipped := []string{}
+	for _, r := range result.Skipped {
+		skipped = append(skipped, r.DestName)
+	}
+	sort.Strings(skipped)
+	expected = []string{"done.txt", "retried.txt"}
+	if strings.Join(skipped, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v to be skipped, got %v", expected, skipped)
+	}
+
+	// blobs submitted again are pending until they're copied.
+	if state := j.State("failed.txt"); state != BlobPending {
+		t.Errorf("expected resubmitted failed blob to be pending, got %s", state)
+	}
+
+	result.AddSucceeded(journalTestSource+"failed.txt", "failed.txt")
+	err = ac.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// and the retry is recorded for the next resume.
+	j, err = OpenJournal(path, journalTestSource, journalTestDest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	if state := j.State("failed.txt"); state != BlobDone {
+		t.Errorf("expected retried blob to be done, got %s", state)
+	}
+}
+
+func TestJournalRejectsDifferentJob(t *testing.T) {
+	path, cleanup := newTestJournalPath(t)
+	defer cleanup()
+
+	writeTestJournal(t, path)
+
+	testCases := []struct {
+		name      string
+		sourceURL string
+		destURL   string
+	}{
+		{"different source", "https://myacct.blob.core.windows.net/other/", journalTestDest},
+		{"different destination", journalTestSource, "s3://mybucket/other/"},
+		{"swapped", journalTestDest, journalTestSource},
+	}
+
+	for _, tc := range testCases {
+		j, err := OpenJournal(path, tc.sourceURL, tc.destURL)
+		if err == nil {
+			j.Close()
+			t.Errorf("%s: expected journal to be rejected", tc.name)
+		}
+	}
+}
+
+func TestJournalInvalid(t *testing.T) {
+	path, cleanup := newTestJournalPath(t)
+	defer cleanup()
+
+	_, err := OpenJournal(path, journalTestSource, journalTestDest)
+	if err == nil {
+		t.Error("expected missing journal to be an error")
+	}
+
+	for _, contents := range []string{"", "not json\n"} {
+		err = ioutil.WriteFile(path, []byte(contents), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		j, err := OpenJournal(path, journalTestSource, journalTestDest)
+		if err == nil {
+			j.Close()
+			t.Errorf("expected journal %q to be rejected", contents)
+		}
+	}
+}
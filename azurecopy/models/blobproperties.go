@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+// BlobProperties are the (mostly HTTP) properties and user metadata of a blob.
+// Handlers populate whatever their cloud exposes when listing or reading a blob and write whatever
+// the destination cloud can store. Anything the destination can't store is dropped.
+type BlobProperties struct {
+
+	// size in bytes.
+	Size int64
+
+	LastModified time.Time
+
+	ContentType        string
+	ContentEncoding    string
+	ContentLanguage    string
+	ContentDisposition string
+	CacheControl       string
+
+	// raw MD5 (not base64 or hex encoded) of the content. nil if unknown.
+	ContentMD5 []byte
+
+	// Azure blob type (BlockBlob, PageBlob or AppendBlob). Empty for clouds that only have one type.
+	BlobType string
+
+	// ETag as given by the source cloud. Only meaningful when compared against the same cloud.
+	ETag string
+
+	// user defined metadata. Keys are lower case and never include a cloud specific
+	// prefix (eg. x-amz-meta-).
+	Metadata map[string]string
+}
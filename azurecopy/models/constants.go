@@ -10,4 +10,6 @@ const (
 	OneDrive
 	Filesystem
 	FTP
+	AzureFile
+	SFTP
 )
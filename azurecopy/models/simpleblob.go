@@ -1,5 +1,7 @@
 package models
 
+import "time"
+
 // SimpleBlob is AzureCopy's cloud agnostic version of a blob
 // Although real clouds (Azure/S3 etc) allow blob names to simulate virtual directories
 // ie blob name can be "vdir1/vdir2/myblob" we will only store the "file" part of the URL.
@@ -35,4 +37,10 @@ type SimpleBlob struct {
 
 	// parent.
 	ParentContainer *SimpleContainer
+
+	// when this is a snapshot of the blob (Azure only). Zero for the blob itself.
+	Snapshot time.Time
+
+	// size, timestamps, content type, user metadata etc.
+	Properties BlobProperties
 }
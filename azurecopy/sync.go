@@ -0,0 +1,352 @@
+package azurecopy
+
+import (
+	"azurecopy/azurecopy/handlers"
+	"azurecopy/azurecopy/models"
+	"azurecopy/azurecopy/utils/misc"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// SyncPlan is what a sync decided to do with each source blob, keyed by the blob name relative to the
+// source/destination URLs.
+type SyncPlan struct {
+
+	// blobs missing from the destination.
+	New []string
+
+	// blobs that exist at the destination but differ.
+	Changed []string
+
+	// blobs that are the same at both ends, so not copied.
+	Unchanged []string
+
+	// blobs at the destination that aren't at the source. Only deleted when mirroring.
+	Delete []string
+
+	// number of blobs found at the destination.
+	destCount int
+}
+
+// NewSyncPlan factory time!
+func NewSyncPlan() *SyncPlan {
+	sp := SyncPlan{}
+	sp.New = []string{}
+	sp.Changed = []string{}
+	sp.Unchanged = []string{}
+	sp.Delete = []string{}
+	return &sp
+}
+
+// DisplaySummary prints what the sync decided to copy (and delete).
+func (sp *SyncPlan) DisplaySummary() {
+	fmt.Printf("Sync plan: New: %d Changed: %d Unchanged: %d Delete: %d\n", len(sp.New), len(sp.Changed), len(sp.Unchanged), len(sp.Delete))
+
+	for _, name := range sp.New {
+		fmt.Printf("NEW %s\n", name)
+	}
+
+	for _, name := range sp.Changed {
+		fmt.Printf("CHANGED %s\n", name)
+	}
+
+	for _, name := range sp.Delete {
+		fmt.Printf("DELETE %s\n", name)
+	}
+}
+
+// syncState tracks both listings while they're streaming in.
+// Source blobs that haven't (yet) been seen at the destination are held as pending until either
+// the destination blob turns up or the destination listing finishes.
+type syncState struct {
+
+	// destination blobs not yet matched to a source blob.
+	destBlobs map[string]models.SimpleBlob
+
+	// source blobs waiting for the destination listing.
+	pendingBlobs map[string]models.SimpleBlob
+
+	// destination listing has finished.
+	destListed bool
+
+	// set if the destination listing failed. Unmatched source blobs can't be decided.
+	destErr error
+
+	// only work out the plan, don't copy anything.
+	dryRun bool
+}
+
+// SyncByURL copies blobs from the source URL to the destination URL, but only those that are missing
+// at the destination or differ from it.
+// Both listings are streamed and compared as they arrive, so copying starts before either listing has finished.
+// Blobs are compared by MD5 when both sides know it, otherwise by size and last modified time.
+// If dryRun is set, only the plan is generated.
+func (ac *AzureCopy) SyncByURL(useCopyBlobFlag bool, dryRun bool) (*SyncPlan, *CopyResult, error) {
+	plan, result, _, err := ac.syncByURL(useCopyBlobFlag, dryRun)
+	return plan, result, err
+}
+
+// MirrorByURL syncs the source URL to the destination URL then deletes any destination blobs that
+// aren't at the source, so the destination matches the source exactly.
+// As a safety net, nothing is deleted if more than deleteThreshold percent of the destination blobs would be removed.
+// If dryRun is set, only the plan (including the deletions) is generated.
+func (ac *AzureCopy) MirrorByURL(useCopyBlobFlag bool, deleteThreshold uint, dryRun bool) (*SyncPlan, *CopyResult, error) {
+
+	plan, result, destContainer, err := ac.syncByURL(useCopyBlobFlag, dryRun)
+	if err != nil {
+		// without complete listings we can't tell what is extraneous.
+		return plan, result, err
+	}
+
+	if uint(len(plan.Delete))*100 > deleteThreshold*uint(plan.destCount) {
+		return plan, result, fmt.Errorf("Mirror would delete %d of %d destination blobs, more than the %d%% threshold. Nothing deleted",
+			len(plan.Delete), plan.destCount, deleteThreshold)
+	}
+
+	if dryRun {
+		return plan, result, nil
+	}
+
+	for _, name := range plan.Delete {
+		log.Debugf("Mirror deleting %s", name)
+		err := ac.destHandler.DeleteBlob(destContainer, name)
+		if err != nil {
+			log.Errorf("Unable to delete %s : %s", name, err)
+			result.AddFailed("", name, err)
+			continue
+		}
+
+		result.AddDeleted(name)
+	}
+
+	return plan, result, nil
+}
+
+// syncByURL does the actual syncing for SyncByURL and MirrorByURL. The destination container is
+// returned so extraneous blobs can then be deleted from it.
+func (ac *AzureCopy) syncByURL(useCopyBlobFlag bool, dryRun bool) (*SyncPlan, *CopyResult, *models.SimpleContainer, error) {
+
+	log.Debugf("syncByURL %s to %s", ac.sourceURL, ac.destURL)
+
+	if misc.GetLastChar(ac.sourceURL) != "/" && misc.GetLastChar(ac.sourceURL) != "\\" {
+		return nil, nil, nil, errors.New("Sync source must be a container (end with /)")
+	}
+
+	if _, ok := ac.destHandler.(handlers.ServerSideCopyHandler); useCopyBlobFlag && !ok {
+		return nil, nil, nil, errors.New("CopyBlob flag can only be used with an Azure blob or file destination")
+	}
+
+	sourceContainer, err := ac.sourceHandler.GetSpecificSimpleContainer(ac.sourceURL)
+	if err != nil {
+		log.Errorf("SyncByURL failed source: %s", err)
+		return nil, nil, nil, err
+	}
+
+	destContainer, err := ac.destHandler.GetSpecificSimpleContainer(ac.destURL)
+	if err != nil {
+		log.Errorf("SyncByURL failed dest: %s", err)
+		return nil, nil, nil, err
+	}
+
+	plan := NewSyncPlan()
+	result := ac.newCopyResult()
+
+	state := syncState{}
+	state.destBlobs = make(map[string]models.SimpleBlob)
+	state.pendingBlobs = make(map[string]models.SimpleBlob)
+	state.dryRun = dryRun
+
+	// blobs are only submitted when they need copying, so always replace.
+	ac.startCopyPool(destContainer, true, useCopyBlobFlag, result)
+
+	// handlers close the channels when done, regardless of error.
+	sourceChannel := make(chan models.SimpleContainer, 10)
+	destChannel := make(chan models.SimpleContainer, 10)
+	sourceErrChannel := make(chan error, 1)
+	destErrChannel := make(chan error, 1)
+
+	// both sides are filtered, so blobs excluded at the destination are never deleted. Only the paths of
+	// destination blobs are filtered, their sizes/timestamps aren't the source ones.
+	sourceListContainer, sourcePrefix := ac.pushDownListingPrefix(sourceContainer, ac.sourceCloudType)
+	destListContainer, destPrefix := ac.pushDownListingPrefix(destContainer, ac.destCloudType)
+
+	go func() {
+		sourceErrChannel <- ac.sourceHandler.GetContainerContentsOverChannel(*sourceListContainer, sourceChannel)
+	}()
+
+	go func() {
+		destErrChannel <- ac.destHandler.GetContainerContentsOverChannel(*destListContainer, destChannel)
+	}()
+
+	// nil channels are never selected, so each is set to nil when closed.
+	for sourceChannel != nil || destChannel != nil {
+		select {
+		case containerDetails, ok := <-sourceChannel:
+			if !ok {
+				sourceChannel = nil
+				continue
+			}
+
+			visitBlobs(&containerDetails, sourcePrefix, func(blob *models.SimpleBlob) {
+				if ac.filter.Matches(blob.DestName, blob.Properties) {
+					ac.syncSourceBlob(&state, *blob, plan, result)
+				}
+			})
+
+		case containerDetails, ok := <-destChannel:
+			if !ok {
+				destChannel = nil
+				ac.finishDestListing(&state, <-destErrChannel, plan, result)
+				continue
+			}
+
+			visitBlobs(&containerDetails, destPrefix, func(blob *models.SimpleBlob) {
+				if ac.filter.MatchesPath(blob.DestName) {
+					ac.syncDestBlob(&state, *blob, plan, result)
+				}
+			})
+		}
+	}
+
+	// wait for all copying to be done.
+	ac.pool.Wait()
+
+	sourceErr := <-sourceErrChannel
+	if sourceErr != nil {
+		log.Errorf("SyncByURL source listing failed %s", sourceErr)
+		return plan, result, destContainer, sourceErr
+	}
+
+	if state.destErr != nil {
+		return plan, result, destContainer, state.destErr
+	}
+
+	// whatever is left at the destination wasn't at the source.
+	for name := range state.destBlobs {
+		plan.Delete = append(plan.Delete, name)
+	}
+	sort.Strings(plan.Delete)
+
+	return plan, result, destContainer, nil
+}
+
+// syncSourceBlob decides what to do with a source blob, or holds onto it until we know.
+func (ac *AzureCopy) syncSourceBlob(state *syncState, blob models.SimpleBlob, plan *SyncPlan, result *CopyResult) {
+
+	destBlob, ok := state.destBlobs[blob.DestName]
+	if ok {
+		delete(state.destBlobs, blob.DestName)
+		ac.syncCompare(state, blob, destBlob, plan, result)
+		return
+	}
+
+	if !state.destListed {
+		state.pendingBlobs[blob.DestName] = blob
+		return
+	}
+
+	ac.syncMissingBlob(state, blob, plan, result)
+}
+
+// syncDestBlob matches a destination blob against a pending source blob, or remembers it for when
+// the source blob turns up.
+func (ac *AzureCopy) syncDestBlob(state *syncState, blob models.SimpleBlob, plan *SyncPlan, result *CopyResult) {
+
+	plan.destCount++
+
+	sourceBlob, ok := state.pendingBlobs[blob.DestName]
+	if ok {
+		delete(state.pendingBlobs, blob.DestName)
+		ac.syncCompare(state, sourceBlob, blob, plan, result)
+		return
+	}
+
+	state.destBlobs[blob.DestName] = blob
+}
+
+// finishDestListing deals with all the source blobs that never turned up at the destination.
+func (ac *AzureCopy) finishDestListing(state *syncState, destErr error, plan *SyncPlan, result *CopyResult) {
+
+	state.destListed = true
+	state.destErr = destErr
+	if destErr != nil {
+		log.Errorf("SyncByURL destination listing failed %s", destErr)
+	}
+
+	for name, blob := range state.pendingBlobs {
+		delete(state.pendingBlobs, name)
+		ac.syncMissingBlob(state, blob, plan, result)
+	}
+}
+
+// syncMissingBlob copies a source blob that isn't at the destination. If the destination couldn't be listed
+// we don't know that, so it is recorded as failed.
+func (ac *AzureCopy) syncMissingBlob(state *syncState, blob models.SimpleBlob, plan *SyncPlan, result *CopyResult) {
+
+	if state.destErr != nil {
+		result.AddFailed(blob.URL, blob.DestName, fmt.Errorf("unable to list destination: %s", state.destErr))
+		return
+	}
+
+	plan.New = append(plan.New, blob.DestName)
+	if !state.dryRun {
+		ac.submitBlob(blob, result)
+	}
+}
+
+// syncCompare copies the source blob if it differs from the destination blob.
+func (ac *AzureCopy) syncCompare(state *syncState, sourceBlob models.SimpleBlob, destBlob models.SimpleBlob, plan *SyncPlan, result *CopyResult) {
+
+	if !ac.blobChanged(sourceBlob.Properties, destBlob.Properties) {
+		log.Debugf("%s unchanged", sourceBlob.DestName)
+		plan.Unchanged = append(plan.Unchanged, sourceBlob.DestName)
+		return
+	}
+
+	plan.Changed = append(plan.Changed, sourceBlob.DestName)
+	if !state.dryRun {
+		ac.submitBlob(sourceBlob, result)
+	}
+}
+
+// blobChanged compares the properties of the source and destination blobs.
+// If both sides know the content hash, that's all that is compared. Otherwise the blob has changed if the size
+// differs or the source was modified after the destination was written.
+func (ac *AzureCopy) blobChanged(source models.BlobProperties, dest models.BlobProperties) bool {
+
+	sourceHash := contentHash(source, ac.sourceCloudType)
+	destHash := contentHash(dest, ac.destCloudType)
+	if sourceHash != "" && destHash != "" {
+		return sourceHash != destHash
+	}
+
+	if source.Size != dest.Size {
+		return true
+	}
+
+	if !source.LastModified.IsZero() && !dest.LastModified.IsZero() {
+		return source.LastModified.After(dest.LastModified)
+	}
+
+	return false
+}
+
+// contentHash returns the hex MD5 of the content if known.
+// S3 ETags are the MD5 of the content, unless the object was uploaded in parts (in which case they contain a -).
+// Other clouds ETags are just versions, so can't be compared between blobs.
+func contentHash(properties models.BlobProperties, cloudType models.CloudType) string {
+	if len(properties.ContentMD5) > 0 {
+		return hex.EncodeToString(properties.ContentMD5)
+	}
+
+	if cloudType == models.S3 && properties.ETag != "" && !strings.Contains(properties.ETag, "-") {
+		return strings.ToLower(properties.ETag)
+	}
+
+	return ""
+}
@@ -0,0 +1,95 @@
+package azurecopy
+
+import (
+	"azurecopy/azurecopy/models"
+	"crypto/md5"
+	"testing"
+	"time"
+)
+
+func TestContentHash(t *testing.T) {
+
+	sum := md5.Sum([]byte("hello"))
+
+	testCases := []struct {
+		name       string
+		properties models.BlobProperties
+		cloudType  models.CloudType
+		hash       string
+	}{
+		{"MD5", models.BlobProperties{ContentMD5: sum[:]}, models.Azure, "5d41402abc4b2a76b9719d911017c592"},
+		{"MD5 preferred over ETag", models.BlobProperties{ContentMD5: sum[:], ETag: "ffff"}, models.S3, "5d41402abc4b2a76b9719d911017c592"},
+		{"S3 ETag", models.BlobProperties{ETag: "5D41402ABC4B2A76B9719D911017C592"}, models.S3, "5d41402abc4b2a76b9719d911017c592"},
+		{"S3 multipart ETag", models.BlobProperties{ETag: "9b2cf535f27731c974343645a3985328-3"}, models.S3, ""},
+		{"Azure ETag is a version", models.BlobProperties{ETag: "0x8D4BCC2E4835CD0"}, models.Azure, ""},
+		{"nothing known", models.BlobProperties{}, models.S3, ""},
+	}
+
+	for _, tc := range testCases {
+		if hash := contentHash(tc.properties, tc.cloudType); hash != tc.hash {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.hash, hash)
+		}
+	}
+}
+
+func TestBlobChanged(t *testing.T) {
+
+	older := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	sum := md5.Sum([]byte("hello"))
+	otherSum := md5.Sum([]byte("world"))
+
+	testCases := []struct {
+		name       string
+		sourceType models.CloudType
+		destType   models.CloudType
+		source     models.BlobProperties
+		dest       models.BlobProperties
+		changed    bool
+	}{
+		{"same size and time", models.Azure, models.Azure,
+			models.BlobProperties{Size: 5, LastModified: older}, models.BlobProperties{Size: 5, LastModified: older}, false},
+		{"size mismatch", models.Azure, models.Azure,
+			models.BlobProperties{Size: 5, LastModified: older}, models.BlobProperties{Size: 6, LastModified: newer}, true},
+		{"source modified later", models.Azure, models.Azure,
+			models.BlobProperties{Size: 5, LastModified: newer}, models.BlobProperties{Size: 5, LastModified: older}, true},
+		{"destination written later", models.Azure, models.Azure,
+			models.BlobProperties{Size: 5, LastModified: older}, models.BlobProperties{Size: 5, LastModified: newer}, false},
+		{"zero source time", models.Filesystem, models.Azure,
+			models.BlobProperties{Size: 5}, models.BlobProperties{Size: 5, LastModified: older}, false},
+		{"zero destination time", models.Azure, models.Filesystem,
+			models.BlobProperties{Size: 5, LastModified: newer}, models.BlobProperties{Size: 5}, false},
+		{"zero time size mismatch", models.Azure, models.Filesystem,
+			models.BlobProperties{Size: 5, LastModified: newer}, models.BlobProperties{Size: 4}, true},
+
+		{"MD5 match ignores time", models.Azure, models.Azure,
+			models.BlobProperties{Size: 5, LastModified: newer, ContentMD5: sum[:]},
+			models.BlobProperties{Size: 5, LastModified: older, ContentMD5: sum[:]}, false},
+		{"MD5 mismatch same size and time", models.Azure, models.Azure,
+			models.BlobProperties{Size: 5, LastModified: older, ContentMD5: sum[:]},
+			models.BlobProperties{Size: 5, LastModified: older, ContentMD5: otherSum[:]}, true},
+		{"MD5 against S3 ETag", models.Azure, models.S3,
+			models.BlobProperties{Size: 5, LastModified: newer, ContentMD5: sum[:]},
+			models.BlobProperties{Size: 5, LastModified: older, ETag: "5d41402abc4b2a76b9719d911017c592"}, false},
+		{"MD5 on one side only", models.Azure, models.Azure,
+			models.BlobProperties{Size: 5, LastModified: newer, ContentMD5: sum[:]},
+			models.BlobProperties{Size: 5, LastModified: older}, true},
+
+		{"S3 multipart ETag falls back to time", models.S3, models.Azure,
+			models.BlobProperties{Size: 5, LastModified: older, ETag: "9b2cf535f27731c974343645a3985328-3"},
+			models.BlobProperties{Size: 5, LastModified: newer, ContentMD5: otherSum[:]}, false},
+		{"S3 multipart ETags on both sides", models.S3, models.S3,
+			models.BlobProperties{Size: 5, LastModified: newer, ETag: "9b2cf535f27731c974343645a3985328-3"},
+			models.BlobProperties{Size: 5, LastModified: older, ETag: "9b2cf535f27731c974343645a3985328-3"}, true},
+		{"S3 single part ETags match", models.S3, models.S3,
+			models.BlobProperties{Size: 5, LastModified: newer, ETag: "5d41402abc4b2a76b9719d911017c592"},
+			models.BlobProperties{Size: 5, LastModified: older, ETag: "5d41402abc4b2a76b9719d911017c592"}, false},
+	}
+
+	for _, tc := range testCases {
+		ac := AzureCopy{sourceCloudType: tc.sourceType, destCloudType: tc.destType}
+		if changed := ac.blobChanged(tc.source, tc.dest); changed != tc.changed {
+			t.Errorf("%s: expected changed %t, got %t", tc.name, tc.changed, changed)
+		}
+	}
+}
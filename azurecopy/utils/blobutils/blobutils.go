@@ -20,16 +20,16 @@ func ReadBlob(reader io.ReadCloser, blob *models.SimpleBlob, cacheToDisk bool, c
 		cacheName := misc.GenerateCacheName(blob.BlobCloudName)
 		blob.DataCachedAtPath = cacheLocation + "/" + cacheName
 		log.Debugf("cache location is %s", blob.DataCachedAtPath)
-		cacheFile, err = os.OpenFile(blob.DataCachedAtPath, os.O_WRONLY|os.O_CREATE, 0666)
-		//defer cacheFile.Close()
-
+		cacheFile, err = os.OpenFile(blob.DataCachedAtPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 		if err != nil {
-			log.Fatalf("Populate blob %s", err)
+			log.Errorf("Populate blob %s", err)
 			return err
 		}
+		defer cacheFile.Close()
 	} else {
 		blob.DataInMemory = []byte{}
 	}
+	blob.BlobInMemory = !cacheToDisk
 
 	log.Debugf("cachefile early is %s", cacheFile)
 	// 100k buffer... way too small?
@@ -38,6 +38,9 @@ func ReadBlob(reader io.ReadCloser, blob *models.SimpleBlob, cacheToDisk bool, c
 	for finishedProcessing == false {
 		numBytesRead, err := reader.Read(buffer)
 		if err != nil {
+			if err != io.EOF {
+				return err
+			}
 			finishedProcessing = true
 		}
 
@@ -54,7 +57,7 @@ func ReadBlob(reader io.ReadCloser, blob *models.SimpleBlob, cacheToDisk bool, c
 			if err != nil {
 				log.Debugf("cachefile %s", cacheFile)
 
-				log.Fatalf("cache to disk fatal %s", err)
+				log.Errorf("cache to disk failed %s", err)
 				return err
 			}
 		} else {
@@ -0,0 +1,69 @@
+package blobutils
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Metadata mapping between clouds.
+//
+// Internally metadata keys are always lower case with no cloud specific prefix.
+//   S3    : x-amz-meta-<key>  <-> <key>   (prefix is added/removed by the SDK)
+//   Azure : x-ms-meta-<key>   <-> <key>   (keys must be valid C# identifiers, so anything else is replaced with _ when writing)
+//   Dropbox, Filesystem, FTP and SFTP have no user metadata, so it is dropped when writing to them.
+//   The Filesystem handler can keep file attributes in the metadata below though, so they survive a round trip through a cloud.
+
+// Metadata used by the Filesystem handler for file attributes. Valid Azure keys as is.
+const (
+	FileModeMetadataKey     = "azurecopy_mode"    // permission bits, octal. eg. 644
+	FileUIDMetadataKey      = "azurecopy_uid"     // owner user id.
+	FileGIDMetadataKey      = "azurecopy_gid"     // owner group id.
+	FileModifiedMetadataKey = "azurecopy_mtime"   // modified time, RFC3339 (nanoseconds). Clouds set their own last modified on upload.
+	SymlinkMetadataKey      = "azurecopy_symlink" // the blob is a symlink record, this is the link target (as is the content).
+)
+
+// NormaliseMetadata returns a copy of the metadata with lower case keys.
+func NormaliseMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	normalised := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		normalised[strings.ToLower(k)] = v
+	}
+	return normalised
+}
+
+// AzureMetadata converts metadata to keys Azure will accept.
+// If two keys map to the same Azure key, one of them wins. Which one is undefined.
+func AzureMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	azureMetadata := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		azureMetadata[AzureMetadataKey(k)] = v
+	}
+	return azureMetadata
+}
+
+// AzureMetadataKey converts a key to a valid C# identifier, which is what Azure requires.
+// eg. "content-origin" becomes "content_origin" and "2fa" becomes "_2fa"
+func AzureMetadataKey(key string) string {
+	key = strings.ToLower(key)
+
+	mapped := strings.Map(func(r rune) rune {
+		if r == '_' || (r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r))) {
+			return r
+		}
+		return '_'
+	}, key)
+
+	if mapped == "" || unicode.IsDigit(rune(mapped[0])) {
+		mapped = "_" + mapped
+	}
+
+	return mapped
+}
@@ -0,0 +1,335 @@
+package filterutils
+
+import (
+	"azurecopy/azurecopy/models"
+	"fmt"
+	"path"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"time"
+)
+
+// BlobFilter decides which blobs are listed/copied, based on the path of the blob relative to the
+// source URL (eg. vdir1/vdir2/myblob) and its properties.
+//
+// Glob patterns follow .gitignore conventions:
+//   - a pattern without a / (eg. *.parquet) matches the blob name at any depth.
+//   - a pattern with a / (eg. logs/*.parquet or /data) matches the whole relative path.
+//   - a pattern ending in / (eg. tmp/) matches everything in that directory.
+//   - ** matches any number of directories (eg. logs/**/*.parquet).
+//   - a pattern starting with ! negates an earlier pattern in the same list (eg. -exclude tmp/ -exclude !tmp/keep.txt).
+//     The last pattern that matches wins.
+//
+// Regexes are matched against the whole relative path (use ^ and $ to anchor).
+type BlobFilter struct {
+	include      []globPattern
+	exclude      []globPattern
+	includeRegex []*regexp.Regexp
+	excludeRegex []*regexp.Regexp
+
+	// 0 means no limit.
+	minSize int64
+	maxSize int64
+
+	// zero means no limit.
+	modifiedAfter  time.Time
+	modifiedBefore time.Time
+}
+
+type globPattern struct {
+	pattern string
+
+	// matches against the whole relative path, not just the name.
+	anchored bool
+
+	// matches a directory (and therefore everything in it).
+	directory bool
+
+	// started with !, a match un-matches earlier patterns.
+	negated bool
+}
+
+// NewBlobFilter factory time!
+// Returns an error if any of the patterns are invalid.
+func NewBlobFilter(include []string, exclude []string, includeRegex []string, excludeRegex []string,
+	minSize int64, maxSize int64, modifiedAfter time.Time, modifiedBefore time.Time) (*BlobFilter, error) {
+
+	var err error
+	bf := BlobFilter{}
+	bf.minSize = minSize
+	bf.maxSize = maxSize
+	bf.modifiedAfter = modifiedAfter
+	bf.modifiedBefore = modifiedBefore
+
+	bf.include, err = newGlobPatterns(include)
+	if err != nil {
+		return nil, err
+	}
+
+	bf.exclude, err = newGlobPatterns(exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	bf.includeRegex, err = compileRegexes(includeRegex)
+	if err != nil {
+		return nil, err
+	}
+
+	bf.excludeRegex, err = compileRegexes(excludeRegex)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bf, nil
+}
+
+func newGlobPatterns(patterns []string) ([]globPattern, error) {
+	globs := []globPattern{}
+	for _, p := range patterns {
+		g := globPattern{}
+		g.negated = strings.HasPrefix(p, "!")
+		g.directory = strings.HasSuffix(p, "/")
+		g.pattern = strings.TrimSuffix(strings.TrimPrefix(p, "!"), "/")
+		g.anchored = strings.Contains(g.pattern, "/")
+		g.pattern = strings.TrimPrefix(g.pattern, "/")
+
+		if _, err := path.Match(g.pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid pattern %s : %s", p, err)
+		}
+
+		globs = append(globs, g)
+	}
+
+	return globs, nil
+}
+
+func compileRegexes(patterns []string) ([]*regexp.Regexp, error) {
+	regexes := []*regexp.Regexp{}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regex %s : %s", p, err)
+		}
+		regexes = append(regexes, re)
+	}
+
+	return regexes, nil
+}
+
+// IsEmpty returns true if the filter lets everything through.
+func (bf *BlobFilter) IsEmpty() bool {
+	return len(bf.include) == 0 && len(bf.exclude) == 0 && len(bf.includeRegex) == 0 && len(bf.excludeRegex) == 0 &&
+		bf.minSize == 0 && bf.maxSize == 0 && bf.modifiedAfter.IsZero() && bf.modifiedBefore.IsZero()
+}
+
+// Matches returns true if the blob should be listed/copied.
+// If there are include patterns, the blob must match at least one of them. Excludes win over includes.
+// Blobs with an unknown modified time never pass a modified time filter.
+func (bf *BlobFilter) Matches(relativePath string, properties models.BlobProperties) bool {
+
+	if !bf.MatchesPath(relativePath) {
+		return false
+	}
+
+	if bf.minSize > 0 && properties.Size < bf.minSize {
+		return false
+	}
+
+	if bf.maxSize > 0 && properties.Size > bf.maxSize {
+		return false
+	}
+
+	if !bf.modifiedAfter.IsZero() && (properties.LastModified.IsZero() || !properties.LastModified.After(bf.modifiedAfter)) {
+		return false
+	}
+
+	if !bf.modifiedBefore.IsZero() && (properties.LastModified.IsZero() || !properties.LastModified.Before(bf.modifiedBefore)) {
+		return false
+	}
+
+	return true
+}
+
+// MatchesPath checks just the include/exclude patterns. Used where the properties of the blob aren't
+// comparable with the source (eg. destination blobs when syncing).
+func (bf *BlobFilter) MatchesPath(relativePath string) bool {
+
+	if len(bf.include) > 0 || len(bf.includeRegex) > 0 {
+		if !matchesAnyGlob(bf.include, relativePath) && !matchesAnyRegex(bf.includeRegex, relativePath) {
+			return false
+		}
+	}
+
+	if matchesAnyGlob(bf.exclude, relativePath) || matchesAnyRegex(bf.excludeRegex, relativePath) {
+		return false
+	}
+
+	return true
+}
+
+// ListingPrefix returns the directory (eg. logs/2017/) that every included blob must be in.
+// This can be used as the listing prefix so the cloud doesn't enumerate blobs we'll never copy.
+// Returns "" if there isn't one.
+func (bf *BlobFilter) ListingPrefix() string {
+
+	if len(bf.include) == 0 && len(bf.includeRegex) == 0 {
+		return ""
+	}
+
+	prefixes := []string{}
+	for _, g := range bf.include {
+		// negated patterns only ever remove blobs.
+		if g.negated {
+			continue
+		}
+
+		if !g.anchored {
+			return ""
+		}
+
+		literal := literalPrefix(g.pattern)
+		if g.directory && literal == g.pattern {
+			literal = literal + "/"
+		}
+		prefixes = append(prefixes, literal)
+	}
+
+	for _, re := range bf.includeRegex {
+		literal, anchored := regexLiteralPrefix(re.String())
+
+		// unanchored regexes can match anywhere in the path.
+		if !anchored {
+			return ""
+		}
+		prefixes = append(prefixes, literal)
+	}
+
+	if len(prefixes) == 0 {
+		return ""
+	}
+
+	common := prefixes[0]
+	for _, p := range prefixes[1:] {
+		for !strings.HasPrefix(p, common) {
+			common = common[:len(common)-1]
+		}
+	}
+
+	// only whole directories.
+	return common[:strings.LastIndex(common, "/")+1]
+}
+
+// literalPrefix returns the start of the glob pattern before any special characters.
+func literalPrefix(pattern string) string {
+	i := strings.IndexAny(pattern, "*?[\\")
+	if i < 0 {
+		return pattern
+	}
+	return pattern[:i]
+}
+
+// regexLiteralPrefix returns the literal text straight after the ^ at the start of the regex.
+// anchored is false if the regex doesn't have to match at the start of the path (including alternations like ^a|b).
+func regexLiteralPrefix(expr string) (string, bool) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	re = re.Simplify()
+
+	if re.Op != syntax.OpConcat || len(re.Sub) == 0 || re.Sub[0].Op != syntax.OpBeginText {
+		return "", false
+	}
+
+	literal := ""
+	for _, sub := range re.Sub[1:] {
+		if sub.Op != syntax.OpLiteral || sub.Flags&syntax.FoldCase != 0 {
+			break
+		}
+		literal += string(sub.Rune)
+	}
+
+	return literal, true
+}
+
+// matchesAnyGlob returns true if the last of the patterns that matches isn't negated.
+func matchesAnyGlob(globs []globPattern, relativePath string) bool {
+	matched := false
+	for _, g := range globs {
+		if g.matches(relativePath) {
+			matched = !g.negated
+		}
+	}
+	return matched
+}
+
+func matchesAnyRegex(regexes []*regexp.Regexp, relativePath string) bool {
+	for _, re := range regexes {
+		if re.MatchString(relativePath) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches checks the pattern against the relative path of the blob.
+// Directory patterns are checked against every directory the blob is in.
+func (g globPattern) matches(relativePath string) bool {
+
+	if !g.directory {
+		return g.matchName(relativePath)
+	}
+
+	sp := strings.Split(relativePath, "/")
+	for i := 1; i < len(sp); i++ {
+		if g.matchName(strings.Join(sp[:i], "/")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchName matches the pattern against the whole path if anchored, otherwise just the last element.
+func (g globPattern) matchName(name string) bool {
+	if !g.anchored {
+		name = path.Base(name)
+	}
+
+	return matchSegments(strings.Split(g.pattern, "/"), strings.Split(name, "/"))
+}
+
+// matchSegments matches the pattern one directory at a time. ** matches any number (including none) of directories.
+func matchSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				return true
+			}
+
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+
+		match, _ := path.Match(pattern[0], name[0])
+		if !match {
+			return false
+		}
+
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+
+	return len(name) == 0
+}
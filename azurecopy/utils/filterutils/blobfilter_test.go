@@ -0,0 +1,163 @@
+package filterutils
+
+import (
+	"azurecopy/azurecopy/models"
+	"testing"
+	"time"
+)
+
+func TestBlobFilterPatterns(t *testing.T) {
+
+	testCases := []struct {
+		name         string
+		include      []string
+		exclude      []string
+		includeRegex []string
+		excludeRegex []string
+		path         string
+		matches      bool
+	}{
+		{"no filter", nil, nil, nil, nil, "a/b/c.txt", true},
+
+		{"name glob at the top", []string{"*.parquet"}, nil, nil, nil, "part1.parquet", true},
+		{"name glob at any depth", []string{"*.parquet"}, nil, nil, nil, "logs/2017/part1.parquet", true},
+		{"name glob no match", []string{"*.parquet"}, nil, nil, nil, "logs/2017/part1.csv", false},
+		{"anchored glob", []string{"logs/*.parquet"}, nil, nil, nil, "logs/part1.parquet", true},
+		{"anchored glob doesn't cross directories", []string{"logs/*.parquet"}, nil, nil, nil, "logs/2017/part1.parquet", false},
+		{"leading / anchors", []string{"/part1.parquet"}, nil, nil, nil, "data/part1.parquet", false},
+
+		{"directory excluded", nil, []string{"tmp/"}, nil, nil, "tmp/scratch.txt", false},
+		{"nested directory excluded", nil, []string{"tmp/"}, nil, nil, "data/tmp/a/scratch.txt", false},
+		{"file named like the directory", nil, []string{"tmp/"}, nil, nil, "data/tmp", true},
+		{"other directory", nil, []string{"tmp/"}, nil, nil, "tmpfiles/scratch.txt", true},
+
+		{"** any depth", []string{"logs/**/*.parquet"}, nil, nil, nil, "logs/2017/06/part1.parquet", true},
+		{"** no directories", []string{"logs/**/*.parquet"}, nil, nil, nil, "logs/part1.parquet", true},
+		{"** other directory", []string{"logs/**/*.parquet"}, nil, nil, nil, "data/2017/part1.parquet", false},
+		{"leading **", []string{"**/2017/*"}, nil, nil, nil, "logs/a/2017/part1", true},
+		{"trailing **", []string{"logs/**"}, nil, nil, nil, "logs/2017/06/part1", true},
+		{"** alone", []string{"**"}, nil, nil, nil, "a/b/c", true},
+
+		{"negated exclude", nil, []string{"tmp/", "!tmp/keep.txt"}, nil, nil, "tmp/keep.txt", true},
+		{"negated exclude other file", nil, []string{"tmp/", "!tmp/keep.txt"}, nil, nil, "tmp/scratch.txt", false},
+		{"negated exclude re-excluded", nil, []string{"*.txt", "!keep.txt", "old/"}, nil, nil, "old/keep.txt", false},
+		{"negated include", []string{"*.parquet", "!staging/"}, nil, nil, nil, "staging/part1.parquet", false},
+		{"negated include other directory", []string{"*.parquet", "!staging/"}, nil, nil, nil, "prod/part1.parquet", true},
+
+		{"include regex", nil, nil, []string{`^logs/20(17|18)/`}, nil, "logs/2018/a", true},
+		{"include regex no match", nil, nil, []string{`^logs/20(17|18)/`}, nil, "logs/2019/a", false},
+		{"include glob or regex", []string{"*.csv"}, nil, []string{`^logs/`}, nil, "data/a.csv", true},
+		{"exclude regex", nil, nil, nil, []string{`\.tmp$`}, "data/a.tmp", false},
+		{"exclude wins over include", []string{"*.csv"}, nil, nil, []string{`^tmp/`}, "tmp/a.csv", false},
+	}
+
+	for _, tc := range testCases {
+		bf, err := NewBlobFilter(tc.include, tc.exclude, tc.includeRegex, tc.excludeRegex, 0, 0, time.Time{}, time.Time{})
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+
+		if matches := bf.MatchesPath(tc.path); matches != tc.matches {
+			t.Errorf("%s: %s expected %t, got %t", tc.name, tc.path, tc.matches, matches)
+		}
+	}
+}
+
+func TestBlobFilterInvalidPatterns(t *testing.T) {
+	_, err := NewBlobFilter([]string{"[a-"}, nil, nil, nil, 0, 0, time.Time{}, time.Time{})
+	if err == nil {
+		t.Error("expected invalid glob to be rejected")
+	}
+
+	_, err = NewBlobFilter(nil, nil, nil, []string{"(unclosed"}, 0, 0, time.Time{}, time.Time{})
+	if err == nil {
+		t.Error("expected invalid regex to be rejected")
+	}
+}
+
+func TestBlobFilterListingPrefix(t *testing.T) {
+
+	testCases := []struct {
+		name         string
+		include      []string
+		includeRegex []string
+		prefix       string
+	}{
+		{"no includes", nil, nil, ""},
+		{"name glob", []string{"*.parquet"}, nil, ""},
+		{"anchored glob", []string{"logs/2017/*.parquet"}, nil, "logs/2017/"},
+		{"partial directory name", []string{"logs/20*/a"}, nil, "logs/"},
+		{"directory", []string{"logs/2017/"}, nil, "logs/2017/"},
+		{"common directory", []string{"logs/2017/*", "logs/2018/*"}, nil, "logs/"},
+		{"nothing in common", []string{"logs/*", "data/*"}, nil, ""},
+		{"** after a directory", []string{"logs/**/*.parquet"}, nil, "logs/"},
+		{"negated patterns don't widen", []string{"logs/2017/*", "!logs/2017/tmp/"}, nil, "logs/2017/"},
+		{"only negated", []string{"!tmp/"}, nil, ""},
+		{"anchored regex", nil, []string{`^logs/2017/.*\.parquet$`}, "logs/2017/"},
+		{"unanchored regex", nil, []string{`logs/2017/`}, ""},
+		{"regex alternation", nil, []string{`^(logs|data)/2017/`}, ""},
+		{"top level regex alternation", nil, []string{`^logs/2017/a|^data/`}, ""},
+		{"alternation after the directory", nil, []string{`^logs/(2017|2018)/`}, "logs/"},
+		{"case insensitive regex", nil, []string{`(?i)^logs/`}, ""},
+		{"glob and regex", []string{"logs/2017/*"}, []string{`^logs/2018/`}, "logs/"},
+	}
+
+	for _, tc := range testCases {
+		bf, err := NewBlobFilter(tc.include, nil, tc.includeRegex, nil, 0, 0, time.Time{}, time.Time{})
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+
+		if prefix := bf.ListingPrefix(); prefix != tc.prefix {
+			t.Errorf("%s: expected prefix %q, got %q", tc.name, tc.prefix, prefix)
+		}
+	}
+}
+
+func TestBlobFilterProperties(t *testing.T) {
+
+	modified := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name           string
+		minSize        int64
+		maxSize        int64
+		modifiedAfter  time.Time
+		modifiedBefore time.Time
+		properties     models.BlobProperties
+		matches        bool
+	}{
+		{"no limits", 0, 0, time.Time{}, time.Time{}, models.BlobProperties{Size: 10}, true},
+
+		{"below min size", 100, 0, time.Time{}, time.Time{}, models.BlobProperties{Size: 99}, false},
+		{"at min size", 100, 0, time.Time{}, time.Time{}, models.BlobProperties{Size: 100}, true},
+		{"at max size", 0, 100, time.Time{}, time.Time{}, models.BlobProperties{Size: 100}, true},
+		{"above max size", 0, 100, time.Time{}, time.Time{}, models.BlobProperties{Size: 101}, false},
+		{"between sizes", 10, 100, time.Time{}, time.Time{}, models.BlobProperties{Size: 50}, true},
+		{"empty blob with min size", 1, 0, time.Time{}, time.Time{}, models.BlobProperties{Size: 0}, false},
+
+		{"modified after", 0, 0, modified.Add(-time.Second), time.Time{}, models.BlobProperties{LastModified: modified}, true},
+		{"modified at after boundary", 0, 0, modified, time.Time{}, models.BlobProperties{LastModified: modified}, false},
+		{"modified before after", 0, 0, modified.Add(time.Second), time.Time{}, models.BlobProperties{LastModified: modified}, false},
+		{"modified before", 0, 0, time.Time{}, modified.Add(time.Second), models.BlobProperties{LastModified: modified}, true},
+		{"modified at before boundary", 0, 0, time.Time{}, modified, models.BlobProperties{LastModified: modified}, false},
+		{"modified after before", 0, 0, time.Time{}, modified.Add(-time.Second), models.BlobProperties{LastModified: modified}, false},
+		{"modified in range", 0, 0, modified.Add(-time.Hour), modified.Add(time.Hour), models.BlobProperties{LastModified: modified}, true},
+		{"unknown modified time after", 0, 0, modified, time.Time{}, models.BlobProperties{}, false},
+		{"unknown modified time before", 0, 0, time.Time{}, modified, models.BlobProperties{}, false},
+	}
+
+	for _, tc := range testCases {
+		bf, err := NewBlobFilter(nil, nil, nil, nil, tc.minSize, tc.maxSize, tc.modifiedAfter, tc.modifiedBefore)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+
+		if matches := bf.Matches("a/b.txt", tc.properties); matches != tc.matches {
+			t.Errorf("%s: expected %t, got %t", tc.name, tc.matches, matches)
+		}
+	}
+}
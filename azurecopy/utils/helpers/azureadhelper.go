@@ -0,0 +1,54 @@
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	azureADTokenURL     = "https://login.microsoftonline.com/%s/oauth2/v2.0/token"
+	azureStorageScope   = "https://storage.azure.com/.default"
+	azureADTokenTimeout = 30 * time.Second
+)
+
+type azureADTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// GetAzureADToken gets an OAuth bearer token for Azure Storage for a service principal (client credentials grant).
+// Returns the token and when it expires.
+func GetAzureADToken(tenantID string, clientID string, clientSecret string) (string, time.Time, error) {
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", clientID)
+	form.Set("client_secret", clientSecret)
+	form.Set("scope", azureStorageScope)
+
+	client := http.Client{Timeout: azureADTokenTimeout}
+	resp, err := client.PostForm(fmt.Sprintf(azureADTokenURL, url.PathEscape(tenantID)), form)
+	if err != nil {
+		log.Errorf("Unable to get Azure AD token %s", err)
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("Unable to get Azure AD token for client %s: %s", clientID, resp.Status)
+	}
+
+	tokenResponse := azureADTokenResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&tokenResponse)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiry := time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
+	return tokenResponse.AccessToken, expiry, nil
+}
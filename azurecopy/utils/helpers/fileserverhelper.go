@@ -0,0 +1,199 @@
+package helpers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// FileServer serves local files over HTTP via short lived, unguessable URLs.
+// Used so local files can be the source of an Azure CopyBlob operation.
+// The server is only started when the first file is added.
+type FileServer struct {
+
+	// URL the server is reachable at (by Azure). eg. http://myhost:8080
+	baseURL string
+
+	// address the server listens on. eg. 0.0.0.0:8080 when behind NAT/a proxy.
+	// Defaults to every interface on the port of the base URL.
+	listenAddress string
+
+	// token -> file being served.
+	files     map[string]servedFile
+	filesLock sync.Mutex
+
+	startOnce sync.Once
+	startErr  error
+
+	server *http.Server
+	closed bool
+}
+
+type servedFile struct {
+	path   string
+	expiry time.Time
+}
+
+// NewFileServer factory time!
+// listenAddress can be empty, see FileServer.
+func NewFileServer(baseURL string, listenAddress string) *FileServer {
+	fs := new(FileServer)
+	fs.baseURL = strings.TrimSuffix(baseURL, "/")
+	fs.listenAddress = listenAddress
+	fs.files = make(map[string]servedFile)
+	return fs
+}
+
+// AddFile makes the file available for the duration of expiry and returns the URL it can be retrieved from.
+func (fs *FileServer) AddFile(path string, expiry time.Duration) (string, error) {
+
+	if fs.baseURL == "" {
+		return "", errors.New("No URL configured to serve local files from")
+	}
+
+	fs.startOnce.Do(func() {
+		fs.startErr = fs.start()
+	})
+
+	if fs.startErr != nil {
+		return "", fs.startErr
+	}
+
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(tokenBytes)
+
+	now := time.Now()
+
+	fs.filesLock.Lock()
+	defer fs.filesLock.Unlock()
+
+	if fs.closed {
+		return "", errors.New("File server is closed")
+	}
+
+	// expired files are otherwise only removed if they're requested again, which they usually aren't.
+	for t, f := range fs.files {
+		if now.After(f.expiry) {
+			delete(fs.files, t)
+		}
+	}
+
+	fs.files[token] = servedFile{path: path, expiry: now.Add(expiry)}
+
+	return fs.baseURL + "/" + token + "/" + url.PathEscape(filepath.Base(path)), nil
+}
+
+// start listens on the listen address, or the port of the base URL.
+func (fs *FileServer) start() error {
+	address := fs.listenAddress
+	if address == "" {
+		u, err := url.Parse(fs.baseURL)
+		if err != nil {
+			return err
+		}
+
+		port := u.Port()
+		if port == "" {
+			port = "80"
+		}
+		address = ":" + port
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Errorf("Unable to listen on %s %s", address, err)
+		return err
+	}
+
+	server := &http.Server{Handler: fs}
+
+	fs.filesLock.Lock()
+	fs.server = server
+	fs.filesLock.Unlock()
+
+	log.Debugf("serving local files on %s", listener.Addr())
+	go func() {
+		err := server.Serve(listener)
+		if err != http.ErrServerClosed {
+			log.Errorf("File server stopped %s", err)
+		}
+	}()
+
+	return nil
+}
+
+// Close stops serving files. URLs already handed out stop working.
+func (fs *FileServer) Close() error {
+
+	// stops the server being started after it's closed.
+	fs.startOnce.Do(func() {
+		fs.startErr = errors.New("File server is closed")
+	})
+
+	fs.filesLock.Lock()
+	defer fs.filesLock.Unlock()
+
+	fs.closed = true
+	fs.files = make(map[string]servedFile)
+
+	if fs.server == nil {
+		return nil
+	}
+
+	// closes the listener and any open connections.
+	return fs.server.Close()
+}
+
+// ServeHTTP serves the file referenced by the token in the URL, as long as it hasn't expired.
+func (fs *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sp := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	token := sp[0]
+
+	fs.filesLock.Lock()
+	f, ok := fs.files[token]
+	if ok && time.Now().After(f.expiry) {
+		delete(fs.files, token)
+		ok = false
+	}
+	fs.filesLock.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// ServeContent handles range requests.
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), file)
+}
@@ -0,0 +1,355 @@
+package helpers
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// FTPActiveMode makes active mode (PORT/EPRT) connections for an FTP client that only knows passive mode.
+// The client's dial func is replaced by Dial, which wraps the control connection. When the client asks
+// for a passive data connection (PASV) a local listener is opened instead, the server is told to connect to it
+// (PORT/EPRT) and the client is handed a made up PASV reply. The client's data connection "dial" then returns
+// the connection the server makes to the listener.
+//
+// TLS is done here rather than by the client, since the commands have to be seen in the clear. So the client
+// must be dialled without TLS and with EPSV disabled (so it always asks with PASV).
+// One FTPActiveMode is needed per control connection.
+type FTPActiveMode struct {
+	tlsConfig   *tls.Config
+	explicitTLS bool
+	timeout     time.Duration
+
+	control *ftpActiveControlConn
+}
+
+// NewFTPActiveMode factory time! tlsConfig nil for plain FTP, otherwise explicitTLS picks AUTH TLS over implicit TLS.
+func NewFTPActiveMode(tlsConfig *tls.Config, explicitTLS bool, timeout time.Duration) *FTPActiveMode {
+	am := FTPActiveMode{}
+	am.tlsConfig = tlsConfig
+	am.explicitTLS = explicitTLS
+	am.timeout = timeout
+	return &am
+}
+
+// Dial the first call makes the control connection, later calls return the connection the server made for the
+// data transfer the client just asked for (the address given is ignored).
+func (am *FTPActiveMode) Dial(network string, address string) (net.Conn, error) {
+	if am.control == nil {
+		return am.dialControl(network, address)
+	}
+
+	dataConn := am.control.dataConn
+	if dataConn == nil {
+		return nil, errors.New("FTP data connection requested without a PASV")
+	}
+	return dataConn, nil
+}
+
+// dialControl connects to the server, doing the TLS handshake (and AUTH TLS) if needed.
+func (am *FTPActiveMode) dialControl(network string, address string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: am.timeout}
+	conn, err := dialer.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	control := &ftpActiveControlConn{Conn: conn, mode: am}
+	control.reader = bufio.NewReader(conn)
+
+	if am.tlsConfig != nil {
+		if am.explicitTLS {
+			// the client expects to read the greeting, so it's passed on once TLS is up.
+			code, msg, err := control.cmd(ftpStatusReady, "")
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			control.pending = []byte(fmt.Sprintf("%d %s\r\n", code, strings.Replace(msg, "\n", " ", -1)))
+
+			_, _, err = control.cmd(ftpStatusAuthOK, "AUTH TLS")
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+
+		tlsConn := tls.Client(conn, am.tlsConfig)
+		err = tlsConn.Handshake()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		control.Conn = tlsConn
+		control.reader = bufio.NewReader(tlsConn)
+	}
+
+	am.control = control
+	return control, nil
+}
+
+// FTP reply codes used here.
+const (
+	ftpStatusCommandOK = 200
+	ftpStatusReady     = 220
+	ftpStatusPassive   = 227
+	ftpStatusAuthOK    = 234
+)
+
+// errFTPDataConnClosed the data connection was closed before the server connected.
+var errFTPDataConnClosed = errors.New("FTP data connection closed")
+
+// ftpActiveControlConn the control connection the client sees. PASV commands are answered here,
+// everything else is passed through.
+type ftpActiveControlConn struct {
+	net.Conn
+	mode *FTPActiveMode
+
+	// everything from the server is read through this, so nothing read for our own commands is lost.
+	reader *bufio.Reader
+
+	// a reply for the client that didn't come from the server.
+	pending []byte
+
+	// PBSZ/PROT have been sent, so data connections are encrypted.
+	protected bool
+
+	// the data connection for the transfer in progress.
+	dataConn *ftpActiveDataConn
+}
+
+// cmd sends a command (if there is one) and reads the reply, which must have the expected code.
+func (cc *ftpActiveControlConn) cmd(expected int, format string, args ...interface{}) (int, string, error) {
+	if format != "" {
+		_, err := fmt.Fprintf(cc.Conn, format+"\r\n", args...)
+		if err != nil {
+			return 0, "", err
+		}
+	}
+	return textproto.NewReader(cc.reader).ReadResponse(expected)
+}
+
+// Write answers PASV with a listener of our own, passes anything else to the server.
+func (cc *ftpActiveControlConn) Write(p []byte) (int, error) {
+	if !bytes.HasPrefix(bytes.ToUpper(p), []byte("PASV")) {
+		return cc.Conn.Write(p)
+	}
+
+	listener, err := cc.listen()
+	if err != nil {
+		// reported to the client as the reply to its PASV.
+		log.Errorf("Unable to start FTP active mode data connection %s", err)
+		cc.pending = []byte(fmt.Sprintf("425 %s\r\n", err))
+		return len(p), nil
+	}
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	cc.dataConn = &ftpActiveDataConn{listener: listener, timeout: cc.mode.timeout}
+	if cc.protected {
+		cc.dataConn.tlsConfig = cc.mode.tlsConfig
+	}
+
+	// the address is ignored, the client "dials" the next connection the server makes.
+	cc.pending = []byte(fmt.Sprintf("%d Entering Passive Mode (127,0,0,1,%d,%d).\r\n", ftpStatusPassive, port/256, port%256))
+	return len(p), nil
+}
+
+// listen opens a listener for the server to connect to, and tells the server where it is.
+func (cc *ftpActiveControlConn) listen() (net.Listener, error) {
+
+	if cc.mode.tlsConfig != nil && !cc.protected {
+		if _, _, err := cc.cmd(ftpStatusCommandOK, "PBSZ 0"); err != nil {
+			return nil, err
+		}
+		if _, _, err := cc.cmd(ftpStatusCommandOK, "PROT P"); err != nil {
+			return nil, err
+		}
+		cc.protected = true
+	}
+
+	// listen on the address the server sees us connect from.
+	localIP := cc.Conn.LocalAddr().(*net.TCPAddr).IP
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: localIP})
+	if err != nil {
+		return nil, err
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	if ip4 := localIP.To4(); ip4 != nil {
+		_, _, err = cc.cmd(ftpStatusCommandOK, "PORT %d,%d,%d,%d,%d,%d", ip4[0], ip4[1], ip4[2], ip4[3], port/256, port%256)
+	} else {
+		_, _, err = cc.cmd(ftpStatusCommandOK, "EPRT |2|%s|%d|", localIP, port)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// Read passes on replies a line at a time, so the reply to a transfer command can be seen.
+func (cc *ftpActiveControlConn) Read(p []byte) (int, error) {
+	if len(cc.pending) == 0 {
+		line, err := cc.reader.ReadSlice('\n')
+		if len(line) == 0 {
+			return 0, err
+		}
+		cc.pending = append([]byte(nil), line...)
+
+		// the reply to the transfer command. A preliminary reply (eg. 150) means the server is connecting,
+		// an error means it won't. Anything else is the reply to a command before it (eg. REST).
+		if cc.dataConn != nil && len(line) > 3 && line[3] == ' ' {
+			switch line[0] {
+			case '1':
+				cc.dataConn.setOpening()
+				cc.dataConn = nil
+			case '4', '5':
+				cc.dataConn = nil
+			}
+		}
+	}
+
+	n := copy(p, cc.pending)
+	cc.pending = cc.pending[n:]
+	return n, nil
+}
+
+// ftpActiveDataConn the data connection the client sees. It's the connection the server makes to the listener,
+// accepted on first use.
+type ftpActiveDataConn struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	timeout   time.Duration
+
+	lock sync.Mutex
+
+	// the server has said it's connecting.
+	opening bool
+
+	acceptOnce sync.Once
+	conn       net.Conn
+	err        error
+}
+
+func (dc *ftpActiveDataConn) setOpening() {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	dc.opening = true
+}
+
+// accept waits for the server to connect, then does the TLS handshake if the data is encrypted.
+func (dc *ftpActiveDataConn) accept() (net.Conn, error) {
+	dc.acceptOnce.Do(func() {
+		defer dc.listener.Close()
+
+		if tcpListener, ok := dc.listener.(*net.TCPListener); ok {
+			tcpListener.SetDeadline(time.Now().Add(dc.timeout))
+		}
+
+		conn, err := dc.listener.Accept()
+		if err != nil {
+			dc.err = err
+			return
+		}
+
+		if dc.tlsConfig != nil {
+			tlsConn := tls.Client(conn, dc.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				dc.err = err
+				return
+			}
+			conn = tlsConn
+		}
+
+		dc.conn = conn
+	})
+
+	return dc.conn, dc.err
+}
+
+func (dc *ftpActiveDataConn) Read(p []byte) (int, error) {
+	conn, err := dc.accept()
+	if err != nil {
+		return 0, err
+	}
+	return conn.Read(p)
+}
+
+func (dc *ftpActiveDataConn) Write(p []byte) (int, error) {
+	conn, err := dc.accept()
+	if err != nil {
+		return 0, err
+	}
+	return conn.Write(p)
+}
+
+// Close closes the connection. If the server is connecting but nothing was read or written (eg. an empty upload)
+// the connection is accepted first, so the server sees a complete (empty) transfer rather than a refused connection.
+func (dc *ftpActiveDataConn) Close() error {
+	dc.lock.Lock()
+	opening := dc.opening
+	dc.lock.Unlock()
+
+	if !opening {
+		// the server isn't connecting, so don't wait for it.
+		dc.acceptOnce.Do(func() {
+			dc.listener.Close()
+			dc.err = errFTPDataConnClosed
+		})
+	}
+
+	conn, err := dc.accept()
+	if err == errFTPDataConnClosed {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (dc *ftpActiveDataConn) LocalAddr() net.Addr {
+	return dc.listener.Addr()
+}
+
+func (dc *ftpActiveDataConn) RemoteAddr() net.Addr {
+	if dc.conn != nil {
+		return dc.conn.RemoteAddr()
+	}
+	return nil
+}
+
+func (dc *ftpActiveDataConn) SetDeadline(t time.Time) error {
+	conn, err := dc.accept()
+	if err != nil {
+		return err
+	}
+	return conn.SetDeadline(t)
+}
+
+func (dc *ftpActiveDataConn) SetReadDeadline(t time.Time) error {
+	conn, err := dc.accept()
+	if err != nil {
+		return err
+	}
+	return conn.SetReadDeadline(t)
+}
+
+func (dc *ftpActiveDataConn) SetWriteDeadline(t time.Time) error {
+	conn, err := dc.accept()
+	if err != nil {
+		return err
+	}
+	return conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,285 @@
+package helpers
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// fakeActiveFTPServer an FTP server that only does active mode (PORT/EPRT), with TLS if tlsConfig is set.
+type fakeActiveFTPServer struct {
+	listener    net.Listener
+	tlsConfig   *tls.Config
+	implicitTLS bool
+
+	lock  sync.Mutex
+	files map[string][]byte
+}
+
+func newFakeActiveFTPServer(t *testing.T, tlsConfig *tls.Config, implicitTLS bool) *fakeActiveFTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := fakeActiveFTPServer{listener: listener, tlsConfig: tlsConfig, implicitTLS: implicitTLS}
+	fs.files = make(map[string][]byte)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fs.serve(conn)
+		}
+	}()
+
+	return &fs
+}
+
+func (fs *fakeActiveFTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	if fs.implicitTLS {
+		conn = tls.Server(conn, fs.tlsConfig)
+	}
+	control := textproto.NewConn(conn)
+	control.PrintfLine("220 fake FTP server")
+
+	var dataAddress string
+	protected := false
+
+	// dial connects to the address from PORT/EPRT.
+	dial := func() (net.Conn, error) {
+		if dataAddress == "" {
+			return nil, fmt.Errorf("no PORT")
+		}
+		dataConn, err := net.Dial("tcp", dataAddress)
+		dataAddress = ""
+		if err != nil {
+			return nil, err
+		}
+		if protected {
+			dataConn = tls.Server(dataConn, fs.tlsConfig)
+		}
+		return dataConn, nil
+	}
+
+	for {
+		line, err := control.ReadLine()
+		if err != nil {
+			return
+		}
+		command, arg := line, ""
+		if i := strings.Index(line, " "); i != -1 {
+			command, arg = line[:i], line[i+1:]
+		}
+
+		switch strings.ToUpper(command) {
+		case "AUTH":
+			control.PrintfLine("234 AUTH TLS ok")
+			conn = tls.Server(conn, fs.tlsConfig)
+			control = textproto.NewConn(conn)
+		case "USER":
+			control.PrintfLine("331 password please")
+		case "PASS":
+			control.PrintfLine("230 logged in")
+		case "FEAT":
+			control.PrintfLine("211 no features")
+		case "TYPE", "PBSZ", "NOOP":
+			control.PrintfLine("200 ok")
+		case "PROT":
+			protected = arg == "P"
+			control.PrintfLine("200 ok")
+		case "PORT":
+			parts := strings.Split(arg, ",")
+			p1, _ := strconv.Atoi(parts[4])
+			p2, _ := strconv.Atoi(parts[5])
+			dataAddress = net.JoinHostPort(strings.Join(parts[:4], "."), strconv.Itoa(p1*256+p2))
+			control.PrintfLine("200 PORT ok")
+		case "EPRT":
+			parts := strings.Split(arg, "|")
+			dataAddress = net.JoinHostPort(parts[2], parts[3])
+			control.PrintfLine("200 EPRT ok")
+
+		case "RETR", "STOR", "LIST":
+			fs.lock.Lock()
+			data, ok := fs.files[arg]
+			fs.lock.Unlock()
+			if command == "RETR" && !ok {
+				control.PrintfLine("550 no such file")
+				continue
+			}
+
+			// like real servers, connect before saying the transfer is starting.
+			dataConn, err := dial()
+			if err != nil {
+				control.PrintfLine("425 %s", err)
+				continue
+			}
+			control.PrintfLine("150 transfer starting")
+
+			switch command {
+			case "RETR":
+				dataConn.Write(data)
+			case "STOR":
+				data, err = ioutil.ReadAll(dataConn)
+				if err != nil {
+					dataConn.Close()
+					control.PrintfLine("426 %s", err)
+					continue
+				}
+				fs.lock.Lock()
+				fs.files[arg] = data
+				fs.lock.Unlock()
+			case "LIST":
+				fs.lock.Lock()
+				for name, data := range fs.files {
+					fmt.Fprintf(dataConn, "-rw-r--r-- 1 owner group %d Jan 01 00:00 %s\r\n", len(data), name)
+				}
+				fs.lock.Unlock()
+			}
+			dataConn.Close()
+			control.PrintfLine("226 transfer complete")
+
+		case "QUIT":
+			control.PrintfLine("221 bye")
+			return
+		default:
+			// PASV and EPSV included, this server is active mode only.
+			control.PrintfLine("502 %s not implemented", command)
+		}
+	}
+}
+
+// newTestTLSConfigs returns the server's config with a self signed certificate, and a client config trusting it.
+func newTestTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	clientConfig := &tls.Config{ServerName: "127.0.0.1", RootCAs: roots, ClientSessionCache: tls.NewLRUClientSessionCache(0)}
+
+	return serverConfig, clientConfig
+}
+
+func TestFTPActiveMode(t *testing.T) {
+	serverTLSConfig, clientTLSConfig := newTestTLSConfigs(t)
+
+	testCases := []struct {
+		name        string
+		tls         bool
+		implicitTLS bool
+	}{
+		{"plain", false, false},
+		{"explicit TLS", true, false},
+		{"implicit TLS", true, true},
+	}
+
+	for _, tc := range testCases {
+		var serverConfig, clientConfig *tls.Config
+		if tc.tls {
+			serverConfig, clientConfig = serverTLSConfig, clientTLSConfig
+		}
+
+		fs := newFakeActiveFTPServer(t, serverConfig, tc.implicitTLS)
+
+		am := NewFTPActiveMode(clientConfig, !tc.implicitTLS, 5*time.Second)
+		client, err := ftp.Dial(fs.listener.Addr().String(), ftp.DialWithDialFunc(am.Dial), ftp.DialWithDisabledEPSV(true), ftp.DialWithTimeout(5*time.Second))
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+
+		err = client.Login("user", "password")
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+
+		contents := bytes.Repeat([]byte("active mode "), 10000)
+		for name, data := range map[string][]byte{"a.txt": contents, "empty.txt": {}} {
+			err = client.Stor(name, bytes.NewReader(data))
+			if err != nil {
+				t.Errorf("%s: Stor %s %s", tc.name, name, err)
+			}
+		}
+
+		// a failed transfer leaves the connection usable.
+		_, err = client.Retr("missing.txt")
+		if err == nil {
+			t.Errorf("%s: expected Retr of a missing file to fail", tc.name)
+		}
+
+		for name, data := range map[string][]byte{"a.txt": contents, "empty.txt": {}} {
+			resp, err := client.Retr(name)
+			if err != nil {
+				t.Errorf("%s: Retr %s %s", tc.name, name, err)
+				continue
+			}
+			read, err := ioutil.ReadAll(resp)
+			resp.Close()
+			if err != nil || !bytes.Equal(read, data) {
+				t.Errorf("%s: Retr %s read %d bytes, expected %d %v", tc.name, name, len(read), len(data), err)
+			}
+		}
+
+		entries, err := client.List("")
+		if err != nil {
+			t.Errorf("%s: List %s", tc.name, err)
+		}
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+		}
+		sort.Strings(names)
+		if strings.Join(names, ",") != "a.txt,empty.txt" {
+			t.Errorf("%s: expected a.txt and empty.txt to be listed, got %v", tc.name, names)
+		}
+
+		err = client.Quit()
+		if err != nil {
+			t.Errorf("%s: Quit %s", tc.name, err)
+		}
+		fs.listener.Close()
+	}
+}
@@ -1,5 +1,89 @@
 package helpers
 
-type FTPHelper struct {
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/jlaffaye/ftp"
+)
+
+// FTPConnectionPool hands out logged in FTP connections so concurrent workers never share one.
+// A connection can only do one thing at a time (a transfer ties it up until the data connection is closed),
+// so each worker takes a connection, uses it, then gives it back. At most maxConnections are open at once,
+// since most servers limit how many connections a user can have.
+type FTPConnectionPool struct {
+	dial func() (*ftp.ServerConn, error)
+
+	// connections not currently in use.
+	idle chan *ftp.ServerConn
+
+	// one entry per connection in use (or being dialled).
+	inUse chan struct{}
+}
+
+// NewFTPConnectionPool factory time! dial connects and logs in a new connection.
+func NewFTPConnectionPool(maxConnections uint, dial func() (*ftp.ServerConn, error)) *FTPConnectionPool {
+	if maxConnections < 1 {
+		maxConnections = 1
+	}
+
+	pool := FTPConnectionPool{}
+	pool.dial = dial
+	pool.idle = make(chan *ftp.ServerConn, maxConnections)
+	pool.inUse = make(chan struct{}, maxConnections)
+	return &pool
 }
 
+// Get gets an idle connection, or dials a new one. Blocks if maxConnections are already in use.
+// Every connection from Get must be returned via Put.
+func (p *FTPConnectionPool) Get() (*ftp.ServerConn, error) {
+	p.inUse <- struct{}{}
+
+	for {
+		select {
+		case conn := <-p.idle:
+			// the server may have dropped it while it was idle.
+			if err := conn.NoOp(); err != nil {
+				log.Debugf("discarding stale FTP connection %s", err)
+				conn.Quit()
+				continue
+			}
+			return conn, nil
+
+		default:
+			conn, err := p.dial()
+			if err != nil {
+				<-p.inUse
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+}
+
+// Put returns a connection to the pool. If err (the result of using the connection) is set the connection
+// may be in an unknown state, so it's closed rather than reused.
+func (p *FTPConnectionPool) Put(conn *ftp.ServerConn, err error) {
+	defer func() { <-p.inUse }()
+
+	if err != nil {
+		conn.Quit()
+		return
+	}
+
+	select {
+	case p.idle <- conn:
+	default:
+		conn.Quit()
+	}
+}
+
+// Close closes the idle connections.
+func (p *FTPConnectionPool) Close() {
+	for {
+		select {
+		case conn := <-p.idle:
+			conn.Quit()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package helpers
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// how many times a chunk is attempted before the download fails.
+const rangeFetchAttempts = 3
+
+// RangeFetcher opens a stream to count bytes of a blob, starting at offset.
+type RangeFetcher func(offset int64, count int64) (io.ReadCloser, error)
+
+// RangedReader downloads a blob as a number of byte ranges (chunks) in parallel, but
+// returns the bytes in order. At most parallelism chunks are downloaded/held in memory at once,
+// so a slow consumer (eg. the destination upload) slows the download rather than filling memory.
+type RangedReader struct {
+
+	// already opened stream for the start of the blob (may be nil).
+	first io.ReadCloser
+
+	// results of the chunks, in blob order.
+	pending chan chan rangeResult
+
+	// closed when the reader is closed so no more chunks are started.
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// what's left of the chunk currently being read.
+	current []byte
+	err     error
+}
+
+type rangeResult struct {
+	data []byte
+	err  error
+}
+
+// NewRangedReader returns a reader over a blob of size bytes.
+// first is an already open stream to the first firstCount bytes of the blob (ie the request that was
+// used to get the blob properties) and the rest of the blob is fetched via fetch in chunkSize chunks.
+func NewRangedReader(first io.ReadCloser, firstCount int64, size int64, chunkSize int64, parallelism uint, fetch RangeFetcher) *RangedReader {
+
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	rr := new(RangedReader)
+	rr.first = first
+	rr.pending = make(chan chan rangeResult, parallelism-1)
+	rr.done = make(chan struct{})
+
+	go rr.fetchChunks(firstCount, size, chunkSize, fetch)
+	return rr
+}
+
+// fetchChunks starts the download of each chunk, waiting for room in the pending queue before starting the next.
+func (rr *RangedReader) fetchChunks(offset int64, size int64, chunkSize int64, fetch RangeFetcher) {
+	defer close(rr.pending)
+
+	for ; offset < size; offset += chunkSize {
+		count := chunkSize
+		if offset+count > size {
+			count = size - offset
+		}
+
+		// buffered so the download never blocks, even if the reader has been closed.
+		result := make(chan rangeResult, 1)
+
+		select {
+		case rr.pending <- result:
+		case <-rr.done:
+			return
+		}
+
+		go func(offset int64, count int64) {
+			result <- fetchRange(offset, count, fetch)
+		}(offset, count)
+	}
+}
+
+// fetchRange downloads a single chunk into memory, retrying if required.
+func fetchRange(offset int64, count int64, fetch RangeFetcher) rangeResult {
+
+	var err error
+	for attempt := 0; attempt < rangeFetchAttempts; attempt++ {
+		var body io.ReadCloser
+		body, err = fetch(offset, count)
+		if err != nil {
+			log.Debugf("unable to fetch range %d-%d (attempt %d) %s", offset, offset+count-1, attempt+1, err)
+			continue
+		}
+
+		data := make([]byte, count)
+		_, err = io.ReadFull(body, data)
+		body.Close()
+		if err != nil {
+			log.Debugf("unable to read range %d-%d (attempt %d) %s", offset, offset+count-1, attempt+1, err)
+			continue
+		}
+
+		return rangeResult{data: data}
+	}
+
+	return rangeResult{err: fmt.Errorf("Unable to download range %d-%d : %s", offset, offset+count-1, err)}
+}
+
+// Read returns the bytes of the blob in order.
+func (rr *RangedReader) Read(p []byte) (int, error) {
+
+	if rr.first != nil {
+		n, err := rr.first.Read(p)
+		if err == io.EOF {
+			rr.first.Close()
+			rr.first = nil
+			err = nil
+		}
+
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+
+	for len(rr.current) == 0 {
+		if rr.err != nil {
+			return 0, rr.err
+		}
+
+		result, ok := <-rr.pending
+		if !ok {
+			rr.err = io.EOF
+			continue
+		}
+
+		r := <-result
+		if r.err != nil {
+			rr.err = r.err
+			rr.Close()
+			continue
+		}
+
+		rr.current = r.data
+	}
+
+	n := copy(p, rr.current)
+	rr.current = rr.current[n:]
+	return n, nil
+}
+
+// Close stops any more chunks being downloaded. Chunks already being downloaded are discarded.
+func (rr *RangedReader) Close() error {
+	rr.closeOnce.Do(func() {
+		close(rr.done)
+		if rr.first != nil {
+			rr.first.Close()
+			rr.first = nil
+		}
+	})
+
+	return nil
+}
@@ -0,0 +1,217 @@
+package helpers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBlob serves byte ranges of data. The first attempt at some ranges fails, and earlier ranges
+// are slower so they complete out of order.
+type fakeBlob struct {
+	data []byte
+
+	// ranges (by offset) whose first attempt fails, and how.
+	failOnce  map[int64]bool
+	shortOnce map[int64]bool
+
+	// ranges that always fail.
+	failAlways map[int64]bool
+
+	lock      sync.Mutex
+	attempts  map[int64]int
+	inFlight  int
+	maxFlight int
+}
+
+func newFakeBlob(size int) *fakeBlob {
+	fb := fakeBlob{}
+	fb.data = make([]byte, size)
+	for i := range fb.data {
+		fb.data[i] = byte(i * 7)
+	}
+	fb.failOnce = make(map[int64]bool)
+	fb.shortOnce = make(map[int64]bool)
+	fb.failAlways = make(map[int64]bool)
+	fb.attempts = make(map[int64]int)
+	return &fb
+}
+
+func (fb *fakeBlob) fetch(offset int64, count int64) (io.ReadCloser, error) {
+	fb.lock.Lock()
+	fb.attempts[offset]++
+	attempt := fb.attempts[offset]
+	fb.inFlight++
+	if fb.inFlight > fb.maxFlight {
+		fb.maxFlight = fb.inFlight
+	}
+	fb.lock.Unlock()
+
+	defer func() {
+		fb.lock.Lock()
+		fb.inFlight--
+		fb.lock.Unlock()
+	}()
+
+	// the further into the blob, the quicker the range arrives.
+	time.Sleep(time.Duration(len(fb.data)-int(offset)) * time.Microsecond * 20)
+
+	if fb.failAlways[offset] || (attempt == 1 && fb.failOnce[offset]) {
+		return nil, fmt.Errorf("fetch of %d failed", offset)
+	}
+
+	if offset < 0 || offset+count > int64(len(fb.data)) {
+		return nil, fmt.Errorf("range %d-%d out of bounds", offset, offset+count-1)
+	}
+
+	body := fb.data[offset : offset+count]
+	if attempt == 1 && fb.shortOnce[offset] {
+		body = body[:count/2]
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(body)), nil
+}
+
+func TestRangedReader(t *testing.T) {
+
+	testCases := []struct {
+		name        string
+		size        int
+		firstCount  int
+		chunkSize   int64
+		parallelism uint
+		failOnce    []int64
+		shortOnce   []int64
+	}{
+		{"chunks divide evenly", 1000, 100, 100, 4, nil, nil},
+		{"last chunk is short", 1037, 100, 100, 4, []int64{300}, nil},
+		{"no first stream", 1037, 0, 100, 3, []int64{0, 1000}, []int64{500}},
+		{"first stream is the whole blob", 500, 500, 100, 4, nil, nil},
+		{"first stream covers part of a chunk", 1037, 50, 100, 2, []int64{50}, []int64{850}},
+		{"chunk bigger than the blob", 37, 0, 100, 4, []int64{0}, nil},
+		{"one at a time", 1037, 100, 64, 1, []int64{164}, []int64{292}},
+		{"empty blob", 0, 0, 100, 4, nil, nil},
+	}
+
+	for _, tc := range testCases {
+		fb := newFakeBlob(tc.size)
+		for _, offset := range tc.failOnce {
+			fb.failOnce[offset] = true
+		}
+		for _, offset := range tc.shortOnce {
+			fb.shortOnce[offset] = true
+		}
+
+		var first io.ReadCloser
+		if tc.firstCount > 0 {
+			first = ioutil.NopCloser(bytes.NewReader(fb.data[:tc.firstCount]))
+		}
+
+		rr := NewRangedReader(first, int64(tc.firstCount), int64(tc.size), tc.chunkSize, tc.parallelism, fb.fetch)
+		data, err := ioutil.ReadAll(rr)
+		rr.Close()
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+
+		if !bytes.Equal(data, fb.data) {
+			t.Errorf("%s: read %d bytes, didn't match the %d byte blob", tc.name, len(data), len(fb.data))
+		}
+
+		fb.lock.Lock()
+		for _, offset := range append(tc.failOnce, tc.shortOnce...) {
+			if fb.attempts[offset] != 2 {
+				t.Errorf("%s: expected range %d to be fetched twice, was fetched %d times", tc.name, offset, fb.attempts[offset])
+			}
+		}
+		if fb.maxFlight > int(tc.parallelism) {
+			t.Errorf("%s: %d ranges fetched at once, expected at most %d", tc.name, fb.maxFlight, tc.parallelism)
+		}
+		fb.lock.Unlock()
+	}
+}
+
+func TestRangedReaderFails(t *testing.T) {
+
+	fb := newFakeBlob(1037)
+	fb.failAlways[500] = true
+
+	rr := NewRangedReader(nil, 0, 1037, 100, 4, fb.fetch)
+	defer rr.Close()
+
+	data, err := ioutil.ReadAll(rr)
+	if err == nil {
+		t.Fatal("expected the download to fail")
+	}
+
+	// everything before the failed range is still returned, in order.
+	if !bytes.Equal(data, fb.data[:500]) {
+		t.Errorf("expected the first 500 bytes before the error, got %d", len(data))
+	}
+
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	if fb.attempts[500] != rangeFetchAttempts {
+		t.Errorf("expected %d attempts at the failed range, got %d", rangeFetchAttempts, fb.attempts[500])
+	}
+
+	// the error sticks.
+	if _, err := rr.Read(make([]byte, 10)); err == nil {
+		t.Error("expected reads after the failure to fail")
+	}
+}
+
+func TestRangedReaderClose(t *testing.T) {
+
+	fb := newFakeBlob(10000)
+
+	first := &closeRecorder{Reader: bytes.NewReader(fb.data[:100])}
+	rr := NewRangedReader(first, 100, 10000, 100, 4, fb.fetch)
+
+	// read part way, then give up.
+	_, err := io.ReadFull(rr, make([]byte, 50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr.Close()
+	rr.Close()
+
+	if !first.closed {
+		t.Error("expected the first stream to be closed")
+	}
+
+	// give any fetches already started time to finish, no more should start.
+	time.Sleep(50 * time.Millisecond)
+	fb.lock.Lock()
+	started := len(fb.attempts)
+	fb.lock.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	if len(fb.attempts) != started {
+		t.Errorf("ranges still being fetched after close, %d then %d", started, len(fb.attempts))
+	}
+	if started > 5 {
+		t.Errorf("expected at most a few ranges to be fetched, got %d", started)
+	}
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (cr *closeRecorder) Close() error {
+	if cr.closed {
+		return errors.New("closed twice")
+	}
+	cr.closed = true
+	return nil
+}
@@ -1,5 +1,7 @@
 package misc
 
+import "time"
+
 // misc consts for credentials.
 // need a more dynamic way to add for new cloud types.
 // but for now, it will do.
@@ -12,6 +14,23 @@ const (
 	AzureDestAccountName    = "AzureDestAccountName"
 	AzureDestAccountKey     = "AzureDestAccountKey"
 
+	// Azure OAuth. Either a token or the service principal to get one for. Used for both source and destination.
+	AzureAccessToken  = "AzureAccessToken"
+	AzureTenantID     = "AzureTenantID"
+	AzureClientID     = "AzureClientID"
+	AzureClientSecret = "AzureClientSecret"
+
+	// Azure blob service endpoints for sovereign clouds, private endpoints or the emulator.
+	// eg. https://myacct.blob.core.chinacloudapi.cn or http://azurite:10000/devstoreaccount1
+	AzureDefaultEndpoint = "AzureDefaultEndpoint"
+	AzureSourceEndpoint  = "AzureSourceEndpoint"
+	AzureDestEndpoint    = "AzureDestEndpoint"
+
+	// destination Azure access tier (Hot, Cool or Archive) and blob type (BlockBlob, PageBlob or AppendBlob).
+	// If the blob type isn't set blobs keep the type of the source (block blobs for non Azure sources).
+	AzureAccessTier = "AzureAccessTier"
+	AzureBlobType   = "AzureBlobType"
+
 	// S3
 	S3DefaultAccessID     = "S3DefaultAccessID"
 	S3DefaultAccessSecret = "S3DefaultAccessSecret"
@@ -25,6 +44,46 @@ const (
 	S3DestAccessSecret = "S3DestAccessSecret"
 	S3DestRegion       = "S3DestRegion"
 
+	// S3 compatible endpoints (MinIO, Ceph, Wasabi etc). eg. http://localhost:9000
+	S3DefaultEndpoint = "S3DefaultEndpoint"
+	S3SourceEndpoint  = "S3SourceEndpoint"
+	S3DestEndpoint    = "S3DestEndpoint"
+
+	// FTP. Host is host or host:port, and overrides the host in the URL.
+	FTPDefaultHost     = "FTPDefaultHost"
+	FTPDefaultUsername = "FTPDefaultUsername"
+	FTPDefaultPassword = "FTPDefaultPassword"
+
+	FTPSourceHost     = "FTPSourceHost"
+	FTPSourceUsername = "FTPSourceUsername"
+	FTPSourcePassword = "FTPSourcePassword"
+
+	FTPDestHost     = "FTPDestHost"
+	FTPDestUsername = "FTPDestUsername"
+	FTPDestPassword = "FTPDestPassword"
+
+	// FTP data connection mode (passive or pasv).
+	FTPMode = "FTPMode"
+
+	// SFTP. Username/password/private key override any username/password in the URL.
+	SFTPDefaultUsername   = "SFTPDefaultUsername"
+	SFTPDefaultPassword   = "SFTPDefaultPassword"
+	SFTPDefaultPrivateKey = "SFTPDefaultPrivateKey"
+
+	SFTPSourceUsername   = "SFTPSourceUsername"
+	SFTPSourcePassword   = "SFTPSourcePassword"
+	SFTPSourcePrivateKey = "SFTPSourcePrivateKey"
+
+	SFTPDestUsername   = "SFTPDestUsername"
+	SFTPDestPassword   = "SFTPDestPassword"
+	SFTPDestPrivateKey = "SFTPDestPrivateKey"
+
+	// passphrase for encrypted private keys.
+	SFTPPrivateKeyPassphrase = "SFTPPrivateKeyPassphrase"
+
+	// known_hosts file server host keys are verified against. ~/.ssh/known_hosts if not set.
+	SFTPKnownHosts = "SFTPKnownHosts"
+
 	// debug
 	Debug   = "Debug"
 	Source  = "Source"
@@ -33,6 +92,19 @@ const (
 
 	// container name to create.
 	CreateContainerName = "CreateContainer"
+
+	// URL (reachable by Azure) that local files are served from when generating presigned URLs
+	// for the Filesystem handler. eg. http://myhost:8080
+	FilesystemServeURL = "FilesystemServeURL"
+
+	// address the Filesystem handler's file server listens on, if it differs from FilesystemServeURL. eg. 0.0.0.0:8080
+	FilesystemServeListenAddress = "FilesystemServeListenAddress"
+
+	// what the Filesystem handler does with symlinks (follow, skip or preserve).
+	FilesystemSymlinks = "FilesystemSymlinks"
+
+	// path of the job journal.
+	JournalPath = "JournalPath"
 )
 
 // Commands to execute
@@ -43,6 +115,8 @@ const (
 	CommandUnknown
 	CommandListContainer
 	CommandCopyBlob
+	CommandSync
+	CommandMirror
 )
 
 // CloudConfig UGLY UGLY UGLY way to store the configuration.
@@ -61,6 +135,53 @@ type CloudConfig struct {
 	Version bool // display version
 
 	ConcurrentCount uint // how many goroutines do we have in the pool?
+
+	PresignedURLExpiry uint // how many minutes presigned URLs (CopyBlob flag) are valid for.
+
+	DryRun bool // sync/mirror only display what would be copied/deleted.
+
+	MirrorDeleteThreshold uint // mirror aborts if more than this percentage of the destination would be deleted.
+
+	Resume bool // resume the job recorded in the journal.
+
+	NonRecursive bool // list only the immediate children (blobs and virtual directories) of the source.
+
+	AzureSnapshots bool // list (and copy) the snapshots of source Azure blobs as well as the blobs themselves.
+
+	S3SourcePathStyle          bool // source S3 URLs are https://host/bucket/key rather than https://bucket.host/key
+	S3DestPathStyle            bool // destination S3 URLs are https://host/bucket/key rather than https://bucket.host/key
+	S3SourceInsecureSkipVerify bool // skip TLS verification for the source S3 endpoint.
+	S3DestInsecureSkipVerify   bool // skip TLS verification for the destination S3 endpoint.
+
+	S3MultipartThreshold   uint // MB. S3 objects larger than this are uploaded in parts.
+	S3MultipartPartSize    uint // MB. size of each part.
+	S3MultipartConcurrency uint // how many parts of an object are uploaded at once.
+	S3MultipartRetries     uint // how many times a failed part is retried.
+
+	AzureBlockSize        uint // MB. size of each block of an Azure block blob (max 100).
+	AzureBlockParallelism uint // how many blocks of a blob are uploaded at once.
+
+	FTPExplicitTLS    bool // ftp:// URLs upgrade to TLS (AUTH TLS). ftps:// URLs always use (implicit) TLS.
+	FTPMaxConnections uint // how many connections are opened to each FTP server.
+
+	SFTPUseAgent              bool // offer the keys held by ssh-agent (SSH_AUTH_SOCK) to SFTP servers.
+	SFTPInsecureIgnoreHostKey bool // don't verify SFTP server host keys. Testing only!
+
+	FilesystemPreserveTimes       bool // keep the modified time of local files in blob metadata, and restore it when writing local files.
+	FilesystemPreservePermissions bool // keep the mode and uid/gid of local files in blob metadata, and restore them when writing local files.
+
+	DownloadChunkSize   uint // MB. Azure/S3 blobs larger than this are downloaded as parallel byte ranges.
+	DownloadParallelism uint // how many ranges of a blob are downloaded at once. Separate from ConcurrentCount.
+
+	// which blobs are listed/copied. See filterutils.BlobFilter for the pattern syntax.
+	IncludePatterns []string
+	ExcludePatterns []string
+	IncludeRegex    []string
+	ExcludeRegex    []string
+	MinSize         int64 // bytes, 0 for no limit.
+	MaxSize         int64 // bytes, 0 for no limit.
+	ModifiedAfter   time.Time
+	ModifiedBefore  time.Time
 }
 
 // NewCloudConfig  Make new (and only really) configuration map
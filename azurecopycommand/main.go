@@ -2,18 +2,67 @@ package main
 
 import (
 	"azurecopy/azurecopy"
+	"azurecopy/azurecopy/handlers"
 	"azurecopy/azurecopy/models"
 	"azurecopy/azurecopy/utils/misc"
 	"flag"
 	"fmt"
 
 	"os"
+	"os/signal"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
 
 var Version string
 
+// stringSliceFlag lets a flag be given multiple times. eg. -include *.csv -include *.json
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSliceFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// parseFilterTime parses an RFC3339 time given to a filter flag. Empty means no filter.
+func parseFilterTime(flagName string, value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		fmt.Printf("Invalid %s time %s, expected RFC3339 format eg. 2017-06-01T00:00:00Z\n", flagName, value)
+		os.Exit(1)
+	}
+
+	return t
+}
+
+// parseChoice checks the value given to a flag is one of the choices (ignoring case) and returns the choice.
+// Empty means not set.
+func parseChoice(flagName string, value string, choices ...string) string {
+	if value == "" {
+		return ""
+	}
+
+	for _, choice := range choices {
+		if strings.EqualFold(value, choice) {
+			return choice
+		}
+	}
+
+	fmt.Printf("Invalid %s %s, expected one of %s\n", flagName, value, strings.Join(choices, ", "))
+	os.Exit(1)
+	return ""
+}
+
 func generateSpace(c int) string {
 	s := ""
 	for i := 0; i < c; i++ {
@@ -43,9 +92,9 @@ func printContainer(container *models.SimpleContainer, depth int) {
 
 // getCommand. Naive way to determine what the actual user wants to do. Copy, list etc etc.
 // rework when it gets more complex.
-func getCommand(copyCommand bool, listCommand bool, createContainerCommand string, copyBlobCommand bool) int {
+func getCommand(copyCommand bool, listCommand bool, createContainerCommand string, copyBlobCommand bool, syncCommand bool, mirrorCommand bool) int {
 
-	if !copyCommand && !listCommand && createContainerCommand == "" && !copyBlobCommand {
+	if !copyCommand && !listCommand && createContainerCommand == "" && !copyBlobCommand && !syncCommand && !mirrorCommand {
 		fmt.Println("No command given")
 		os.Exit(1)
 	}
@@ -58,6 +107,14 @@ func getCommand(copyCommand bool, listCommand bool, createContainerCommand strin
 		return misc.CommandCopyBlob
 	}
 
+	if syncCommand {
+		return misc.CommandSync
+	}
+
+	if mirrorCommand {
+		return misc.CommandMirror
+	}
+
 	if listCommand {
 		return misc.CommandList
 	}
@@ -81,23 +138,61 @@ func setupConfiguration() *misc.CloudConfig {
 	var dest = flag.String("dest", "", "Destination URL")
 	var debug = flag.Bool("debug", false, "Debug output")
 	var copyCommand = flag.Bool("copy", false, "Copy from source to destination")
-	var copyBlobCommand = flag.Bool("copyblob", false, "Copy from source to destination using Azure CopyBlob flag. Can only be used if Azure is destination")
+	var copyBlobCommand = flag.Bool("copyblob", false, "Copy from source to destination using Azure CopyBlob flag. Can only be used if Azure (blob or file storage) is destination")
+	var syncCommand = flag.Bool("sync", false, "Copy only blobs that are missing or differ at the destination")
+	var mirrorCommand = flag.Bool("mirror", false, "Sync then delete destination blobs that aren't at the source")
+	var mirrorThreshold = flag.Uint("mirrorthreshold", 10, "Mirror aborts if more than this percentage of destination blobs would be deleted")
+	var dryRun = flag.Bool("dryrun", false, "Sync/mirror only display what would be copied and deleted")
+
+	var journal = flag.String("journal", "", "Record the state of each blob to this journal file so the job can be resumed")
+	var resume = flag.String("resume", "", "Resume the job recorded in this journal file. Completed blobs are skipped")
+
+	var includePatterns stringSliceFlag
+	var excludePatterns stringSliceFlag
+	var includeRegex stringSliceFlag
+	var excludeRegex stringSliceFlag
+	flag.Var(&includePatterns, "include", "Only list/copy blobs matching this glob (eg. *.parquet or logs/2017/*). Can be repeated")
+	flag.Var(&excludePatterns, "exclude", "Don't list/copy blobs matching this glob (eg. tmp/). Can be repeated")
+	flag.Var(&includeRegex, "includeregex", "Only list/copy blobs whose path matches this regex. Can be repeated")
+	flag.Var(&excludeRegex, "excluderegex", "Don't list/copy blobs whose path matches this regex. Can be repeated")
+	var minSize = flag.Int64("minsize", 0, "Only list/copy blobs of at least this many bytes")
+	var maxSize = flag.Int64("maxsize", 0, "Only list/copy blobs of at most this many bytes")
+	var modifiedAfter = flag.String("modifiedafter", "", "Only list/copy blobs modified after this time (RFC3339)")
+	var modifiedBefore = flag.String("modifiedbefore", "", "Only list/copy blobs modified before this time (RFC3339)")
 
 	//var copyBlobCommand = false
 
 	var listCommand = flag.Bool("list", false, "List contents from source")
+	var nonRecursive = flag.Bool("nonrecursive", false, "List only the immediate children (blobs and virtual directories) of the source")
 	var createContainerCommand = flag.String("createcontainer", "", "Create container for destination")
 
 	var simpleOutput = flag.Bool("simpleoutput", false, "Simple output, URLs over trees")
 
 	var replace = flag.Bool("replace", true, "Replace blob if already exists")
 
+	var presignedURLExpiry = flag.Uint("presignexpiry", 15, "How many minutes presigned source URLs are valid for (copyblob)")
+	var filesystemServeURL = flag.String("FilesystemServeURL", "", "URL (reachable by Azure) local files are served from when filesystem is copyblob source. eg. http://myhost:8080")
+	var filesystemServeListenAddress = flag.String("FilesystemServeListenAddress", "", "Address local files are served on, if not the port of FilesystemServeURL on every interface. eg. 0.0.0.0:8080 behind NAT")
+	var filesystemPreserveTimes = flag.Bool("preservetimes", false, "Keep the modified time of local files (in blob metadata) and restore it when writing local files")
+	var filesystemPreservePermissions = flag.Bool("preservepermissions", false, "Keep the mode and owner (uid/gid) of local files (in blob metadata) and restore them when writing local files. Restoring the owner needs root")
+	var filesystemSymlinks = flag.String("symlinks", "follow", "What to do with local symlinks: follow, skip or preserve (copied as a record of the link and restored as a link)")
+
 	var azureDefaultAccountName = flag.String("AzureDefaultAccountName", "", "Default Azure Account Name")
 	var azureDefaultAccountKey = flag.String("AzureDefaultAccountKey", "", "Default Azure Account Key")
 	var azureSourceAccountName = flag.String("AzureSourceAccountName", "", "Source Azure Account Name")
 	var azureSourceAccountKey = flag.String("AzureSourceAccountKey", "", "Source Azure Account Key")
 	var azureDestAccountName = flag.String("AzureDestAccountName", "", "Destination Azure Account Name")
 	var azureDestAccountKey = flag.String("AzureDestAccountKey", "", "Destination Azure Account Key")
+	var azureAccessToken = flag.String("AzureAccessToken", "", "Azure OAuth bearer token (eg. from az account get-access-token --resource https://storage.azure.com/)")
+	var azureTenantID = flag.String("AzureTenantID", "", "Azure AD tenant of the service principal (or AZURE_TENANT_ID)")
+	var azureClientID = flag.String("AzureClientID", "", "Azure service principal client ID (or AZURE_CLIENT_ID)")
+	var azureClientSecret = flag.String("AzureClientSecret", "", "Azure service principal secret (or AZURE_CLIENT_SECRET)")
+	var azureDefaultEndpoint = flag.String("AzureDefaultEndpoint", "", "Default Azure blob endpoint (sovereign cloud, private endpoint, Azurite). eg. http://azurite:10000/devstoreaccount1")
+	var azureSourceEndpoint = flag.String("AzureSourceEndpoint", "", "Source Azure blob endpoint")
+	var azureDestEndpoint = flag.String("AzureDestEndpoint", "", "Destination Azure blob endpoint")
+	var azureAccessTier = flag.String("AzureAccessTier", "", "Access tier (Hot, Cool or Archive) of block blobs written to Azure. Default is the account tier")
+	var azureBlobType = flag.String("AzureBlobType", "", "Type (BlockBlob, PageBlob or AppendBlob) of blobs written to Azure. Default is the type of the source blob")
+	var azureSnapshots = flag.Bool("AzureSnapshots", false, "List/copy the snapshots of source Azure blobs as well as the blobs (copied as blobname@snapshottime)")
 
 	var s3DefaultAccessID = flag.String("S3DefaultAccessID", "", "Default S3 Access ID")
 	var s3DefaultAccessSecret = flag.String("S3DefaultAccessSecret", "", "Default S3 Access Secret")
@@ -109,6 +204,52 @@ func setupConfiguration() *misc.CloudConfig {
 	var s3DestAccessSecret = flag.String("S3DestAccessSecret", "", "Destination S3 Access Secret")
 	var s3DestRegion = flag.String("S3DestRegion", "", "Destination S3 Region")
 
+	var s3DefaultEndpoint = flag.String("S3DefaultEndpoint", "", "Default S3 compatible endpoint (MinIO, Ceph, Wasabi etc). eg. http://localhost:9000")
+	var s3SourceEndpoint = flag.String("S3SourceEndpoint", "", "Source S3 compatible endpoint")
+	var s3DestEndpoint = flag.String("S3DestEndpoint", "", "Destination S3 compatible endpoint")
+	var s3SourcePathStyle = flag.Bool("S3SourcePathStyle", false, "Source S3 uses path style addressing (https://host/bucket/key)")
+	var s3DestPathStyle = flag.Bool("S3DestPathStyle", false, "Destination S3 uses path style addressing (https://host/bucket/key)")
+	var s3SourceSkipTLSVerify = flag.Bool("S3SourceSkipTLSVerify", false, "Skip TLS certificate verification for the source S3 endpoint")
+	var s3DestSkipTLSVerify = flag.Bool("S3DestSkipTLSVerify", false, "Skip TLS certificate verification for the destination S3 endpoint")
+
+	var s3MultipartThreshold = flag.Uint("s3multipartthreshold", 100, "S3 objects larger than this many MB are uploaded in parts")
+	var s3PartSize = flag.Uint("s3partsize", 16, "Size in MB of each part of an S3 multipart upload (min 5)")
+	var s3PartConcurrency = flag.Uint("s3partconcurrency", 5, "How many parts of an S3 object are uploaded concurrently")
+	var s3PartRetries = flag.Uint("s3partretries", 3, "How many times a failed S3 part is retried before the upload is aborted")
+
+	var azureBlockSize = flag.Uint("azureblocksize", 4, "Size in MB of each block of an Azure block blob (max 100). Raised automatically for blobs that need more than 50000 blocks")
+	var azureBlockParallelism = flag.Uint("azureblockparallelism", 4, "How many blocks of an Azure blob are uploaded concurrently")
+
+	var ftpDefaultHost = flag.String("FTPDefaultHost", "", "Default FTP host (host or host:port). Overrides the host in the URL")
+	var ftpDefaultUsername = flag.String("FTPDefaultUsername", "", "Default FTP username (anonymous if not set)")
+	var ftpDefaultPassword = flag.String("FTPDefaultPassword", "", "Default FTP password")
+	var ftpSourceHost = flag.String("FTPSourceHost", "", "Source FTP host")
+	var ftpSourceUsername = flag.String("FTPSourceUsername", "", "Source FTP username")
+	var ftpSourcePassword = flag.String("FTPSourcePassword", "", "Source FTP password")
+	var ftpDestHost = flag.String("FTPDestHost", "", "Destination FTP host")
+	var ftpDestUsername = flag.String("FTPDestUsername", "", "Destination FTP username")
+	var ftpDestPassword = flag.String("FTPDestPassword", "", "Destination FTP password")
+	var ftpExplicitTLS = flag.Bool("ftpexplicittls", false, "Use explicit TLS (AUTH TLS) for ftp:// URLs. ftps:// URLs always use implicit TLS")
+	var ftpMode = flag.String("ftpmode", "passive", "FTP data connection mode: passive (EPSV, falling back to PASV), pasv (PASV only) or active (PORT/EPRT)")
+	var ftpMaxConnections = flag.Uint("ftpmaxconnections", 5, "Maximum number of connections to each FTP server")
+
+	var sftpDefaultUsername = flag.String("SFTPDefaultUsername", "", "Default SFTP username")
+	var sftpDefaultPassword = flag.String("SFTPDefaultPassword", "", "Default SFTP password")
+	var sftpDefaultPrivateKey = flag.String("SFTPDefaultPrivateKey", "", "Default SFTP private key file")
+	var sftpSourceUsername = flag.String("SFTPSourceUsername", "", "Source SFTP username")
+	var sftpSourcePassword = flag.String("SFTPSourcePassword", "", "Source SFTP password")
+	var sftpSourcePrivateKey = flag.String("SFTPSourcePrivateKey", "", "Source SFTP private key file")
+	var sftpDestUsername = flag.String("SFTPDestUsername", "", "Destination SFTP username")
+	var sftpDestPassword = flag.String("SFTPDestPassword", "", "Destination SFTP password")
+	var sftpDestPrivateKey = flag.String("SFTPDestPrivateKey", "", "Destination SFTP private key file")
+	var sftpPrivateKeyPassphrase = flag.String("SFTPPrivateKeyPassphrase", "", "Passphrase for encrypted SFTP private keys")
+	var sftpKnownHosts = flag.String("sftpknownhosts", "", "known_hosts file SFTP server host keys are verified against (default ~/.ssh/known_hosts)")
+	var sftpUseAgent = flag.Bool("sftpuseagent", false, "Offer the keys held by ssh-agent (SSH_AUTH_SOCK) to SFTP servers")
+	var sftpInsecureIgnoreHostKey = flag.Bool("sftpinsecureignorehostkey", false, "Don't verify SFTP server host keys. Testing only!")
+
+	var downloadChunkSize = flag.Uint("downloadchunksize", 8, "Azure/S3 blobs larger than this many MB are downloaded as parallel ranges of this size")
+	var downloadParallelism = flag.Uint("downloadparallelism", 4, "How many ranges of a single blob are downloaded concurrently (1 disables ranged downloads)")
+
 	flag.Parse()
 
 	config.Version = *version
@@ -121,12 +262,36 @@ func setupConfiguration() *misc.CloudConfig {
 			os.Exit(1)
 		}
 
-		config.Command = getCommand(*copyCommand, *listCommand, *createContainerCommand, *copyBlobCommand)
+		if *azureBlockSize > 100 {
+			fmt.Printf("Maximum Azure block size is 100 MB")
+			os.Exit(1)
+		}
+
+		config.Command = getCommand(*copyCommand, *listCommand, *createContainerCommand, *copyBlobCommand, *syncCommand, *mirrorCommand)
 		config.Configuration[misc.Source] = *source
 		config.Configuration[misc.Dest] = *dest
 		config.Replace = *replace
 		config.SimpleOutput = *simpleOutput
+		config.NonRecursive = *nonRecursive
 		config.ConcurrentCount = *concurrentCount
+		config.PresignedURLExpiry = *presignedURLExpiry
+		config.DryRun = *dryRun
+		config.MirrorDeleteThreshold = *mirrorThreshold
+
+		config.Configuration[misc.JournalPath] = *journal
+		if *resume != "" {
+			config.Configuration[misc.JournalPath] = *resume
+			config.Resume = true
+		}
+		config.IncludePatterns = includePatterns
+		config.ExcludePatterns = excludePatterns
+		config.IncludeRegex = includeRegex
+		config.ExcludeRegex = excludeRegex
+		config.MinSize = *minSize
+		config.MaxSize = *maxSize
+		config.ModifiedAfter = parseFilterTime("modifiedafter", *modifiedAfter)
+		config.ModifiedBefore = parseFilterTime("modifiedbefore", *modifiedBefore)
+
 		config.Configuration[misc.CreateContainerName] = *createContainerCommand
 
 		config.Configuration[misc.AzureDefaultAccountName] = *azureDefaultAccountName
@@ -135,6 +300,16 @@ func setupConfiguration() *misc.CloudConfig {
 		config.Configuration[misc.AzureSourceAccountKey] = *azureSourceAccountKey
 		config.Configuration[misc.AzureDestAccountName] = *azureDestAccountName
 		config.Configuration[misc.AzureDestAccountKey] = *azureDestAccountKey
+		config.Configuration[misc.AzureAccessToken] = *azureAccessToken
+		config.Configuration[misc.AzureTenantID] = *azureTenantID
+		config.Configuration[misc.AzureClientID] = *azureClientID
+		config.Configuration[misc.AzureClientSecret] = *azureClientSecret
+		config.Configuration[misc.AzureDefaultEndpoint] = *azureDefaultEndpoint
+		config.Configuration[misc.AzureSourceEndpoint] = *azureSourceEndpoint
+		config.Configuration[misc.AzureDestEndpoint] = *azureDestEndpoint
+		config.Configuration[misc.AzureAccessTier] = parseChoice("AzureAccessTier", *azureAccessTier, handlers.AzureTierHot, handlers.AzureTierCool, handlers.AzureTierArchive)
+		config.Configuration[misc.AzureBlobType] = parseChoice("AzureBlobType", *azureBlobType, handlers.AzureBlockBlob, handlers.AzurePageBlob, handlers.AzureAppendBlob)
+		config.AzureSnapshots = *azureSnapshots
 
 		config.Configuration[misc.S3DefaultAccessID] = *s3DefaultAccessID
 		config.Configuration[misc.S3DefaultAccessSecret] = *s3DefaultAccessSecret
@@ -145,11 +320,95 @@ func setupConfiguration() *misc.CloudConfig {
 		config.Configuration[misc.S3DestAccessID] = *s3DestAccessID
 		config.Configuration[misc.S3DestAccessSecret] = *s3DestAccessSecret
 		config.Configuration[misc.S3DestRegion] = *s3DestRegion
+
+		config.Configuration[misc.S3DefaultEndpoint] = *s3DefaultEndpoint
+		config.Configuration[misc.S3SourceEndpoint] = *s3SourceEndpoint
+		config.Configuration[misc.S3DestEndpoint] = *s3DestEndpoint
+		config.S3SourcePathStyle = *s3SourcePathStyle
+		config.S3DestPathStyle = *s3DestPathStyle
+		config.S3SourceInsecureSkipVerify = *s3SourceSkipTLSVerify
+		config.S3DestInsecureSkipVerify = *s3DestSkipTLSVerify
+
+		config.S3MultipartThreshold = *s3MultipartThreshold
+		config.S3MultipartPartSize = *s3PartSize
+		config.S3MultipartConcurrency = *s3PartConcurrency
+		config.S3MultipartRetries = *s3PartRetries
+		config.AzureBlockSize = *azureBlockSize
+		config.AzureBlockParallelism = *azureBlockParallelism
+		config.DownloadChunkSize = *downloadChunkSize
+		config.DownloadParallelism = *downloadParallelism
+
+		config.Configuration[misc.FTPDefaultHost] = *ftpDefaultHost
+		config.Configuration[misc.FTPDefaultUsername] = *ftpDefaultUsername
+		config.Configuration[misc.FTPDefaultPassword] = *ftpDefaultPassword
+		config.Configuration[misc.FTPSourceHost] = *ftpSourceHost
+		config.Configuration[misc.FTPSourceUsername] = *ftpSourceUsername
+		config.Configuration[misc.FTPSourcePassword] = *ftpSourcePassword
+		config.Configuration[misc.FTPDestHost] = *ftpDestHost
+		config.Configuration[misc.FTPDestUsername] = *ftpDestUsername
+		config.Configuration[misc.FTPDestPassword] = *ftpDestPassword
+		config.Configuration[misc.FTPMode] = parseChoice("ftpmode", *ftpMode, handlers.FTPModePassive, handlers.FTPModePASV, handlers.FTPModeActive)
+		config.FTPExplicitTLS = *ftpExplicitTLS
+		config.FTPMaxConnections = *ftpMaxConnections
+
+		config.Configuration[misc.SFTPDefaultUsername] = *sftpDefaultUsername
+		config.Configuration[misc.SFTPDefaultPassword] = *sftpDefaultPassword
+		config.Configuration[misc.SFTPDefaultPrivateKey] = *sftpDefaultPrivateKey
+		config.Configuration[misc.SFTPSourceUsername] = *sftpSourceUsername
+		config.Configuration[misc.SFTPSourcePassword] = *sftpSourcePassword
+		config.Configuration[misc.SFTPSourcePrivateKey] = *sftpSourcePrivateKey
+		config.Configuration[misc.SFTPDestUsername] = *sftpDestUsername
+		config.Configuration[misc.SFTPDestPassword] = *sftpDestPassword
+		config.Configuration[misc.SFTPDestPrivateKey] = *sftpDestPrivateKey
+		config.Configuration[misc.SFTPPrivateKeyPassphrase] = *sftpPrivateKeyPassphrase
+		config.Configuration[misc.SFTPKnownHosts] = *sftpKnownHosts
+		config.SFTPUseAgent = *sftpUseAgent
+		config.SFTPInsecureIgnoreHostKey = *sftpInsecureIgnoreHostKey
+
+		config.Configuration[misc.FilesystemServeURL] = *filesystemServeURL
+		config.Configuration[misc.FilesystemServeListenAddress] = *filesystemServeListenAddress
+		config.Configuration[misc.FilesystemSymlinks] = parseChoice("symlinks", *filesystemSymlinks, handlers.FilesystemSymlinkFollow, handlers.FilesystemSymlinkSkip, handlers.FilesystemSymlinkPreserve)
+		config.FilesystemPreserveTimes = *filesystemPreserveTimes
+		config.FilesystemPreservePermissions = *filesystemPreservePermissions
 	}
 
 	return config
 }
 
+// reportCopyResult displays the summary of the copy and returns the exit code, non-zero if anything failed.
+func reportCopyResult(result *azurecopy.CopyResult, err error) int {
+	if result != nil {
+		result.DisplaySummary()
+	}
+
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	if result != nil && result.HasFailures() {
+		return 1
+	}
+
+	return 0
+}
+
+// cancelCopiesOnInterrupt aborts any in progress CopyBlob operations if the user hits ctrl-c.
+// Otherwise Azure would keep copying in the background after we've exited.
+func cancelCopiesOnInterrupt(ac *azurecopy.AzureCopy) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+
+	go func() {
+		<-c
+		fmt.Println("Cancelling pending copies")
+		err := ac.CancelPendingCopies()
+		if err != nil {
+			log.Errorf("Unable to cancel all pending copies %s", err)
+		}
+	}()
+}
+
 // "so it begins"
 func main() {
 
@@ -168,27 +427,48 @@ func main() {
 		return
 	}
 
-	ac := azurecopy.NewAzureCopy(*config)
+	ac, err := azurecopy.NewAzureCopy(*config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// exit at the end rather than part way, so the handlers and journal are closed even if the command fails.
+	exitCode := 0
 
 	switch config.Command {
 	case misc.CommandCopy:
-		err := ac.CopyBlobByURL(config.Replace, false)
-		if err != nil {
-			log.Fatal(err)
-		}
+		result, err := ac.CopyBlobByURL(config.Replace, false)
+		exitCode = reportCopyResult(result, err)
 		break
 
 	case misc.CommandCopyBlob:
-		err := ac.CopyBlobByURL(config.Replace, true)
-		if err != nil {
-			log.Fatal(err)
+		cancelCopiesOnInterrupt(ac)
+		result, err := ac.CopyBlobByURL(config.Replace, true)
+		exitCode = reportCopyResult(result, err)
+		break
+
+	case misc.CommandSync:
+		plan, result, err := ac.SyncByURL(false, config.DryRun)
+		if plan != nil {
+			plan.DisplaySummary()
 		}
+		exitCode = reportCopyResult(result, err)
+		break
+
+	case misc.CommandMirror:
+		plan, result, err := ac.MirrorByURL(false, config.MirrorDeleteThreshold, config.DryRun)
+		if plan != nil {
+			plan.DisplaySummary()
+		}
+		exitCode = reportCopyResult(result, err)
 		break
 
 	case misc.CommandList:
 		container, err := ac.ListContainer( )
 		if err != nil {
-			log.Fatal(err)
+			log.Error(err)
+			exitCode = 1
+			break
 		}
 
 		log.Debug("List results")
@@ -202,11 +482,20 @@ func main() {
 	case misc.CommandCreateContainer:
 		err := ac.CreateContainer(config.Configuration[misc.CreateContainerName])
 		if err != nil {
-			log.Fatal(err)
+			log.Error(err)
+			exitCode = 1
 		}
 
 	case misc.CommandUnknown:
-		log.Fatal("Unsure of command to execute")
+		log.Error("Unsure of command to execute")
+		exitCode = 1
+	}
+
+	err = ac.Close()
+	if err != nil {
+		log.Errorf("Unable to close %s", err)
+		exitCode = 1
 	}
 
+	os.Exit(exitCode)
 }